@@ -0,0 +1,461 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	bolt "go.etcd.io/bbolt"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultActionQueueMaxAttempts     = 10
+	defaultActionQueueInitialInterval = 5
+	defaultActionQueueMaxInterval     = 600
+	// actionQueuePollInterval is how often the queue is checked for the actions due to retry
+	actionQueuePollInterval = time.Second
+
+	outcomeQueued = "queued"
+)
+
+var (
+	bucketActionQueue = []byte("action_queue")
+	bucketDeadLetters = []byte("dead_letters")
+
+	errActionNotFound = errors.New("the action does not exist")
+)
+
+// actionQueueConfig configures the persistent queue of the changes made on the platform
+type actionQueueConfig struct {
+	// Enabled makes the changes go through the queue kept in the store, so they survive the platform outages
+	// and the restarts. It only works when the store is set by --store-path.
+	Enabled bool `json:"enabled,omitempty"`
+	// MaxAttempts is the number of attempts before an action is moved to the dead letters, it is 10 by default.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// InitialInterval is the backoff in seconds after the first failed attempt, it is 5 by default.
+	InitialInterval int `json:"initial_interval,omitempty"`
+	// MaxInterval bounds the backoff in seconds, it is 600 by default.
+	MaxInterval int `json:"max_interval,omitempty"`
+}
+
+func (c *actionQueueConfig) validate() error {
+	if c.MaxAttempts < 0 || c.InitialInterval < 0 || c.MaxInterval < 0 {
+		return errors.New("the action_queue max_attempts, initial_interval and max_interval can not be negative")
+	}
+	return nil
+}
+
+// queuedAction is a change which is delivered to the platform at least once
+type queuedAction struct {
+	ID     uint64     `json:"id"`
+	Kind   actionKind `json:"kind"`
+	Org    string     `json:"org"`
+	Repo   string     `json:"repo"`
+	Number string     `json:"number"`
+	// CommentKind tells whether the comment is on an issue or a pull request
+	CommentKind string `json:"comment_kind"`
+	// State is the target state of UpdateIssue and UpdatePR
+	State string `json:"state,omitempty"`
+	// Body is the rendered comment
+	Body string `json:"body,omitempty"`
+	// History is recorded when the update is delivered
+	History *historyEntry `json:"history,omitempty"`
+	// Decision is published to the sinks when the update is delivered, the commenter is told by a comment
+	// if the update is moved to the dead letters
+	Decision  *auditRecord `json:"decision,omitempty"`
+	EventGUID string       `json:"event_guid,omitempty"`
+
+	CreatedAt   time.Time `json:"created_at"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// key is the issue or pull request, the actions of the same key are delivered in their order
+func (a *queuedAction) key() string {
+	return a.Org + "/" + a.Repo + "#" + a.Number
+}
+
+// actionQueue keeps the pending actions and the dead letters in the store.
+// The actions are delivered by runActionQueue alone, and every change of the queue is one transaction,
+// so the operations on the dead letters don't wait for the platform.
+type actionQueue struct {
+	s       *store
+	retrier *retrier
+	// wakeup is signaled when an action is queued
+	wakeup chan struct{}
+	now    func() time.Time
+}
+
+func newActionQueue(s *store, c *actionQueueConfig) (*actionQueue, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketActionQueue); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketDeadLetters)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &retryConfig{MaxAttempts: c.MaxAttempts, InitialInterval: c.InitialInterval, MaxInterval: c.MaxInterval}
+	if rc.MaxAttempts == 0 {
+		rc.MaxAttempts = defaultActionQueueMaxAttempts
+	}
+	if rc.InitialInterval == 0 {
+		rc.InitialInterval = defaultActionQueueInitialInterval
+	}
+	if rc.MaxInterval == 0 {
+		rc.MaxInterval = defaultActionQueueMaxInterval
+	}
+
+	return &actionQueue{
+		s:       s,
+		retrier: newRetrier(rc),
+		wakeup:  make(chan struct{}, 1),
+		now:     time.Now,
+	}, nil
+}
+
+// enqueue adds the action to the end of the queue
+func (q *actionQueue) enqueue(a *queuedAction) error {
+	now := q.now()
+	a.CreatedAt, a.NextAttempt = now, now
+
+	err := q.s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketActionQueue)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		a.ID = seq
+
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(seq), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func listActions(tx *bolt.Tx, bucket []byte) ([]queuedAction, error) {
+	var actions []queuedAction
+	err := tx.Bucket(bucket).ForEach(func(_, v []byte) error {
+		a := queuedAction{}
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		actions = append(actions, a)
+		return nil
+	})
+	return actions, err
+}
+
+func putAction(tx *bolt.Tx, bucket []byte, a *queuedAction) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put(itob(a.ID), data)
+}
+
+// due returns the actions which can be delivered now, it is the first action of every issue or pull request
+// if it is due. The later actions of an issue or pull request wait for the earlier ones.
+func (q *actionQueue) due() ([]queuedAction, error) {
+	var actions []queuedAction
+	err := q.s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		actions, err = listActions(tx, bucketActionQueue)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := q.now()
+	seen := map[string]bool{}
+	var due []queuedAction
+	for i := range actions {
+		key := actions[i].key()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if !actions[i].NextAttempt.After(now) {
+			due = append(due, actions[i])
+		}
+	}
+	return due, nil
+}
+
+// complete removes the delivered action from the queue
+func (q *actionQueue) complete(a *queuedAction) error {
+	return q.s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketActionQueue).Delete(itob(a.ID))
+	})
+}
+
+// fail schedules the next attempt of the action, or moves it to the dead letters if it can't be delivered.
+// It reports if the action is moved to the dead letters.
+// The action which was not sent because of the open circuit is attempted again when the circuit is half-open.
+func (q *actionQueue) fail(a *queuedAction, err error) (dead bool, _ error) {
+	a.LastError = err.Error()
+	if errors.Is(err, errCircuitOpen) {
+		// The circuit which doesn't tell when it is half-open is attempted after the first backoff
+		if a.NextAttempt, _ = retryAt(err); a.NextAttempt.IsZero() {
+			a.NextAttempt = q.now().Add(q.retrier.backoff(1))
+		}
+	} else {
+		a.Attempts++
+		dead = !isRetryable(err) || a.Attempts >= q.retrier.maxAttempts
+
+		d := q.retrier.backoff(a.Attempts)
+		if reset, ok := rateLimitReset(err); ok && reset.After(q.now().Add(d)) {
+			d = reset.Sub(q.now())
+		}
+		a.NextAttempt = q.now().Add(d)
+	}
+
+	return dead, q.s.db.Update(func(tx *bolt.Tx) error {
+		if !dead {
+			return putAction(tx, bucketActionQueue, a)
+		}
+		if err := tx.Bucket(bucketActionQueue).Delete(itob(a.ID)); err != nil {
+			return err
+		}
+		return putAction(tx, bucketDeadLetters, a)
+	})
+}
+
+// deadLetters returns the actions which failed to be delivered, the oldest comes first
+func (q *actionQueue) deadLetters() (actions []queuedAction, err error) {
+	err = q.s.db.View(func(tx *bolt.Tx) error {
+		actions, err = listActions(tx, bucketDeadLetters)
+		return err
+	})
+	return
+}
+
+// retryDeadLetter puts the dead letter back to the queue at its original position
+func (q *actionQueue) retryDeadLetter(id uint64) error {
+	err := q.s.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketDeadLetters).Get(itob(id))
+		if v == nil {
+			return errActionNotFound
+		}
+
+		a := queuedAction{}
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		a.Attempts, a.NextAttempt = 0, q.now()
+		if err := tx.Bucket(bucketDeadLetters).Delete(itob(id)); err != nil {
+			return err
+		}
+		return putAction(tx, bucketActionQueue, &a)
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// discardDeadLetter deletes the dead letter
+func (q *actionQueue) discardDeadLetter(id uint64) error {
+	return q.s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketDeadLetters)
+		if b.Get(itob(id)) == nil {
+			return errActionNotFound
+		}
+		return b.Delete(itob(id))
+	})
+}
+
+// runActionQueue delivers the queued actions until the robot shuts down
+func (bot *robot) runActionQueue() {
+	if bot.actions == nil {
+		return
+	}
+
+	ticker := time.NewTicker(actionQueuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		bot.deliverDueActions()
+
+		select {
+		case <-bot.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-bot.actions.wakeup:
+		}
+	}
+}
+
+// deliverDueActions tries to deliver every action due once
+func (bot *robot) deliverDueActions() {
+	due, err := bot.actions.due()
+	if err != nil {
+		bot.logError(err, "failed to list the queued actions")
+		return
+	}
+
+	for i := range due {
+		if bot.interrupted() {
+			return
+		}
+		bot.deliverAction(&due[i])
+	}
+}
+
+func (bot *robot) deliverAction(a *queuedAction) {
+	ctx, cancel := bot.eventContext(a.EventGUID)
+	defer cancel()
+
+	err := bot.sendAction(ctx, a)
+	if errors.Is(err, errConflict) && bot.dropConflictedAction(ctx, a) {
+		return
+	}
+	if err == nil {
+		if err = bot.actions.complete(a); err != nil {
+			bot.logError(err, "failed to remove the delivered action "+strconv.FormatUint(a.ID, 10))
+		}
+		if a.History != nil && bot.history != nil {
+			if err = bot.history.add(a.Org, a.Repo, a.Number, a.History); err != nil {
+				bot.logError(err, "failed to record the history of "+a.key())
+			}
+		}
+		if a.Decision != nil {
+			rec := *a.Decision
+			rec.Outcome = outcomeSuccess
+			bot.notify(a.Org, a.Repo, &rec)
+		}
+		return
+	}
+
+	// The action is attempted again after the shutdown
+	if bot.interrupted() {
+		return
+	}
+
+	dead, qerr := bot.actions.fail(a, err)
+	if qerr != nil {
+		bot.logError(qerr, "failed to reschedule the action "+strconv.FormatUint(a.ID, 10))
+		return
+	}
+	if !dead {
+		return
+	}
+
+	bot.logError(err, "move the action "+strconv.FormatUint(a.ID, 10)+" on "+a.key()+" to the dead letters")
+	// Tells the commenter that the update failed as handleUpdateError does
+	if a.Decision == nil {
+		return
+	}
+	if template := updateFailureTemplate(err); template != "" {
+		bot.enqueueComment(a.EventGUID, a.Org, a.Repo, a.Number, a.CommentKind,
+			bot.cnf.renderComment(updateFailureComment(template, a.Decision)))
+	}
+}
+
+// dropConflictedAction completes the update which conflicted, if someone else changed the issue or pull request
+// to the state at the same time. It reports if the action is completed.
+func (bot *robot) dropConflictedAction(ctx context.Context, a *queuedAction) bool {
+	if a.Decision == nil {
+		return false
+	}
+	plan, pa := a.plan(), &plannedAction{Kind: a.Kind, State: a.State}
+	if !bot.inState(ctx, plan, pa) {
+		return false
+	}
+
+	if err := bot.actions.complete(a); err != nil {
+		bot.logError(err, "failed to remove the action "+strconv.FormatUint(a.ID, 10))
+	}
+	rec := *a.Decision
+	bot.dropChangedAtSameTime(plan, pa, &rec)
+	bot.notify(a.Org, a.Repo, &rec)
+	return true
+}
+
+// plan returns the plan which the queued update was made for, the action must have the decision
+func (a *queuedAction) plan() *lifecyclePlan {
+	return newLifecyclePlan(a.Org, a.Repo, a.Number, a.CommentKind, a.Decision.Action)
+}
+
+func (bot *robot) sendAction(ctx context.Context, a *queuedAction) error {
+	switch a.Kind {
+	case actionKindUpdateIssue, actionKindUpdatePR:
+		var err error
+		if a.Kind == actionKindUpdatePR {
+			err = bot.cli.UpdatePR(ctx, a.Org, a.Repo, a.Number, a.State)
+		} else {
+			err = bot.cli.UpdateIssue(ctx, a.Org, a.Repo, a.Number, a.State)
+		}
+		if err == nil {
+			bot.guard.recordOwn(a.key(), a.State)
+		}
+		return err
+	case actionKindComment:
+		if a.CommentKind == client.CommentOnIssue {
+			return bot.cli.CreateIssueComment(ctx, a.Org, a.Repo, a.Number, a.Body)
+		}
+		return bot.cli.CreatePRComment(ctx, a.Org, a.Repo, a.Number, a.Body)
+	}
+	return &apiError{kind: errUnexpected, op: "deliver the action", err: errors.New("unknown kind " + string(a.Kind))}
+}
+
+// queueUpdate queues the update of the plan, it reports if the update is queued
+func (bot *robot) queueUpdate(plan *lifecyclePlan, rec *auditRecord, a *plannedAction) bool {
+	err := bot.actions.enqueue(&queuedAction{
+		Kind: a.Kind, Org: plan.Org, Repo: plan.Repo, Number: plan.Number, CommentKind: plan.CommentKind,
+		State: a.State, History: newHistoryEntry(rec), EventGUID: rec.EventGUID, Decision: rec,
+	})
+	if err != nil {
+		bot.logError(err, "failed to queue the "+plan.Command+" of "+rec.Target+", apply it directly")
+		return false
+	}
+
+	rec.Outcome = outcomeQueued
+	return true
+}
+
+func (bot *robot) enqueueComment(guid, org, repo, number, commentKind, body string) {
+	err := bot.actions.enqueue(&queuedAction{
+		Kind: actionKindComment, Org: org, Repo: repo, Number: number,
+		CommentKind: commentKind, Body: body, EventGUID: guid,
+	})
+	if err != nil {
+		bot.logError(err, "failed to queue the comment on "+org+"/"+repo+"#"+number)
+	}
+}
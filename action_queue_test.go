@@ -0,0 +1,298 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestActionQueue(t *testing.T, now *time.Time) *actionQueue {
+	q, err := newActionQueue(newTestStore(t), &actionQueueConfig{MaxAttempts: 2, InitialInterval: 10, MaxInterval: 60})
+	assert.Equal(t, nil, err)
+	q.now = func() time.Time { return *now }
+	q.retrier.jitter = func(time.Duration) time.Duration { return 0 }
+	return q
+}
+
+func TestActionQueue(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	q := newTestActionQueue(t, &now)
+
+	for _, a := range []queuedAction{
+		{Kind: actionKindUpdateIssue, Org: org, Repo: repo, Number: number, State: "closed"},
+		{Kind: actionKindComment, Org: org, Repo: repo, Number: number, Body: "closed"},
+		{Kind: actionKindUpdatePR, Org: org, Repo: repo, Number: "2", State: "closed"},
+	} {
+		assert.Equal(t, nil, q.enqueue(&a))
+	}
+
+	// the comment waits for the update of the same issue
+	due, err := q.due()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(due))
+	assert.Equal(t, uint64(1), due[0].ID)
+	assert.Equal(t, uint64(3), due[1].ID)
+
+	// the failed update is retried after the backoff, and holds the comment back
+	dead, err := q.fail(&due[0], newTransientError("update", errTransient))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, dead)
+	assert.Equal(t, nil, q.complete(&due[1]))
+	due, _ = q.due()
+	assert.Equal(t, 0, len(due))
+
+	now = now.Add(5 * time.Second)
+	due, _ = q.due()
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, 1, due[0].Attempts)
+
+	// the attempts are used up
+	dead, err = q.fail(&due[0], newTransientError("update", errTransient))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, dead)
+
+	due, _ = q.due()
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, actionKindComment, due[0].Kind)
+
+	letters, err := q.deadLetters()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, uint64(1), letters[0].ID)
+
+	// the retried dead letter goes back before the comment
+	assert.Equal(t, nil, q.retryDeadLetter(1))
+	due, _ = q.due()
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, uint64(1), due[0].ID)
+	assert.Equal(t, 0, due[0].Attempts)
+	assert.Equal(t, errActionNotFound, q.retryDeadLetter(1))
+
+	// an error which is not retryable moves the action to the dead letters at once
+	dead, _ = q.fail(&due[0], &apiError{kind: errForbidden, op: "update", status: http.StatusForbidden})
+	assert.Equal(t, true, dead)
+	assert.Equal(t, nil, q.discardDeadLetter(1))
+	assert.Equal(t, errActionNotFound, q.discardDeadLetter(1))
+	letters, _ = q.deadLetters()
+	assert.Equal(t, 0, len(letters))
+
+	// the action is attempted again when the circuit is half-open, without using up the attempts
+	due, _ = q.due()
+	dead, _ = q.fail(&due[0], &apiError{kind: errCircuitOpen, op: "comment", resetAt: now.Add(time.Hour)})
+	assert.Equal(t, false, dead)
+	now = now.Add(time.Hour)
+	due, _ = q.due()
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, 0, due[0].Attempts)
+
+	// the action is attempted again after the backoff if the circuit doesn't tell when it is half-open
+	dead, _ = q.fail(&due[0], &apiError{kind: errCircuitOpen, op: "comment"})
+	assert.Equal(t, false, dead)
+	due, _ = q.due()
+	assert.Equal(t, 0, len(due))
+	now = now.Add(10 * time.Second)
+	due, _ = q.due()
+	assert.Equal(t, 1, len(due))
+}
+
+func TestExecutePlanQueued(t *testing.T) {
+	now := time.Now()
+	st := newTestStore(t)
+	h, err := newLifecycleHistory(st)
+	assert.Equal(t, nil, err)
+	q, err := newActionQueue(st, &actionQueueConfig{MaxAttempts: 1})
+	assert.Equal(t, nil, err)
+	q.now = func() time.Time { return now }
+
+	buf := new(bytes.Buffer)
+	mc := &mockClient{}
+	bot := &robot{cli: mc, cnf: &configuration{
+		EventStateOpened:          "opened",
+		EventStateClosed:          "closed",
+		CommentUpdateStateFailure: "failed to __action__",
+	}, audit: &writerAuditSink{w: buf}, history: h, actions: q}
+
+	plan := newLifecyclePlan(org, repo, number, client.CommentOnIssue, actionClose)
+	plan.add(plannedAction{Kind: actionKindUpdateIssue, State: "closed"})
+	rec := bot.executePlan(context.Background(), new(client.GenericEvent), plan)
+	assert.Equal(t, outcomeQueued, rec.Outcome)
+	// nothing is changed on the platform until the action is delivered
+	assert.Equal(t, "", mc.method)
+
+	// the update is dead-lettered, and the failure comment is queued
+	bot.deliverDueActions()
+	assert.Equal(t, "UpdateIssue", mc.method)
+	letters, _ := q.deadLetters()
+	assert.Equal(t, 1, len(letters))
+	due, _ := q.due()
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, "failed to close", due[0].Body)
+
+	// the transition is recorded when the update is delivered
+	mc.successfulUpdateIssue, mc.successfulCreateIssueComment = true, true
+	assert.Equal(t, nil, q.retryDeadLetter(letters[0].ID))
+	bot.deliverDueActions()
+	bot.deliverDueActions()
+	due, _ = q.due()
+	assert.Equal(t, 0, len(due))
+	entries, _ := h.list(org, repo, number)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, actionClose, entries[0].Action)
+}
+
+func TestDeliverActionUpdateFailure(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		failure error
+		// state is the current state read again after the conflict
+		state   string
+		dead    int
+		comment string
+	}{
+		{
+			"the token lacks the permission",
+			&apiError{kind: errForbidden, op: "UpdateIssue", status: 403},
+			"",
+			1,
+			"the robot can't close",
+		},
+		{
+			"the issue was closed by someone else at the same time",
+			&apiError{kind: errConflict, op: "UpdateIssue", status: 409},
+			"closed",
+			0,
+			"",
+		},
+		{
+			"the update conflicts with the issue which is still opened",
+			&apiError{kind: errConflict, op: "UpdateIssue", status: 409},
+			"opened",
+			1,
+			"failed to close",
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			now := time.Now()
+			q := newTestActionQueue(t, &now)
+			mc := &mockClient{successfulGetState: true, state: testCases[i].state, failure: testCases[i].failure}
+			bot := &robot{cli: mc, cnf: &configuration{
+				CommentUpdateStateFailure:   "failed to __action__",
+				CommentUpdateStateForbidden: "the robot can't __action__",
+			}, actions: q}
+
+			plan := newLifecyclePlan(org, repo, number, client.CommentOnIssue, actionClose)
+			plan.add(plannedAction{Kind: actionKindUpdateIssue, State: "closed"})
+			bot.executePlan(context.Background(), new(client.GenericEvent), plan)
+			bot.deliverDueActions()
+
+			letters, _ := q.deadLetters()
+			assert.Equal(t, testCases[i].dead, len(letters))
+			due, _ := q.due()
+			if testCases[i].comment == "" {
+				assert.Equal(t, 0, len(due))
+			} else {
+				assert.Equal(t, 1, len(due))
+				assert.Equal(t, testCases[i].comment, due[0].Body)
+			}
+		})
+	}
+}
+
+func TestDeadLettersHandler(t *testing.T) {
+	now := time.Now()
+	q := newTestActionQueue(t, &now)
+	assert.Equal(t, nil, q.enqueue(&queuedAction{Kind: actionKindUpdateIssue, Org: org, Repo: repo, Number: number}))
+	due, _ := q.due()
+	_, _ = q.fail(&due[0], &apiError{kind: errForbidden, op: "update", status: http.StatusForbidden})
+
+	h := requireAdminToken([]byte("secret"), q)
+	testCases := []struct {
+		desc   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{
+			"no token",
+			http.MethodGet,
+			"/admin/dead-letters/",
+			"",
+			http.StatusUnauthorized,
+		},
+		{
+			"wrong token",
+			http.MethodGet,
+			"/admin/dead-letters/",
+			"Bearer guess",
+			http.StatusUnauthorized,
+		},
+		{
+			"list the dead letters",
+			http.MethodGet,
+			"/admin/dead-letters/",
+			"Bearer secret",
+			http.StatusOK,
+		},
+		{
+			"invalid id",
+			http.MethodPost,
+			"/admin/dead-letters/one/retry",
+			"Bearer secret",
+			http.StatusBadRequest,
+		},
+		{
+			"retry the dead letter",
+			http.MethodPost,
+			"/admin/dead-letters/1/retry",
+			"Bearer secret",
+			http.StatusNoContent,
+		},
+		{
+			"the dead letter is retried already",
+			http.MethodDelete,
+			"/admin/dead-letters/1",
+			"Bearer secret",
+			http.StatusNotFound,
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			r := httptest.NewRequest(testCases[i].method, testCases[i].path, nil)
+			if testCases[i].token != "" {
+				r.Header.Set("Authorization", testCases[i].token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, testCases[i].status, w.Code)
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var letters []queuedAction
+			assert.Equal(t, nil, json.Unmarshal(w.Body.Bytes(), &letters))
+			assert.Equal(t, 1, len(letters))
+		})
+	}
+}
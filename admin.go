@@ -0,0 +1,161 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	deadLettersPath = "/admin/dead-letters/"
+	permissionsPath = "/admin/permissions/"
+	issuesPath      = "/admin/issues/"
+)
+
+// requireAdminToken only passes the requests with the admin token in the Authorization header
+func requireAdminToken(token []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if len(token) == 0 || subtle.ConstantTimeCompare(got, token) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP serves the dead letters of the action queue:
+//
+//	GET    /admin/dead-letters/            lists the dead letters
+//	POST   /admin/dead-letters/{id}/retry  puts the dead letter back to the queue
+//	DELETE /admin/dead-letters/{id}        discards the dead letter
+func (q *actionQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, deadLettersPath), "/"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && parts[0] == "":
+		actions, err := q.deadLetters()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if actions == nil {
+			actions = []queuedAction{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(actions)
+
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "retry":
+		q.serveDeadLetter(w, parts[0], q.retryDeadLetter)
+
+	case r.Method == http.MethodDelete && len(parts) == 1 && parts[0] != "":
+		q.serveDeadLetter(w, parts[0], q.discardDeadLetter)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (q *actionQueue) serveDeadLetter(w http.ResponseWriter, id string, op func(uint64) error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id: "+id, http.StatusBadRequest)
+		return
+	}
+
+	err = op(n)
+	switch {
+	case errors.Is(err, errActionNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ServeHTTP invalidates the cached permissions, for example after the members of a repository changed:
+//
+//	DELETE /admin/permissions/{org}[/{repo}[/{user}]]
+//
+// The user is invalidated in all the repositories by DELETE /admin/permissions/?user={user}.
+func (c *permissionCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, permissionsPath), "/"), "/", 3)
+	parts = append(parts, "", "")
+	user := parts[2]
+	if user == "" {
+		user = r.URL.Query().Get("user")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"invalidated": c.invalidate(parts[0], parts[1], user)})
+}
+
+// serveIssueCommand runs the close or reopen on an issue for an operator:
+//
+//	POST /admin/issues/{org}/{repo}/{number}/close
+//	POST /admin/issues/{org}/{repo}/{number}/reopen
+//
+// The body is {"operator": "...", "force": false}, and the audit record of the decision is responded.
+func (bot *robot) serveIssueCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, issuesPath), "/"), "/")
+	if len(parts) != 4 || (parts[3] != actionClose && parts[3] != actionReopen) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if _, err := strconv.ParseUint(parts[2], 10, 64); err != nil {
+		http.Error(w, "invalid number: "+parts[2], http.StatusBadRequest)
+		return
+	}
+
+	var cmd adminCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := cmd.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rec, err := bot.runAdminCommand(parts[0], parts[1], parts[2], parts[3], &cmd)
+	switch {
+	case errors.Is(err, errRepoNotConfigured), errors.Is(err, errNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errCommandNotApplicable):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errInterrupted), errors.Is(err, errQueueFull):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(rec)
+	}
+}
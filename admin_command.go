@@ -0,0 +1,124 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/framework"
+	"strings"
+)
+
+var (
+	errRepoNotConfigured    = errors.New("no config for the repo")
+	errCommandNotApplicable = errors.New("the command doesn't apply to the current state")
+	errInterrupted          = errors.New("the robot is shutting down")
+)
+
+// adminCommand is a close or reopen which an operator runs with the admin API
+type adminCommand struct {
+	// Operator is the user whom the command is run for, the permission is checked against it unless forced
+	Operator string `json:"operator"`
+	// Force skips the permission and linked pull request checks, it is recorded in the audit
+	Force bool `json:"force,omitempty"`
+}
+
+func (c *adminCommand) validate() error {
+	if strings.TrimSpace(c.Operator) == "" {
+		return errors.New("the operator can not be empty")
+	}
+	return nil
+}
+
+// runAdminCommand runs the close or reopen on the issue for the operator. It goes through the same policy
+// as the commented command, unless it is forced, and returns the audit record of the decision.
+// The shutdown waits for the command like the events, but doesn't write it to the unfinished events file,
+// the operator gets errInterrupted and runs it again.
+func (bot *robot) runAdminCommand(org, repo, number, command string, cmd *adminCommand) (rec *auditRecord, err error) {
+	repoCnf := bot.cnf.getRepoConfig(org, repo)
+	if repoCnf == nil {
+		return nil, errRepoNotConfigured
+	}
+
+	guid := "admin-" + randomID()
+	tracked := newAdminEvent(guid, org, repo, number, command, cmd.Operator, "", "")
+	if !bot.inflight.add(tracked, true) {
+		return nil, errInterrupted
+	}
+	defer bot.inflight.done(tracked)
+
+	qerr := bot.queue.do(org+"/"+repo+"#"+number, func() {
+		if bot.interrupted() {
+			err = errInterrupted
+			return
+		}
+		ctx, cancel := bot.eventContext(guid)
+		defer cancel()
+
+		// The current state and author are read, because there is no webhook carrying them
+		state, author, gerr := bot.comments.GetItem(ctx, org, repo, client.CommentOnIssue, number)
+		if gerr != nil {
+			err = gerr
+			return
+		}
+		evt := newAdminEvent(guid, org, repo, number, command, cmd.Operator, author, state)
+
+		b := bot.withRepoMode(repoCnf)
+		var plan *lifecyclePlan
+		if cmd.Force {
+			plan = b.planForced(ctx, org, repo, number, command, cmd.Operator)
+		} else if plan = b.planReopen(ctx, evt, org, repo, number); plan == nil {
+			plan = b.planClose(ctx, evt, repoCnf, org, repo, number)
+		}
+		if plan == nil {
+			err = errCommandNotApplicable
+			return
+		}
+		plan.Operator, plan.Force = cmd.Operator, cmd.Force
+		rec = b.executePlan(ctx, evt, plan)
+	})
+	if qerr != nil {
+		return nil, qerr
+	}
+	return
+}
+
+// newAdminEvent returns the event of the command as if the operator commented it on the issue
+func newAdminEvent(guid, org, repo, number, command, operator, author, state string) *client.GenericEvent {
+	strs := []string{
+		framework.NoteEvent, guid, org, repo, number, client.CommentOnIssue, "/" + command, operator, author, state,
+	}
+	return &client.GenericEvent{
+		EventType: &strs[0], EventGUID: &strs[1], Org: &strs[2], Repo: &strs[3], Number: &strs[4],
+		CommentKind: &strs[5], Comment: &strs[6], Commenter: &strs[7], Author: &strs[8], State: &strs[9],
+	}
+}
+
+// planForced plans the command without the permission and linked pull request checks,
+// nothing is changed if the issue is already in the state
+func (bot *robot) planForced(ctx context.Context, org, repo, number, command, operator string) *lifecyclePlan {
+	plan := newLifecyclePlan(org, repo, number, client.CommentOnIssue, command)
+	plan.Role = roleOperator
+
+	state := bot.cnf.EventStateClosed
+	if command == actionReopen {
+		state = bot.cnf.EventStateOpened
+	}
+	bot.planStateChange(ctx, plan, actionKindUpdateIssue, state, operator)
+	if plan.Policy == policyAllowed {
+		plan.Policy = policyForced
+	}
+	return plan
+}
@@ -0,0 +1,150 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/server-common-lib/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeIssueCommand(t *testing.T) {
+	forge := newFakeForge()
+	forgeSrv := httptest.NewServer(forge)
+	t.Cleanup(forgeSrv.Close)
+
+	cnf := &configuration{}
+	assert.Equal(t, nil, utils.LoadFromYaml(findTestdata(t, configYaml), cnf))
+
+	logger := logrus.NewEntry(logrus.New())
+	logger.Logger.SetLevel(logrus.PanicLevel)
+	cli := newForgeClient(forgeSrv.URL, cnf, logger)
+	bot := &robot{cli: cli, cnf: cnf, log: logger, comments: cli}
+	handler := requireAdminToken([]byte("admin"), http.HandlerFunc(bot.serveIssueCommand))
+
+	testCases := []struct {
+		desc   string
+		method string
+		path   string
+		token  string
+		body   string
+		state  string
+		status int
+		out    *auditRecord
+	}{
+		{
+			"without the admin token",
+			http.MethodPost, "/admin/issues/owner3/repo1/1/close", "", `{"operator":"admin1"}`,
+			"opened", http.StatusUnauthorized, nil,
+		},
+		{
+			"unknown command",
+			http.MethodPost, "/admin/issues/owner3/repo1/1/lock", "admin", `{"operator":"admin1"}`,
+			"opened", http.StatusNotFound, nil,
+		},
+		{
+			"not a post",
+			http.MethodGet, "/admin/issues/owner3/repo1/1/close", "admin", "",
+			"opened", http.StatusMethodNotAllowed, nil,
+		},
+		{
+			"without the operator",
+			http.MethodPost, "/admin/issues/owner3/repo1/1/close", "admin", `{"force":true}`,
+			"opened", http.StatusBadRequest, nil,
+		},
+		{
+			"repository not configured",
+			http.MethodPost, "/admin/issues/owner9/repo1/1/close", "admin", `{"operator":"admin1"}`,
+			"opened", http.StatusNotFound, nil,
+		},
+		{
+			"issue not found",
+			http.MethodPost, "/admin/issues/owner3/repo1/2/close", "admin", `{"operator":"admin1"}`,
+			"opened", http.StatusNotFound, nil,
+		},
+		{
+			"operator without the permission",
+			http.MethodPost, "/admin/issues/owner3/repo1/1/close", "admin", `{"operator":"user1"}`,
+			"opened", http.StatusOK,
+			&auditRecord{Actor: "user1", Action: actionClose, Role: roleNone, Policy: policyNoPermission,
+				Outcome: outcomeSkipped, Operator: "user1"},
+		},
+		{
+			"issue without the linked pull request",
+			http.MethodPost, "/admin/issues/owner3/repo1/1/close", "admin", `{"operator":"admin1"}`,
+			"opened", http.StatusOK,
+			&auditRecord{Actor: "admin1", Action: actionClose, Role: roleCollaborator, Policy: policyNeedsLinkPR,
+				Outcome: outcomeSkipped, Operator: "admin1"},
+		},
+		{
+			"forced close",
+			http.MethodPost, "/admin/issues/owner3/repo1/1/close", "admin", `{"operator":"user1","force":true}`,
+			"closed", http.StatusOK,
+			&auditRecord{Actor: "user1", Action: actionClose, Role: roleOperator, Policy: policyForced,
+				Outcome: outcomeSuccess, Operator: "user1", Force: true},
+		},
+		{
+			"reopen of an opened issue",
+			http.MethodPost, "/admin/issues/owner3/repo1/1/reopen", "admin", `{"operator":"admin1"}`,
+			"opened", http.StatusConflict, nil,
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			forge.reset([]forgeItem{{Org: "owner3", Repo: "repo1", Number: "1", State: "opened", Author: "author1"}},
+				nil, []string{"owner3/repo1/admin1"}, nil)
+
+			r := httptest.NewRequest(testCases[i].method, testCases[i].path, strings.NewReader(testCases[i].body))
+			r.Header.Set("Authorization", "Bearer "+testCases[i].token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, testCases[i].status, w.Code)
+
+			item, _ := forge.item(kindIssue, "owner3", "repo1", "1")
+			assert.Equal(t, testCases[i].state, item.State)
+			if testCases[i].out == nil {
+				return
+			}
+
+			var rec auditRecord
+			assert.Equal(t, nil, json.NewDecoder(w.Body).Decode(&rec))
+			assert.Equal(t, true, strings.HasPrefix(rec.EventGUID, "admin-"))
+			want := *testCases[i].out
+			want.Time, want.EventGUID = rec.Time, rec.EventGUID
+			want.Author, want.Target, want.TargetKind = "author1", "owner3/repo1#1", client.CommentOnIssue
+			assert.Equal(t, want, rec)
+		})
+	}
+
+	// the command is tracked with the events, and refused once the shutdown lists them
+	bot.inflight = newEventTracker()
+	forge.reset([]forgeItem{{Org: "owner3", Repo: "repo1", Number: "1", State: "opened", Author: "author1"}},
+		nil, []string{"owner3/repo1/admin1"}, nil)
+	_, err := bot.runAdminCommand("owner3", "repo1", "1", actionClose, &adminCommand{Operator: "user1", Force: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bot.inflight.wait(context.Background()))
+
+	assert.Equal(t, []*client.GenericEvent{}, bot.inflight.close())
+	_, err = bot.runAdminCommand("owner3", "repo1", "1", actionReopen, &adminCommand{Operator: "user1", Force: true})
+	assert.Equal(t, errInterrupted, err)
+	item, _ := forge.item(kindIssue, "owner3", "repo1", "1")
+	assert.Equal(t, "closed", item.State)
+}
@@ -0,0 +1,133 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The classes of the errors returned by iClient, check them with errors.Is
+var (
+	// errNotFound means the issue, pull request or repository doesn't exist, for example it was deleted
+	errNotFound = errors.New("not found")
+	// errForbidden means the token of the robot lacks the permission or scope
+	errForbidden = errors.New("forbidden")
+	// errRateLimited means the rate limit of the platform is exceeded, see rateLimitReset
+	errRateLimited = errors.New("rate limited")
+	// errConflict means the request conflicts with the current state on the platform
+	errConflict = errors.New("conflict")
+	// errTransient means the request failed on the network or on the server, it may succeed later
+	errTransient = errors.New("transient failure")
+	// errUnexpected means the platform responded an unexpected status, the request won't succeed on retries
+	errUnexpected = errors.New("unexpected response")
+	// errCircuitOpen means the request was not sent, because the requests of the method failed repeatedly.
+	// It is returned by limitedClient, see retryAt.
+	errCircuitOpen = errors.New("circuit open")
+)
+
+// apiError is a failed request to the platform
+type apiError struct {
+	kind   error
+	op     string
+	status int
+	// resetAt is when the rate limit is reset for errRateLimited, or when the circuit is half-open for errCircuitOpen
+	resetAt time.Time
+	err     error
+}
+
+func (e *apiError) Error() string {
+	s := e.op + ": " + e.kind.Error()
+	if e.status != 0 {
+		s += fmt.Sprintf(", response status: %d", e.status)
+	}
+	if e.err != nil {
+		s += ", " + e.err.Error()
+	}
+	return s
+}
+
+func (e *apiError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+// newStatusError classifies the failed response by its status code and headers
+func newStatusError(op string, status int, header http.Header) error {
+	e := &apiError{op: op, status: status}
+
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		e.kind = errNotFound
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.kind = errForbidden
+	case status == http.StatusTooManyRequests:
+		e.kind = errRateLimited
+		e.resetAt = parseRateLimitReset(header, time.Now())
+	case status == http.StatusConflict:
+		e.kind = errConflict
+	case status >= http.StatusInternalServerError || status == http.StatusRequestTimeout:
+		e.kind = errTransient
+	default:
+		e.kind = errUnexpected
+	}
+	return e
+}
+
+// newTransientError wraps the error of a request which failed before a response was received
+func newTransientError(op string, err error) error {
+	return &apiError{kind: errTransient, op: op, err: err}
+}
+
+// parseRateLimitReset reads when the rate limit is reset from the Retry-After header in seconds,
+// or from the X-RateLimit-Reset header in unix seconds. It is zero if they are absent.
+func parseRateLimitReset(header http.Header, now time.Time) time.Time {
+	if v, err := strconv.ParseInt(header.Get("Retry-After"), 10, 64); err == nil {
+		return now.Add(time.Duration(v) * time.Second)
+	}
+	if v, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		return time.Unix(v, 0)
+	}
+	return time.Time{}
+}
+
+// rateLimitReset returns when the rate limit is reset if err is a rate limited error which knows it
+func rateLimitReset(err error) (time.Time, bool) {
+	var e *apiError
+	if errors.As(err, &e) && e.kind == errRateLimited && !e.resetAt.IsZero() {
+		return e.resetAt, true
+	}
+	return time.Time{}, false
+}
+
+// retryAt returns when the request can be sent again if err is a rate limited error which knows it,
+// or an error of the open circuit
+func retryAt(err error) (time.Time, bool) {
+	var e *apiError
+	if errors.As(err, &e) && e.kind == errCircuitOpen {
+		return e.resetAt, true
+	}
+	return rateLimitReset(err)
+}
+
+// isRetryable reports if the failed request may succeed when it is sent again
+func isRetryable(err error) bool {
+	return errors.Is(err, errTransient) || errors.Is(err, errRateLimited)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewStatusError(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		status    int
+		kind      error
+		retryable bool
+	}{
+		{"the issue was deleted", http.StatusNotFound, errNotFound, false},
+		{"the token lacks the scope", http.StatusForbidden, errForbidden, false},
+		{"the token is invalid", http.StatusUnauthorized, errForbidden, false},
+		{"the rate limit is exceeded", http.StatusTooManyRequests, errRateLimited, true},
+		{"the state was changed", http.StatusConflict, errConflict, false},
+		{"the server is unavailable", http.StatusServiceUnavailable, errTransient, true},
+		{"the request is invalid", http.StatusBadRequest, errUnexpected, false},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			err := newStatusError("GET repos/owner1/repo1/issues/1", testCases[i].status, http.Header{})
+			assert.Equal(t, true, errors.Is(err, testCases[i].kind))
+			assert.Equal(t, testCases[i].retryable, isRetryable(err))
+		})
+	}
+
+	err := newTransientError("GET repos/owner1/repo1/issues/1", errors.New("connection refused"))
+	assert.Equal(t, "GET repos/owner1/repo1/issues/1: transient failure, connection refused", err.Error())
+	assert.Equal(t, true, isRetryable(err))
+}
+
+func TestParseRateLimitReset(t *testing.T) {
+	now := time.Date(2024, 12, 15, 10, 0, 0, 0, time.UTC)
+
+	header := http.Header{}
+	assert.Equal(t, time.Time{}, parseRateLimitReset(header, now))
+
+	header.Set("X-RateLimit-Reset", "1734256860")
+	assert.Equal(t, time.Unix(1734256860, 0), parseRateLimitReset(header, now))
+
+	header.Set("Retry-After", "30")
+	assert.Equal(t, now.Add(30*time.Second), parseRateLimitReset(header, now))
+
+	err := &apiError{kind: errRateLimited, resetAt: now}
+	reset, ok := rateLimitReset(err)
+	assert.Equal(t, []interface{}{now, true}, []interface{}{reset, ok})
+	_, ok = rateLimitReset(&apiError{kind: errTransient})
+	assert.Equal(t, false, ok)
+}
+
+func TestGitcodeClientErrors(t *testing.T) {
+	forge := newFakeForge()
+	forge.reset([]forgeItem{{Org: "owner1", Repo: "repo1", Number: "1", State: "opened", Author: "author1"}},
+		[]forgeItem{{Org: "owner1", Repo: "repo1", Number: "2", State: "opened", Author: "author1"}}, nil, nil)
+	srv := httptest.NewServer(forge)
+	defer srv.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	cli := newForgeClient(srv.URL, &configuration{}, logrus.NewEntry(logger))
+
+	state, err := cli.GetIssueState(context.Background(), "owner1", "repo1", "1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "opened", state)
+
+	// the issue was deleted
+	_, err = cli.GetIssueState(context.Background(), "owner1", "repo1", "2")
+	assert.Equal(t, true, errors.Is(err, errNotFound))
+	assert.Equal(t, true, errors.Is(cli.UpdateIssue(context.Background(), "owner1", "repo1", "2", "closed"), errNotFound))
+
+	// the pull request is updated with the states of the webhook like the issue
+	assert.Equal(t, nil, cli.UpdatePR(context.Background(), "owner1", "repo1", "2", "closed"))
+	state, err = cli.GetPRState(context.Background(), "owner1", "repo1", "2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "closed", state)
+	assert.Equal(t, nil, cli.UpdatePR(context.Background(), "owner1", "repo1", "2", "opened"))
+	state, err = cli.GetPRState(context.Background(), "owner1", "repo1", "2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "opened", state)
+	assert.Equal(t, true, errors.Is(cli.UpdatePR(context.Background(), "owner1", "repo1", "2", "merged"), errUnexpected))
+
+	// the request doesn't reach the platform
+	srv.Close()
+	assert.Equal(t, true, errors.Is(cli.UpdateIssue(context.Background(), "owner1", "repo1", "1", "closed"), errTransient))
+}
@@ -0,0 +1,361 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/utils"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	auditSinkStdout = "stdout"
+	auditSinkFile   = "file"
+	auditSinkHTTP   = "http"
+
+	// roleAuthor means the commenter is the author of the issue or pull request
+	roleAuthor = "author"
+	// roleCollaborator means the commenter passed the repository permission check
+	roleCollaborator = "collaborator"
+	// roleNone means the commenter failed the repository permission check
+	roleNone = "none"
+	// roleUnknown means the permission of the commenter could not be looked up
+	roleUnknown = "unknown"
+	// roleOperator means the command was forced by an operator with the admin API
+	roleOperator = "operator"
+
+	policyAllowed               = "allowed"
+	policyNoPermission          = "no-permission"
+	policyPermissionCheckFailed = "permission-check-failed"
+	policyNeedsLinkPR           = "needs-link-pr"
+	policyLinkPRCheckFailed     = "link-pr-check-failed"
+	policyAlreadyInState        = "already-in-state"
+	policyTargetNotFound        = "target-not-found"
+	policyPlatformUnavailable   = "platform-unavailable"
+	policyForced                = "forced"
+	policyClosedWithoutLinkPR   = "closed-without-link-pr"
+
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeSkipped = "skipped"
+
+	defaultAuditMaxSizeMB  = 100
+	defaultAuditMaxBackups = 5
+	defaultAuditTimeout    = 5
+)
+
+// auditConfig configures where the audit records of lifecycle transitions are written.
+type auditConfig struct {
+	// Sink is one of stdout, file or http. Auditing is disabled when it is empty.
+	Sink string `json:"sink,omitempty"`
+	// FilePath is the JSON lines file used by the file sink.
+	FilePath string `json:"file_path,omitempty"`
+	// MaxSizeMB is the size in megabytes at which the file sink rotates.
+	MaxSizeMB int `json:"max_size_mb,omitempty"`
+	// MaxBackups is the number of rotated files kept by the file sink.
+	MaxBackups int `json:"max_backups,omitempty"`
+	// CollectorURL is the endpoint which the http sink posts records to.
+	CollectorURL string `json:"collector_url,omitempty"`
+	// Timeout is the request timeout of the http sink in seconds.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func (c *auditConfig) validate() error {
+	switch c.Sink {
+	case "", auditSinkStdout:
+	case auditSinkFile:
+		if c.FilePath == "" {
+			return errors.New("the audit file_path can not be empty when the sink is file")
+		}
+	case auditSinkHTTP:
+		if c.CollectorURL == "" {
+			return errors.New("the audit collector_url can not be empty when the sink is http")
+		}
+	default:
+		return errors.New("unsupported audit sink: " + c.Sink)
+	}
+
+	if c.MaxSizeMB < 0 || c.MaxBackups < 0 || c.Timeout < 0 {
+		return errors.New("the audit max_size_mb, max_backups and timeout can not be negative")
+	}
+
+	return nil
+}
+
+// auditRecord describes one decision made on a lifecycle command
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	EventGUID  string    `json:"event_guid"`
+	Actor      string    `json:"actor"`
+	Author     string    `json:"author"`
+	Target     string    `json:"target"`
+	TargetKind string    `json:"target_kind"`
+	Action     string    `json:"action"`
+	Role       string    `json:"role"`
+	Policy     string    `json:"policy"`
+	Outcome    string    `json:"outcome"`
+	// Operator ran the command with the admin API, Force tells if the policy checks were skipped
+	Operator string `json:"operator,omitempty"`
+	Force    bool   `json:"force,omitempty"`
+}
+
+func newAuditRecord(evt *client.GenericEvent, org, repo, number, action string) *auditRecord {
+	return &auditRecord{
+		Time:       time.Now().UTC(),
+		EventGUID:  utils.GetString(evt.EventGUID),
+		Actor:      utils.GetString(evt.Commenter),
+		Author:     utils.GetString(evt.Author),
+		Target:     org + "/" + repo + "#" + number,
+		TargetKind: utils.GetString(evt.CommentKind),
+		Action:     action,
+		Outcome:    outcomeSkipped,
+	}
+}
+
+// setOutcome records the result of the platform API call which applied the decision
+func (r *auditRecord) setOutcome(success bool) {
+	if success {
+		r.Outcome = outcomeSuccess
+	} else {
+		r.Outcome = outcomeFailure
+	}
+}
+
+// auditSink is the destination of audit records
+type auditSink interface {
+	write(rec *auditRecord) error
+	close() error
+}
+
+func newAuditSink(c *auditConfig) (auditSink, error) {
+	switch c.Sink {
+	case auditSinkStdout:
+		return &writerAuditSink{w: os.Stdout}, nil
+	case auditSinkFile:
+		s, err := newFileAuditSink(c)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case auditSinkHTTP:
+		timeout := c.Timeout
+		if timeout == 0 {
+			timeout = defaultAuditTimeout
+		}
+		return &httpAuditSink{
+			url: c.CollectorURL,
+			cli: &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// writerAuditSink writes each record as a JSON line to a writer
+type writerAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerAuditSink) write(rec *auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+func (s *writerAuditSink) close() error {
+	return nil
+}
+
+// fileAuditSink writes JSON lines to a file, rotating it when it grows beyond maxSize.
+// The rotated files are named path.1 to path.N, where path.1 is the most recent one.
+type fileAuditSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newFileAuditSink(c *auditConfig) (*fileAuditSink, error) {
+	s := &fileAuditSink{
+		path:       c.FilePath,
+		maxSize:    int64(c.MaxSizeMB) << 20,
+		maxBackups: c.MaxBackups,
+	}
+	if s.maxSize == 0 {
+		s.maxSize = defaultAuditMaxSizeMB << 20
+	}
+	if s.maxBackups == 0 {
+		s.maxBackups = defaultAuditMaxBackups
+	}
+
+	return s, s.open()
+}
+
+func (s *fileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	s.file, s.size = f, info.Size()
+	return nil
+}
+
+func (s *fileAuditSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		older := fmt.Sprintf("%s.%d", s.path, i)
+		if _, err := os.Stat(older); err == nil {
+			if err = os.Rename(older, fmt.Sprintf("%s.%d", s.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func (s *fileAuditSink) write(rec *auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileAuditSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.file.Sync(); err != nil {
+		_ = s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// errAuditSinkClosed is returned for the record written after the audit sink is closed on the shutdown
+var errAuditSinkClosed = errors.New("the audit sink is closed")
+
+// httpAuditSink posts each record as JSON to a collector
+type httpAuditSink struct {
+	url string
+	cli *http.Client
+
+	mu     sync.Mutex
+	closed bool
+	// posting counts the records being posted, close waits for them
+	posting sync.WaitGroup
+}
+
+func (s *httpAuditSink) write(rec *auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errAuditSinkClosed
+	}
+	s.posting.Add(1)
+	s.mu.Unlock()
+	defer s.posting.Done()
+
+	resp, err := s.cli.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("the audit collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// close waits for the records being posted, each of them takes the timeout of the client at most
+func (s *httpAuditSink) close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	s.posting.Wait()
+	return nil
+}
+
+// writeAudit sends the record to the configured audit sink, failures are only logged
+func (bot *robot) writeAudit(rec *auditRecord) {
+	if bot.audit == nil {
+		return
+	}
+
+	if err := bot.audit.write(rec); err != nil && bot.log != nil {
+		bot.log.WithError(err).Error("failed to write the audit record of " + rec.Target)
+	}
+}
+
+// closeAudit closes the audit sink on the shutdown, the records written after it are lost
+func (bot *robot) closeAudit() {
+	if bot.audit == nil {
+		return
+	}
+
+	if err := bot.audit.close(); err != nil && bot.log != nil {
+		bot.log.WithError(err).Error("failed to close the audit sink")
+	}
+}
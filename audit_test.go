@@ -0,0 +1,195 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditConfigValidate(t *testing.T) {
+	testCases := []struct {
+		desc string
+		in   auditConfig
+		out  error
+	}{
+		{
+			"auditing is disabled",
+			auditConfig{},
+			nil,
+		},
+		{
+			"file sink without a path",
+			auditConfig{Sink: auditSinkFile},
+			errors.New("the audit file_path can not be empty when the sink is file"),
+		},
+		{
+			"http sink without a collector",
+			auditConfig{Sink: auditSinkHTTP},
+			errors.New("the audit collector_url can not be empty when the sink is http"),
+		},
+		{
+			"unsupported sink",
+			auditConfig{Sink: "kafka"},
+			errors.New("unsupported audit sink: kafka"),
+		},
+		{
+			"negative rotation size",
+			auditConfig{Sink: auditSinkFile, FilePath: "audit.log", MaxSizeMB: -1},
+			errors.New("the audit max_size_mb, max_backups and timeout can not be negative"),
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			assert.Equal(t, testCases[i].out, testCases[i].in.validate())
+		})
+	}
+}
+
+func TestFileAuditSinkRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := newFileAuditSink(&auditConfig{FilePath: path, MaxBackups: 2})
+	assert.Equal(t, nil, err)
+	// rotate after every record
+	sink.maxSize = 1
+
+	for _, target := range []string{"o/r#1", "o/r#2", "o/r#3", "o/r#4"} {
+		assert.Equal(t, nil, sink.write(&auditRecord{Target: target}))
+	}
+	assert.Equal(t, nil, sink.close())
+
+	readTarget := func(p string) string {
+		data, err := os.ReadFile(p)
+		assert.Equal(t, nil, err)
+		rec := auditRecord{}
+		assert.Equal(t, nil, json.Unmarshal(data, &rec))
+		return rec.Target
+	}
+	assert.Equal(t, "o/r#4", readTarget(path))
+	assert.Equal(t, "o/r#3", readTarget(path+".1"))
+	assert.Equal(t, "o/r#2", readTarget(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestHTTPAuditSink(t *testing.T) {
+	var got auditRecord
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	sink, err := newAuditSink(&auditConfig{Sink: auditSinkHTTP, CollectorURL: srv.URL})
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, nil, sink.write(&auditRecord{Target: "o/r#1", Action: actionClose}))
+	assert.Equal(t, "o/r#1", got.Target)
+	assert.Equal(t, actionClose, got.Action)
+
+	status = http.StatusInternalServerError
+	assert.Equal(t, errors.New("the audit collector responded with status 500"), sink.write(&auditRecord{}))
+}
+
+func TestHTTPAuditSinkClose(t *testing.T) {
+	posting, release := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(posting)
+		<-release
+	}))
+	defer srv.Close()
+
+	sink, err := newAuditSink(&auditConfig{Sink: auditSinkHTTP, CollectorURL: srv.URL})
+	assert.Equal(t, nil, err)
+	written := make(chan error, 1)
+	go func() {
+		written <- sink.write(&auditRecord{Target: "o/r#1"})
+	}()
+	<-posting
+
+	// the record being posted is waited for on the close, the later ones are refused
+	closed := make(chan error, 1)
+	go func() {
+		closed <- sink.close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("the sink is closed before the record is posted")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.Equal(t, nil, <-written)
+	assert.Equal(t, nil, <-closed)
+	assert.Equal(t, errAuditSinkClosed, sink.write(&auditRecord{Target: "o/r#2"}))
+}
+
+func TestHandleEventWritesAudit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	mc := new(mockClient)
+	bot := &robot{cli: mc, cnf: &configuration{
+		EventStateOpened: "opened",
+		EventStateClosed: "closed",
+	}, audit: &writerAuditSink{w: buf}}
+
+	event := new(client.GenericEvent)
+	data, _ := os.ReadFile(findTestdata(t, "note_event.json"))
+	assert.Equal(t, nil, json.Unmarshal(data, event))
+	*event.Comment = comment
+	*event.CommentKind = client.CommentOnIssue
+	author := "author1"
+	event.Author = &author
+
+	// the permission lookup failed
+	bot.handleCloseEvent(context.Background(), event, &repoConfig{}, org, repo, number)
+	// a collaborator closes the issue
+	mc.successfulCheckPermission, mc.permission, mc.successfulUpdateIssue = true, true, true
+	bot.handleCloseEvent(context.Background(), event, &repoConfig{}, org, repo, number)
+	// the issue has no linking pull request
+	mc.successfulGetIssueLinkedPRNumber = true
+	bot.handleCloseEvent(context.Background(), event, &repoConfig{NeedIssueHasLinkPullRequests: true}, org, repo, number)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+
+	want := []auditRecord{
+		{Role: roleUnknown, Policy: policyPermissionCheckFailed, Outcome: outcomeSkipped},
+		{Role: roleCollaborator, Policy: policyAllowed, Outcome: outcomeSuccess},
+		{Role: roleCollaborator, Policy: policyNeedsLinkPR, Outcome: outcomeSkipped},
+	}
+	for i := range lines {
+		rec := auditRecord{}
+		assert.Equal(t, nil, json.Unmarshal([]byte(lines[i]), &rec))
+		assert.Equal(t, "01641beb-95e8-415b-9032-c6eeca3f47ce", rec.EventGUID)
+		assert.Equal(t, commenter, rec.Actor)
+		assert.Equal(t, author, rec.Author)
+		assert.Equal(t, "org1/repo1#1", rec.Target)
+		assert.Equal(t, actionClose, rec.Action)
+		assert.Equal(t, want[i].Role, rec.Role)
+		assert.Equal(t, want[i].Policy, rec.Policy)
+		assert.Equal(t, want[i].Outcome, rec.Outcome)
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/utils"
+	bolt "go.etcd.io/bbolt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultBackfillMaxAge = 24 * 60 * 60
+
+var (
+	bucketHandledComments = []byte("handled_comments")
+	bucketRobotState      = []byte("robot_state")
+	keyLastProcessed      = []byte("last_processed")
+)
+
+// backfillConfig configures the backfill of the commands commented while the robot was down
+type backfillConfig struct {
+	// Repos are the repositories in the form of org/repo, which are scanned on the startup.
+	Repos []string `json:"repos,omitempty"`
+	// MaxAge bounds in seconds how far back the scan goes, it is one day by default.
+	MaxAge int `json:"max_age,omitempty"`
+}
+
+func (c *backfillConfig) validate() error {
+	if c.MaxAge < 0 {
+		return errors.New("the backfill max_age can not be negative")
+	}
+	return validateRepoList("backfill", c.Repos)
+}
+
+func (c *backfillConfig) maxAge() time.Duration {
+	if c.MaxAge == 0 {
+		return defaultBackfillMaxAge * time.Second
+	}
+	return time.Duration(c.MaxAge) * time.Second
+}
+
+// commentJournal records the comments handled and when the last event was handled, in the store
+type commentJournal struct {
+	s   *store
+	now func() time.Time
+}
+
+func newCommentJournal(s *store) (*commentJournal, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketHandledComments); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketRobotState)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &commentJournal{s: s, now: time.Now}, nil
+}
+
+func commentJournalKey(commentKind, id string) []byte {
+	return []byte(commentKind + "/" + id)
+}
+
+// record marks the comment of the event as handled, and moves the last processed time
+func (j *commentJournal) record(evt *client.GenericEvent) error {
+	if j == nil {
+		return nil
+	}
+
+	now, err := j.now().UTC().MarshalText()
+	if err != nil {
+		return err
+	}
+	return j.s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketRobotState).Put(keyLastProcessed, now); err != nil {
+			return err
+		}
+		id := utils.GetString(evt.CommentID)
+		if id == "" {
+			return nil
+		}
+		return tx.Bucket(bucketHandledComments).Put(commentJournalKey(utils.GetString(evt.CommentKind), id), now)
+	})
+}
+
+// handled reports if the comment was handled
+func (j *commentJournal) handled(commentKind, id string) (ok bool, err error) {
+	if j == nil {
+		return false, nil
+	}
+
+	err = j.s.db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket(bucketHandledComments).Get(commentJournalKey(commentKind, id)) != nil
+		return nil
+	})
+	return
+}
+
+// lastProcessed returns when the last event was handled, ok is false if no event was handled
+func (j *commentJournal) lastProcessed() (t time.Time, ok bool, err error) {
+	if j == nil {
+		return
+	}
+
+	err = j.s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketRobotState).Get(keyLastProcessed)
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return t.UnmarshalText(v)
+	})
+	return
+}
+
+// prune forgets the comments handled before the time
+func (j *commentJournal) prune(before time.Time) error {
+	if j == nil {
+		return nil
+	}
+
+	return j.s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketHandledComments)
+		var expired [][]byte
+		_ = b.ForEach(func(k, v []byte) error {
+			t := time.Time{}
+			if t.UnmarshalText(v) != nil || t.Before(before) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// backfilledCommand is a missed command which the backfill replayed
+type backfilledCommand struct {
+	Target      string    `json:"target"`
+	CommentID   string    `json:"comment_id"`
+	Commenter   string    `json:"commenter"`
+	Command     string    `json:"command"`
+	CommentedAt time.Time `json:"commented_at"`
+	Policy      string    `json:"policy,omitempty"`
+	Outcome     string    `json:"outcome,omitempty"`
+}
+
+// backfill handles the lifecycle commands commented in the repositories since the time,
+// the comments which were handled are skipped. It returns the commands replayed.
+func (bot *robot) backfill(since time.Time) ([]backfilledCommand, error) {
+	var replayed []backfilledCommand
+	for _, r := range bot.cnf.Backfill.Repos {
+		v := strings.Split(r, "/")
+		for _, kind := range []string{client.CommentOnIssue, client.CommentOnPR} {
+			ctx, cancel := bot.eventContext("")
+			comments, err := listComments(ctx, bot.comments, defaultPollPageSize, v[0], v[1], kind,
+				&pollWatermark{Since: since})
+			cancel()
+			if err != nil {
+				return replayed, err
+			}
+
+			for i := range comments {
+				c := &comments[i]
+				if !isLifecycleCommand(c.Body) {
+					continue
+				}
+				id := strconv.FormatInt(c.ID, 10)
+				if handled, err := bot.journal.handled(kind, id); err != nil || handled {
+					if err != nil {
+						return replayed, err
+					}
+					continue
+				}
+
+				ctx, cancel := bot.eventContext("")
+				evt, err := newCommentEvent(ctx, bot.comments, v[0], v[1], kind, c)
+				cancel()
+				if errors.Is(err, errNotFound) {
+					continue
+				}
+				if err != nil {
+					return replayed, err
+				}
+
+				rec, err := bot.handleEvent(evt, bot.log.WithFields(*evt.CollectLoggingFields()))
+				if bot.interrupted() {
+					return replayed, nil
+				}
+				// The dropped command is not recorded as handled, so the next backfill replays it
+				if err != nil {
+					continue
+				}
+				cmd := backfilledCommand{
+					Target: r + "#" + c.Number, CommentID: id, Commenter: c.Commenter,
+					Command: strings.TrimSpace(c.Body), CommentedAt: c.CreatedAt,
+				}
+				if rec != nil {
+					cmd.Policy, cmd.Outcome = rec.Policy, rec.Outcome
+				}
+				replayed = append(replayed, cmd)
+			}
+		}
+	}
+	return replayed, nil
+}
+
+// backfillSince returns the time which the backfill starts from, it is the time given, or the last processed
+// event if the time is zero. The scan goes back no longer than the max age unless the time is given.
+// It must be called before any event is handled, because that moves the last processed time to now.
+// The zero time is returned if there is nothing to backfill.
+func (bot *robot) backfillSince(since time.Time) time.Time {
+	c := &bot.cnf.Backfill
+	if len(c.Repos) == 0 || bot.comments == nil {
+		return time.Time{}
+	}
+	if !since.IsZero() {
+		return since
+	}
+
+	last, ok, err := bot.journal.lastProcessed()
+	if err != nil {
+		bot.logError(err, "failed to read the last processed time, skip the backfill")
+	}
+	if err != nil || !ok {
+		return time.Time{}
+	}
+	if oldest := time.Now().Add(-c.maxAge()); last.Before(oldest) {
+		last = oldest
+	}
+	return last
+}
+
+// runBackfill replays the commands missed since the time returned by backfillSince, nothing is replayed
+// if it is zero
+func (bot *robot) runBackfill(since time.Time) {
+	if since.IsZero() {
+		return
+	}
+
+	c := &bot.cnf.Backfill
+	now := time.Now()
+	replayed, err := bot.backfill(since)
+	for i := range replayed {
+		bot.log.WithField("backfill", replayed[i]).Infof("replayed the missed %s on %s commented by %s",
+			replayed[i].Command, replayed[i].Target, replayed[i].Commenter)
+	}
+	if err != nil {
+		bot.logError(err, "the backfill stopped")
+	}
+	if bot.log != nil {
+		bot.log.Infof("the backfill since %s replayed %d commands", since.Format(time.RFC3339), len(replayed))
+	}
+
+	if err := bot.journal.prune(now.Add(-c.maxAge())); err != nil {
+		bot.logError(err, "failed to prune the handled comments")
+	}
+}
+
+// parseBackfillSince parses the time in RFC3339, or the duration before now such as 2h
+func parseBackfillSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, errors.New("invalid backfill-since: " + s)
+	}
+	return now.Add(-d), nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCommentJournal(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	j, err := newCommentJournal(newTestStore(t))
+	assert.Equal(t, nil, err)
+	j.now = func() time.Time { return now }
+
+	_, ok, err := j.lastProcessed()
+	assert.Equal(t, []interface{}{false, nil}, []interface{}{ok, err})
+
+	evt := newCloseEvent("guid1")
+	id := "11"
+	evt.CommentID = &id
+	assert.Equal(t, nil, j.record(evt))
+	last, ok, _ := j.lastProcessed()
+	assert.Equal(t, []interface{}{now, true}, []interface{}{last, ok})
+	handled, _ := j.handled(client.CommentOnIssue, "11")
+	assert.Equal(t, true, handled)
+	handled, _ = j.handled(client.CommentOnPR, "11")
+	assert.Equal(t, false, handled)
+
+	assert.Equal(t, nil, j.prune(now))
+	handled, _ = j.handled(client.CommentOnIssue, "11")
+	assert.Equal(t, true, handled)
+	assert.Equal(t, nil, j.prune(now.Add(time.Second)))
+	handled, _ = j.handled(client.CommentOnIssue, "11")
+	assert.Equal(t, false, handled)
+}
+
+func TestBackfill(t *testing.T) {
+	since := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	mc := &mockClient{successfulCheckPermission: true, permission: true, successfulUpdateIssue: true}
+	bot := newShutdownTestRobot(t, mc)
+	bot.cnf.Backfill.Repos = []string{"owner1/repo1"}
+	j, err := newCommentJournal(newTestStore(t))
+	assert.Equal(t, nil, err)
+	bot.journal = j
+	bot.comments = &fakeLister{comments: map[string][]polledComment{
+		client.CommentOnIssue: {
+			{ID: 1, Number: "1", Body: "/close", Commenter: "maintainer1", CreatedAt: since.Add(time.Minute)},
+			{ID: 2, Number: "2", Body: "/close", Commenter: "maintainer1", CreatedAt: since.Add(2 * time.Minute)},
+			{ID: 3, Number: "2", Body: "closing it", Commenter: "maintainer1", CreatedAt: since.Add(3 * time.Minute)},
+			{ID: 4, Number: "404", Body: "/close", Commenter: "maintainer1", CreatedAt: since.Add(4 * time.Minute)},
+		},
+	}}
+
+	// nothing is replayed on the first start
+	assert.Equal(t, time.Time{}, bot.backfillSince(time.Time{}))
+	bot.runBackfill(bot.backfillSince(time.Time{}))
+	assert.Equal(t, "", mc.method)
+	assert.Equal(t, since, bot.backfillSince(since))
+
+	// the comment 1 was handled through the webhook
+	evt := newCloseEvent("guid1")
+	id := "1"
+	evt.CommentID = &id
+	assert.Equal(t, nil, j.record(evt))
+	// the backfill starts from the last processed event
+	assert.Equal(t, false, bot.backfillSince(time.Time{}).IsZero())
+
+	replayed, err := bot.backfill(since)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []backfilledCommand{{
+		Target: "owner1/repo1#2", CommentID: "2", Commenter: "maintainer1", Command: "/close",
+		CommentedAt: since.Add(2 * time.Minute), Policy: policyAllowed, Outcome: outcomeSuccess,
+	}}, replayed)
+	assert.Equal(t, "UpdateIssue", mc.method)
+
+	// the replayed command is not replayed again
+	replayed, err = bot.backfill(since)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(replayed))
+}
+
+func TestParseBackfillSince(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		desc string
+		in   string
+		out  time.Time
+		err  bool
+	}{
+		{
+			"the time",
+			"2024-05-01T08:00:00Z",
+			time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC),
+			false,
+		},
+		{
+			"the duration",
+			"2h",
+			time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+			false,
+		},
+		{
+			"invalid",
+			"yesterday",
+			time.Time{},
+			true,
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			out, err := parseBackfillSince(testCases[i].in, now)
+			assert.Equal(t, testCases[i].out, out)
+			assert.Equal(t, testCases[i].err, err != nil)
+		})
+	}
+}
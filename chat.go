@@ -0,0 +1,446 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/server-common-lib/secret"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	chatKindWebhook = "webhook"
+	chatKindFeishu  = "feishu"
+	chatKindWeCom   = "wecom"
+	chatKindSlack   = "slack"
+	chatKindEmail   = "email"
+
+	// chatDefaultChannel receives the messages of the sigs which don't have their own channels
+	chatDefaultChannel = "default"
+
+	defaultChatTimeout = 5
+	defaultSMTPPort    = 25
+)
+
+// chatChannel is where the messages of a sig are posted
+type chatChannel struct {
+	// Kind is one of webhook, feishu, wecom, slack and email.
+	Kind string `json:"kind"`
+	// URL is the webhook of the channel, it is not used by email.
+	URL string `json:"url,omitempty"`
+	// SecretFile is the file containing the signing secret of the feishu webhook.
+	SecretFile string `json:"secret_file,omitempty"`
+	// Recipients are the addresses which the email is sent to.
+	Recipients []string `json:"recipients,omitempty"`
+}
+
+func (c *chatChannel) validate(name string, smtpCnf *smtpConfig) error {
+	switch c.Kind {
+	case chatKindWebhook, chatKindFeishu, chatKindWeCom, chatKindSlack:
+		if c.URL == "" {
+			return errors.New("the url of the chat channel " + name + " can not be empty")
+		}
+	case chatKindEmail:
+		if len(c.Recipients) == 0 {
+			return errors.New("the recipients of the chat channel " + name + " can not be empty")
+		}
+		if smtpCnf.Host == "" || smtpCnf.From == "" {
+			return errors.New("the smtp host and from can not be empty when the chat channel " + name + " is email")
+		}
+	default:
+		return errors.New("unsupported kind of the chat channel " + name + ": " + c.Kind)
+	}
+	return nil
+}
+
+// smtpConfig is the server which sends the email
+type smtpConfig struct {
+	Host string `json:"host,omitempty"`
+	// Port is 25 by default.
+	Port int    `json:"port,omitempty"`
+	From string `json:"from,omitempty"`
+	// Username is used to authenticate with PasswordFile, the email is sent without authentication if it is empty.
+	Username     string `json:"username,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+}
+
+// chatConfig configures the messages posted to the channels of the sigs
+// when an issue or pull request is reopened or a command is denied.
+type chatConfig struct {
+	// Channels are keyed by the sig names, the default channel receives the messages of the other sigs.
+	Channels map[string]chatChannel `json:"channels,omitempty"`
+	SMTP     smtpConfig             `json:"smtp,omitempty"`
+	// Timeout is the timeout of sending a message in seconds, it is 5 by default.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func (c *chatConfig) validate() error {
+	for name, ch := range c.Channels {
+		if err := ch.validate(name, &c.SMTP); err != nil {
+			return err
+		}
+	}
+
+	if c.Timeout < 0 || c.SMTP.Port < 0 {
+		return errors.New("the chat timeout and smtp port can not be negative")
+	}
+	return nil
+}
+
+// chatMessage is the message posted to the channel of a sig
+type chatMessage struct {
+	Sig    string
+	Title  string
+	Text   string
+	Record *auditRecord
+}
+
+// newChatMessage returns the message of a reopen or a denied command, ok is false for the other decisions
+func newChatMessage(sig string, rec *auditRecord) (msg *chatMessage, ok bool) {
+	var title, reason string
+	switch {
+	case rec.Action == actionReopen && rec.Outcome == outcomeSuccess:
+		title, reason = rec.Target+" was reopened", newHistoryEntry(rec).Reason
+	case rec.Policy == policyNeedsLinkPR:
+		title, reason = "/"+rec.Action+" on "+rec.Target+" was refused", "no pull request is linked to the issue"
+	case rec.Policy == policyNoPermission:
+		title, reason = "/"+rec.Action+" on "+rec.Target+" was refused", "the commenter has no permission"
+	default:
+		return nil, false
+	}
+
+	lines := []string{
+		"Target: " + rec.Target,
+		"Command: /" + rec.Action + " by @" + rec.Actor,
+		"Author: @" + rec.Author,
+		"Reason: " + reason,
+	}
+	if sig != "" {
+		lines = append([]string{"SIG: " + sig}, lines...)
+	}
+	return &chatMessage{Sig: sig, Title: title, Text: strings.Join(lines, "\n"), Record: rec}, true
+}
+
+// chatAdapter posts the message to a kind of channel
+type chatAdapter interface {
+	send(ctx context.Context, msg *chatMessage) error
+}
+
+func newChatAdapter(ch *chatChannel, c *chatConfig) chatAdapter {
+	switch ch.Kind {
+	case chatKindFeishu:
+		return &feishuAdapter{url: ch.URL, secretFile: ch.SecretFile, now: time.Now}
+	case chatKindWeCom:
+		return &wecomAdapter{url: ch.URL}
+	case chatKindSlack:
+		return &slackAdapter{url: ch.URL}
+	case chatKindEmail:
+		return &emailAdapter{smtp: c.SMTP, recipients: ch.Recipients}
+	default:
+		return &webhookAdapter{url: ch.URL}
+	}
+}
+
+// postChat posts the payload as JSON, and decodes the response body into receiver
+func postChat(ctx context.Context, urlStr string, payload, receiver interface{}) error {
+	op := "post the chat message to " + urlStr
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return &apiError{kind: errUnexpected, op: op, err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, bytes.NewReader(data))
+	if err != nil {
+		return &apiError{kind: errUnexpected, op: op, err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return newTransientError(op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return newStatusError(op, resp.StatusCode, resp.Header)
+	}
+	if receiver != nil {
+		if err = json.NewDecoder(resp.Body).Decode(receiver); err != nil {
+			return &apiError{kind: errUnexpected, op: op, err: err}
+		}
+	}
+	return nil
+}
+
+// webhookAdapter posts the message and the decision as JSON
+type webhookAdapter struct {
+	url string
+}
+
+func (a *webhookAdapter) send(ctx context.Context, msg *chatMessage) error {
+	return postChat(ctx, a.url, map[string]interface{}{
+		"sig":    msg.Sig,
+		"title":  msg.Title,
+		"text":   msg.Text,
+		"record": msg.Record,
+	}, nil)
+}
+
+// feishuAdapter posts to the custom bot of feishu or lark, the message is signed if the secret is set
+type feishuAdapter struct {
+	url        string
+	secretFile string
+	now        func() time.Time
+}
+
+func (a *feishuAdapter) send(ctx context.Context, msg *chatMessage) error {
+	payload := map[string]interface{}{
+		"msg_type": "text",
+		"content":  map[string]string{"text": msg.Title + "\n" + msg.Text},
+	}
+	if a.secretFile != "" {
+		key, err := secret.LoadSingleSecret(a.secretFile)
+		if err != nil {
+			return &apiError{kind: errUnexpected, op: "load the feishu secret", err: err}
+		}
+		timestamp := strconv.FormatInt(a.now().Unix(), 10)
+		payload["timestamp"], payload["sign"] = timestamp, feishuSign(timestamp, key)
+	}
+
+	var resp struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if err := postChat(ctx, a.url, payload, &resp); err != nil {
+		return err
+	}
+	if resp.Code != 0 {
+		return &apiError{kind: errUnexpected, op: "post the feishu message", err: errors.New(resp.Msg)}
+	}
+	return nil
+}
+
+// feishuSign is the signature of feishu, it is the HMAC-SHA256 of nothing keyed by the timestamp and secret
+func feishuSign(timestamp string, key []byte) string {
+	mac := hmac.New(sha256.New, []byte(timestamp+"\n"+string(key)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// wecomAdapter posts to the group bot of wecom
+type wecomAdapter struct {
+	url string
+}
+
+func (a *wecomAdapter) send(ctx context.Context, msg *chatMessage) error {
+	var resp struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	err := postChat(ctx, a.url, map[string]interface{}{
+		"msgtype":  "markdown",
+		"markdown": map[string]string{"content": "**" + msg.Title + "**\n" + msg.Text},
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	if resp.ErrCode != 0 {
+		return &apiError{kind: errUnexpected, op: "post the wecom message", err: errors.New(resp.ErrMsg)}
+	}
+	return nil
+}
+
+// slackAdapter posts to the incoming webhooks of slack and the compatible ones, such as mattermost
+type slackAdapter struct {
+	url string
+}
+
+func (a *slackAdapter) send(ctx context.Context, msg *chatMessage) error {
+	return postChat(ctx, a.url, map[string]string{"text": "*" + msg.Title + "*\n" + msg.Text}, nil)
+}
+
+// emailAdapter sends the message by smtp, STARTTLS is used if the server supports it
+type emailAdapter struct {
+	smtp       smtpConfig
+	recipients []string
+}
+
+func (a *emailAdapter) send(ctx context.Context, msg *chatMessage) error {
+	op := "send the email to " + strings.Join(a.recipients, ",")
+	if err := a.sendMail(ctx, msg); err != nil {
+		// The permanent failures are replied with 5xx
+		var te *textproto.Error
+		if errors.As(err, &te) && te.Code >= 500 {
+			return &apiError{kind: errUnexpected, op: op, err: err}
+		}
+		return newTransientError(op, err)
+	}
+	return nil
+}
+
+func (a *emailAdapter) sendMail(ctx context.Context, msg *chatMessage) error {
+	port := a.smtp.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(a.smtp.Host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, a.smtp.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: a.smtp.Host, MinVersion: tls.VersionTLS12}); err != nil {
+			return err
+		}
+	}
+	if a.smtp.Username != "" {
+		password, err := secret.LoadSingleSecret(a.smtp.PasswordFile)
+		if err != nil {
+			return err
+		}
+		if err = c.Auth(smtp.PlainAuth("", a.smtp.Username, string(password), a.smtp.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(a.smtp.From); err != nil {
+		return err
+	}
+	for _, to := range a.recipients {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		a.smtp.From, strings.Join(a.recipients, ", "), mime.QEncoding.Encode("utf-8", msg.Title),
+		strings.ReplaceAll(msg.Text, "\n", "\r\n"))
+	if _, err = w.Write([]byte(body)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// sigLister lists the sigs which the repository belongs to
+type sigLister interface {
+	listSigs(ctx context.Context, org, repo string) ([]client.SigInfo, error)
+}
+
+// chatTarget is a channel and the sig whose message is posted to it
+type chatTarget struct {
+	sig     string
+	channel chatChannel
+}
+
+// targets returns the channels of the sigs, the sigs without their own channels share the default channel
+func (c *chatConfig) targets(sigs []string) []chatTarget {
+	var targets []chatTarget
+	var others []string
+	for _, sig := range sigs {
+		if ch, ok := c.Channels[sig]; ok {
+			targets = append(targets, chatTarget{sig: sig, channel: ch})
+		} else {
+			others = append(others, sig)
+		}
+	}
+
+	if ch, ok := c.Channels[chatDefaultChannel]; ok && (len(others) > 0 || len(targets) == 0) {
+		targets = append(targets, chatTarget{sig: strings.Join(others, ", "), channel: ch})
+	}
+	return targets
+}
+
+// notifyChat posts the reopen or the denied command to the channels of the sigs in the background
+func (bot *robot) notifyChat(org, repo string, rec *auditRecord) {
+	c := &bot.cnf.ChatNotification
+	if len(c.Channels) == 0 {
+		return
+	}
+	if _, ok := newChatMessage("", rec); !ok {
+		return
+	}
+
+	go bot.sendChat(c, org, repo, rec)
+}
+
+func (bot *robot) sendChat(c *chatConfig, org, repo string, rec *auditRecord) {
+	ctx := bot.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultChatTimeout
+	}
+
+	// The message is posted to the default channel if the sigs can't be looked up
+	var names []string
+	if bot.sigs != nil {
+		lctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		sigs, err := bot.sigs.listSigs(lctx, org, repo)
+		cancel()
+		if err != nil {
+			bot.logError(err, "failed to look up the sigs of "+org+"/"+repo)
+		}
+		for i := range sigs {
+			names = append(names, sigs[i].SigName)
+		}
+	}
+
+	for _, t := range c.targets(names) {
+		msg, _ := newChatMessage(t.sig, rec)
+		adapter := newChatAdapter(&t.channel, c)
+		err := bot.retry.do(ctx, func() error {
+			sctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+			defer cancel()
+			return adapter.send(sctx, msg)
+		})
+		if err != nil {
+			bot.logError(err, "failed to post the "+t.channel.Kind+" message of "+rec.Target+" to the sig "+t.sig)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/server-common-lib/secret"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatConfigValidate(t *testing.T) {
+	testCases := []struct {
+		desc string
+		in   chatConfig
+		out  error
+	}{
+		{"disabled", chatConfig{}, nil},
+		{
+			"valid channels",
+			chatConfig{
+				Channels: map[string]chatChannel{
+					"sig-a":            {Kind: chatKindFeishu, URL: "https://open.feishu.cn/hook/1"},
+					chatDefaultChannel: {Kind: chatKindEmail, Recipients: []string{"dev@example.com"}},
+				},
+				SMTP: smtpConfig{Host: "smtp.example.com", From: "robot@example.com"},
+			},
+			nil,
+		},
+		{
+			"unsupported kind",
+			chatConfig{Channels: map[string]chatChannel{"sig-a": {Kind: "irc"}}},
+			errors.New("unsupported kind of the chat channel sig-a: irc"),
+		},
+		{
+			"webhook without the url",
+			chatConfig{Channels: map[string]chatChannel{"sig-a": {Kind: chatKindSlack}}},
+			errors.New("the url of the chat channel sig-a can not be empty"),
+		},
+		{
+			"email without the recipients",
+			chatConfig{Channels: map[string]chatChannel{"sig-a": {Kind: chatKindEmail}}},
+			errors.New("the recipients of the chat channel sig-a can not be empty"),
+		},
+		{
+			"email without the smtp server",
+			chatConfig{Channels: map[string]chatChannel{"sig-a": {Kind: chatKindEmail, Recipients: []string{"a@b.c"}}}},
+			errors.New("the smtp host and from can not be empty when the chat channel sig-a is email"),
+		},
+		{
+			"negative timeout",
+			chatConfig{Timeout: -1},
+			errors.New("the chat timeout and smtp port can not be negative"),
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			assert.Equal(t, testCases[i].out, testCases[i].in.validate())
+		})
+	}
+}
+
+func TestNewChatMessage(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		in    auditRecord
+		ok    bool
+		title string
+	}{
+		{
+			"reopened",
+			auditRecord{Action: actionReopen, Role: roleAuthor, Policy: policyAllowed, Outcome: outcomeSuccess},
+			true, "owner/repo#1 was reopened",
+		},
+		{
+			"close refused without the linked pull request",
+			auditRecord{Action: actionClose, Role: roleAuthor, Policy: policyNeedsLinkPR, Outcome: outcomeSkipped},
+			true, "/close on owner/repo#1 was refused",
+		},
+		{
+			"reopen refused on the permission",
+			auditRecord{Action: actionReopen, Role: roleNone, Policy: policyNoPermission, Outcome: outcomeSkipped},
+			true, "/reopen on owner/repo#1 was refused",
+		},
+		{
+			"closed",
+			auditRecord{Action: actionClose, Role: roleAuthor, Policy: policyAllowed, Outcome: outcomeSuccess},
+			false, "",
+		},
+		{
+			"failed reopen",
+			auditRecord{Action: actionReopen, Role: roleAuthor, Policy: policyAllowed, Outcome: outcomeFailure},
+			false, "",
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			rec := testCases[i].in
+			rec.Target = "owner/repo#1"
+			msg, ok := newChatMessage("sig-a", &rec)
+			assert.Equal(t, testCases[i].ok, ok)
+			if ok {
+				assert.Equal(t, testCases[i].title, msg.Title)
+				assert.Equal(t, true, strings.HasPrefix(msg.Text, "SIG: sig-a\nTarget: owner/repo#1\n"))
+			}
+		})
+	}
+}
+
+func TestChatTargets(t *testing.T) {
+	a := chatChannel{Kind: chatKindSlack, URL: "a"}
+	def := chatChannel{Kind: chatKindSlack, URL: "default"}
+	testCases := []struct {
+		desc     string
+		channels map[string]chatChannel
+		sigs     []string
+		out      []chatTarget
+	}{
+		{"own channel", map[string]chatChannel{"sig-a": a, chatDefaultChannel: def}, []string{"sig-a"},
+			[]chatTarget{{"sig-a", a}}},
+		{"default channel of the others", map[string]chatChannel{"sig-a": a, chatDefaultChannel: def},
+			[]string{"sig-a", "sig-b", "sig-c"}, []chatTarget{{"sig-a", a}, {"sig-b, sig-c", def}}},
+		{"no sig", map[string]chatChannel{chatDefaultChannel: def}, nil, []chatTarget{{"", def}}},
+		{"no channel", map[string]chatChannel{"sig-a": a}, []string{"sig-b"}, nil},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			c := chatConfig{Channels: testCases[i].channels}
+			assert.Equal(t, testCases[i].out, c.targets(testCases[i].sigs))
+		})
+	}
+}
+
+// newChatServer is a stand-in of the chat webhooks, it replies with response and records the request bodies
+func newChatServer(t *testing.T, response string) (*httptest.Server, chan map[string]interface{}) {
+	bodies := make(chan map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		bodies <- body
+		_, _ = io.WriteString(w, response)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, bodies
+}
+
+// newSMTPServer is a stand-in of the smtp server, it records the data of the mails
+func newSMTPServer(t *testing.T) (*smtpConfig, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serveSMTP(conn, mails)
+		}
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	return &smtpConfig{Host: "127.0.0.1", Port: port, From: "robot@example.com"}, mails
+}
+
+func serveSMTP(conn net.Conn, mails chan string) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost ready")
+
+	var rcpts []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250 localhost")
+		case "RCPT":
+			rcpts = append(rcpts, line)
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			data, _ := tp.ReadDotBytes()
+			mails <- strings.Join(rcpts, "\n") + "\n" + string(data)
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestChatAdapters(t *testing.T) {
+	msg, _ := newChatMessage("sig-a", &auditRecord{
+		Target: "owner/repo#1", Actor: "user1", Author: "user2", Action: actionReopen,
+		Role: roleAuthor, Policy: policyAllowed, Outcome: outcomeSuccess,
+	})
+	text := msg.Title + "\n" + msg.Text
+
+	t.Run("webhook", func(t *testing.T) {
+		srv, bodies := newChatServer(t, "")
+		assert.Equal(t, nil, (&webhookAdapter{url: srv.URL}).send(context.Background(), msg))
+		body := <-bodies
+		assert.Equal(t, "sig-a", body["sig"])
+		assert.Equal(t, msg.Title, body["title"])
+		assert.Equal(t, "owner/repo#1", body["record"].(map[string]interface{})["target"])
+	})
+
+	t.Run("feishu", func(t *testing.T) {
+		srv, bodies := newChatServer(t, `{"code":0,"msg":"success"}`)
+		now := time.Unix(1700000000, 0)
+		a := &feishuAdapter{url: srv.URL, secretFile: "testdata/token", now: func() time.Time { return now }}
+		assert.Equal(t, nil, a.send(context.Background(), msg))
+
+		key, _ := secret.LoadSingleSecret("testdata/token")
+		assert.Equal(t, map[string]interface{}{
+			"msg_type": "text", "content": map[string]interface{}{"text": text},
+			"timestamp": "1700000000", "sign": feishuSign("1700000000", key),
+		}, <-bodies)
+	})
+
+	t.Run("feishu error", func(t *testing.T) {
+		srv, _ := newChatServer(t, `{"code":19021,"msg":"sign match fail"}`)
+		err := (&feishuAdapter{url: srv.URL, now: time.Now}).send(context.Background(), msg)
+		assert.Equal(t, true, errors.Is(err, errUnexpected))
+	})
+
+	t.Run("wecom", func(t *testing.T) {
+		srv, bodies := newChatServer(t, `{"errcode":0,"errmsg":"ok"}`)
+		assert.Equal(t, nil, (&wecomAdapter{url: srv.URL}).send(context.Background(), msg))
+		assert.Equal(t, map[string]interface{}{
+			"msgtype": "markdown", "markdown": map[string]interface{}{"content": "**" + msg.Title + "**\n" + msg.Text},
+		}, <-bodies)
+	})
+
+	t.Run("wecom error", func(t *testing.T) {
+		srv, _ := newChatServer(t, `{"errcode":93000,"errmsg":"invalid webhook url"}`)
+		err := (&wecomAdapter{url: srv.URL}).send(context.Background(), msg)
+		assert.Equal(t, true, errors.Is(err, errUnexpected))
+	})
+
+	t.Run("slack", func(t *testing.T) {
+		srv, bodies := newChatServer(t, "ok")
+		assert.Equal(t, nil, (&slackAdapter{url: srv.URL}).send(context.Background(), msg))
+		assert.Equal(t, map[string]interface{}{"text": "*" + msg.Title + "*\n" + msg.Text}, <-bodies)
+	})
+
+	t.Run("email", func(t *testing.T) {
+		cnf, mails := newSMTPServer(t)
+		a := &emailAdapter{smtp: *cnf, recipients: []string{"sig-a@example.com", "dev@example.com"}}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.Equal(t, nil, a.send(ctx, msg))
+
+		mail := <-mails
+		r := textproto.NewReader(bufio.NewReader(strings.NewReader(mail)))
+		assert.Equal(t, "RCPT TO:<sig-a@example.com>", readLine(r))
+		assert.Equal(t, "RCPT TO:<dev@example.com>", readLine(r))
+		header, err := r.ReadMIMEHeader()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "robot@example.com", header.Get("From"))
+		assert.Equal(t, "sig-a@example.com, dev@example.com", header.Get("To"))
+		assert.Equal(t, msg.Title, header.Get("Subject"))
+		body, _ := io.ReadAll(r.R)
+		assert.Equal(t, msg.Text+"\n", string(body))
+	})
+
+	t.Run("email server down", func(t *testing.T) {
+		a := &emailAdapter{smtp: smtpConfig{Host: "127.0.0.1", Port: 1}, recipients: []string{"a@example.com"}}
+		assert.Equal(t, true, errors.Is(a.send(context.Background(), msg), errTransient))
+	})
+}
+
+func readLine(r *textproto.Reader) string {
+	s, _ := r.ReadLine()
+	return s
+}
+
+// fakeSigLister returns the sigs of every repository
+type fakeSigLister []client.SigInfo
+
+func (f fakeSigLister) listSigs(context.Context, string, string) ([]client.SigInfo, error) {
+	return f, nil
+}
+
+func TestNotifyChat(t *testing.T) {
+	srv, bodies := newChatServer(t, "ok")
+	bot := &robot{
+		cnf: &configuration{ChatNotification: chatConfig{Channels: map[string]chatChannel{
+			chatDefaultChannel: {Kind: chatKindWebhook, URL: srv.URL},
+		}}},
+		sigs: fakeSigLister{{SigName: "sig-a"}, {SigName: "sig-b"}},
+	}
+
+	// A close is not posted
+	bot.notify("owner", "repo", &auditRecord{
+		Target: "owner/repo#1", Action: actionClose, Policy: policyAllowed, Outcome: outcomeSuccess,
+	})
+	bot.notify("owner", "repo", &auditRecord{
+		Target: "owner/repo#2", Action: actionClose, Policy: policyNeedsLinkPR, Outcome: outcomeSkipped,
+	})
+
+	select {
+	case body := <-bodies:
+		assert.Equal(t, "sig-a, sig-b", body["sig"])
+		assert.Equal(t, "/close on owner/repo#2 was refused", body["title"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message was not posted")
+	}
+	assert.Equal(t, 0, len(bodies))
+}
@@ -0,0 +1,258 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/config"
+	"github.com/opensourceways/robot-framework-lib/utils"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	// issueActionClose is the action of the issue event which closes the issue
+	issueActionClose = "close"
+
+	defaultCloseGuardMaxReopens = 3
+	defaultCloseGuardWindow     = 3600
+
+	// closeGuardOwnWindow is how long the robot remembers its own transitions, so the close made by
+	// the robot itself is not guarded when its event arrives
+	closeGuardOwnWindow = 10 * time.Minute
+)
+
+// closeGuardConfig reopens the issues closed on the web UI without the linked pull requests,
+// it requires need_issue_has_link_pull_requests.
+type closeGuardConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// ExemptMaintainers leaves the issues closed by the admins, maintainers and committers closed.
+	ExemptMaintainers bool `json:"exempt_maintainers,omitempty"`
+	// MaxReopens is how many times an issue is reopened in the window at most, it is 3 by default.
+	// The robot stops fighting with the one who keeps closing the issue after that.
+	MaxReopens int `json:"max_reopens,omitempty"`
+	// Window is the window of MaxReopens in seconds, it is 3600 by default.
+	Window int `json:"window,omitempty"`
+}
+
+// validate checks the close guard, comment is the template of the comment on the reopened issues
+func (c *closeGuardConfig) validate(needLinkPR bool, comment string) error {
+	if c.Enabled && !needLinkPR {
+		return errors.New("the close_guard requires need_issue_has_link_pull_requests")
+	}
+	if c.Enabled && comment == "" {
+		return errors.New("the comment_issue_closed_without_link_pr is required when the close_guard is enabled")
+	}
+	if c.MaxReopens < 0 || c.Window < 0 {
+		return errors.New("the close_guard max_reopens and window can not be negative")
+	}
+	return nil
+}
+
+func (c *closeGuardConfig) limits() (maxReopens int, window time.Duration) {
+	maxReopens, window = c.MaxReopens, time.Duration(c.Window)*time.Second
+	if maxReopens == 0 {
+		maxReopens = defaultCloseGuardMaxReopens
+	}
+	if window == 0 {
+		window = defaultCloseGuardWindow * time.Second
+	}
+	return
+}
+
+// closeGuard keeps what stops the guard from looping with the robot itself or with the one who keeps
+// closing the issue. It is kept in memory, so the transitions made by the other instances are not known.
+type closeGuard struct {
+	mu sync.Mutex
+	// own is when the robot changed the issue or pull request to the state, keyed by org/repo#number:state
+	own map[string]time.Time
+	// reopens are when the guard reopened the issue, keyed by org/repo#number
+	reopens map[string][]time.Time
+	now     func() time.Time
+}
+
+func newCloseGuard() *closeGuard {
+	return &closeGuard{own: map[string]time.Time{}, reopens: map[string][]time.Time{}, now: time.Now}
+}
+
+// recordOwn remembers that the robot changed the issue or pull request to the state
+func (g *closeGuard) recordOwn(key, state string) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	for k, t := range g.own {
+		if now.Sub(t) > closeGuardOwnWindow {
+			delete(g.own, k)
+		}
+	}
+	g.own[key+":"+state] = now
+}
+
+// isOwn reports if the robot changed the issue or pull request to the state recently
+func (g *closeGuard) isOwn(key, state string) bool {
+	if g == nil {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	t, ok := g.own[key+":"+state]
+	return ok && g.now().Sub(t) <= closeGuardOwnWindow
+}
+
+// allowReopen records a reopen of the issue, it returns false without recording it
+// if the issue was already reopened max_reopens times in the window
+func (g *closeGuard) allowReopen(key string, c *closeGuardConfig) bool {
+	if g == nil {
+		return true
+	}
+	maxReopens, window := c.limits()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	var recent []time.Time
+	for _, t := range g.reopens[key] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= maxReopens {
+		g.reopens[key] = recent
+		return false
+	}
+	g.reopens[key] = append(recent, now)
+	return true
+}
+
+func (bot *robot) handleIssueEvent(evt *client.GenericEvent, _ config.Configmap, logger *logrus.Entry) {
+	bot.handleEvent(evt, logger)
+}
+
+// guardIssueClose reopens the issue closed without a linked pull request against the policy of the repository,
+// it returns the audit record of the decision, or nil if the event is not such a close.
+func (bot *robot) guardIssueClose(ctx context.Context, evt *client.GenericEvent, logger *logrus.Entry) *auditRecord {
+	org, repo, number := utils.GetString(evt.Org), utils.GetString(evt.Repo), utils.GetString(evt.Number)
+	if utils.GetString(evt.Action) != issueActionClose || utils.GetString(evt.State) != bot.cnf.EventStateClosed {
+		return nil
+	}
+	repoCnf := bot.cnf.getRepoConfig(org, repo)
+	if repoCnf == nil || !repoCnf.CloseGuard.Enabled || !repoCnf.NeedIssueHasLinkPullRequests {
+		return nil
+	}
+
+	key := closeGuardKey(org, repo, number)
+	if bot.guard.isOwn(key, bot.cnf.EventStateClosed) {
+		bot.tracef("%s was closed by the robot itself", key)
+		return nil
+	}
+
+	b := bot.withRepoMode(repoCnf)
+	gevt, plan := b.planCloseGuard(ctx, evt, repoCnf, org, repo, number)
+	if plan == nil {
+		return nil
+	}
+	if plan.Policy == policyClosedWithoutLinkPR && !bot.guard.allowReopen(key, &repoCnf.CloseGuard) {
+		logger.Warningf("stop reopening %s, it was reopened too many times by the close guard", key)
+		plan.Actions = []plannedAction{{
+			Kind:   actionKindSkip,
+			Reason: key + " was reopened too many times by the close guard",
+		}}
+	}
+
+	return b.executePlan(ctx, gevt, plan)
+}
+
+// planCloseGuard decides whether to reopen the closed issue. The closer in the issue event is the author
+// of the event, so the event is returned with the closer as the commenter and the author of the issue.
+// The plan is nil if the issue meets the policy or is not closed any more.
+func (bot *robot) planCloseGuard(ctx context.Context, evt *client.GenericEvent, repoCnf *repoConfig, org, repo, number string) (
+	*client.GenericEvent, *lifecyclePlan) {
+	closer := utils.GetString(evt.Author)
+	plan := newLifecyclePlan(org, repo, number, client.CommentOnIssue, actionReopen)
+
+	state, author, err := bot.comments.GetItem(ctx, org, repo, client.CommentOnIssue, number)
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		bot.logError(err, "failed to get "+org+"/"+repo+"#"+number+", use the state in the webhook")
+		state = utils.GetString(evt.State)
+	}
+	bot.tracef("closed by %s, current state: %s", closer, state)
+	if state != bot.cnf.EventStateClosed {
+		return nil, nil
+	}
+
+	gevt := *evt
+	kind := client.CommentOnIssue
+	gevt.Commenter, gevt.Author, gevt.CommentKind = &closer, &author, &kind
+
+	num, err := bot.linkedPRNumber(ctx, org, repo, number)
+	if err != nil {
+		plan.Policy = policyLinkPRCheckFailed
+		plan.add(plannedAction{Kind: actionKindSkip, Reason: "failed to list the linked pull requests: " + err.Error()})
+		return &gevt, plan
+	}
+	if num > 0 {
+		return nil, nil
+	}
+
+	if repoCnf.CloseGuard.ExemptMaintainers {
+		// The author of the issue is not exempted, only the collaborators are
+		// The issue is left closed if the permission can't be checked, not to fight with a maintainer
+		pass, role, err := bot.checkCommenterPermission(ctx, org, repo, "", closer)
+		plan.Role = role
+		if pass || err != nil {
+			plan.Policy = policyAllowed
+			if err != nil {
+				plan.Policy = policyPermissionCheckFailed
+			}
+			plan.add(plannedAction{
+				Kind:   actionKindSkip,
+				Reason: closer + " is exempted from the close guard as the " + role,
+			})
+			return &gevt, plan
+		}
+	}
+
+	plan.Policy = policyClosedWithoutLinkPR
+	plan.add(plannedAction{Kind: actionKindUpdateIssue, State: bot.cnf.EventStateOpened})
+	plan.add(commentAction(templateIssueClosedWithoutLinkPR, map[string]string{placeholderCommenter: closer}))
+	return &gevt, plan
+}
+
+// linkedPRNumber returns the number of the linked pull requests of the issue, the lookup is retried with backoff
+func (bot *robot) linkedPRNumber(ctx context.Context, org, repo, number string) (num int, err error) {
+	err = bot.retry.do(ctx, func() (err error) {
+		num, err = bot.cli.GetIssueLinkedPRNumber(ctx, org, repo, number)
+		return
+	})
+	return
+}
+
+// closeGuardKey returns the key of the issue or pull request in the close guard
+func closeGuardKey(org, repo, number string) string {
+	return org + "/" + repo + "#" + number
+}
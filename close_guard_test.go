@@ -0,0 +1,195 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/framework"
+	"github.com/opensourceways/server-common-lib/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloseGuardConfigValidate(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		in         closeGuardConfig
+		needLinkPR bool
+		comment    string
+		out        error
+	}{
+		{"disabled", closeGuardConfig{}, false, "", nil},
+		{"enabled", closeGuardConfig{Enabled: true, ExemptMaintainers: true}, true, "reopened", nil},
+		{
+			"enabled without the linked pull request policy",
+			closeGuardConfig{Enabled: true}, false, "reopened",
+			errors.New("the close_guard requires need_issue_has_link_pull_requests"),
+		},
+		{
+			"enabled without the comment",
+			closeGuardConfig{Enabled: true}, true, "",
+			errors.New("the comment_issue_closed_without_link_pr is required when the close_guard is enabled"),
+		},
+		{
+			"negative window",
+			closeGuardConfig{Enabled: true, Window: -1}, true, "reopened",
+			errors.New("the close_guard max_reopens and window can not be negative"),
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			assert.Equal(t, testCases[i].out,
+				testCases[i].in.validate(testCases[i].needLinkPR, testCases[i].comment))
+		})
+	}
+}
+
+func TestCloseGuard(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	g := newCloseGuard()
+	g.now = func() time.Time { return now }
+
+	g.recordOwn("owner/repo#1", "closed")
+	assert.Equal(t, true, g.isOwn("owner/repo#1", "closed"))
+	assert.Equal(t, false, g.isOwn("owner/repo#1", "opened"))
+	assert.Equal(t, false, g.isOwn("owner/repo#2", "closed"))
+	now = now.Add(closeGuardOwnWindow + time.Second)
+	assert.Equal(t, false, g.isOwn("owner/repo#1", "closed"))
+
+	c := &closeGuardConfig{MaxReopens: 2, Window: 60}
+	assert.Equal(t, true, g.allowReopen("owner/repo#1", c))
+	assert.Equal(t, true, g.allowReopen("owner/repo#1", c))
+	assert.Equal(t, false, g.allowReopen("owner/repo#1", c))
+	assert.Equal(t, true, g.allowReopen("owner/repo#2", c))
+	now = now.Add(time.Minute)
+	assert.Equal(t, true, g.allowReopen("owner/repo#1", c))
+}
+
+func TestGuardIssueClose(t *testing.T) {
+	forge := newFakeForge()
+	forgeSrv := httptest.NewServer(forge)
+	t.Cleanup(forgeSrv.Close)
+
+	cnf := &configuration{}
+	assert.Equal(t, nil, utils.LoadFromYaml(findTestdata(t, configYaml), cnf))
+
+	logger := logrus.NewEntry(logrus.New())
+	logger.Logger.SetLevel(logrus.PanicLevel)
+
+	testCases := []struct {
+		desc     string
+		guard    closeGuardConfig
+		org      string
+		action   string
+		closer   string
+		linked   int
+		own      bool
+		reopened int
+		state    string
+		policy   string
+	}{
+		{
+			"closed without a linked pull request",
+			closeGuardConfig{Enabled: true}, "owner3", issueActionClose, "user1", 0, false, 0,
+			"opened", policyClosedWithoutLinkPR,
+		},
+		{
+			"closed with a linked pull request",
+			closeGuardConfig{Enabled: true}, "owner3", issueActionClose, "user1", 1, false, 0, "closed", "",
+		},
+		{
+			"guard disabled",
+			closeGuardConfig{}, "owner3", issueActionClose, "user1", 0, false, 0, "closed", "",
+		},
+		{
+			"repository without the linked pull request policy",
+			closeGuardConfig{Enabled: true}, "owner1", issueActionClose, "user1", 0, false, 0, "closed", "",
+		},
+		{
+			"not a close",
+			closeGuardConfig{Enabled: true}, "owner3", "update", "user1", 0, false, 0, "closed", "",
+		},
+		{
+			"closed by the robot itself",
+			closeGuardConfig{Enabled: true}, "owner3", issueActionClose, "user1", 0, true, 0, "closed", "",
+		},
+		{
+			"maintainer exempted",
+			closeGuardConfig{Enabled: true, ExemptMaintainers: true}, "owner3", issueActionClose, "admin1", 0, false, 0,
+			"closed", policyAllowed,
+		},
+		{
+			"non-member not exempted",
+			closeGuardConfig{Enabled: true, ExemptMaintainers: true}, "owner3", issueActionClose, "user1", 0, false, 0,
+			"opened", policyClosedWithoutLinkPR,
+		},
+		{
+			"reopened too many times",
+			closeGuardConfig{Enabled: true, MaxReopens: 2}, "owner3", issueActionClose, "user1", 0, false, 2,
+			"closed", policyClosedWithoutLinkPR,
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			tc := &testCases[i]
+			cnf.ConfigItems[1].CloseGuard = tc.guard
+			forge.reset([]forgeItem{{
+				Org: tc.org, Repo: "repo1", Number: "1", State: "closed", Author: "author1", LinkedPullRequests: tc.linked,
+			}}, nil, []string{tc.org + "/repo1/admin1"}, nil)
+
+			cli := newForgeClient(forgeSrv.URL, cnf, logger)
+			bot := &robot{cli: cli, cnf: cnf, log: logger, comments: cli, guard: newCloseGuard()}
+			key := closeGuardKey(tc.org, "repo1", "1")
+			if tc.own {
+				bot.guard.recordOwn(key, "closed")
+			}
+			for n := 0; n < tc.reopened; n++ {
+				bot.guard.allowReopen(key, &tc.guard)
+			}
+
+			strs := []string{framework.IssueEvent, "guid-" + strconv.Itoa(i), tc.action, tc.org, "repo1", "1", "closed", tc.closer}
+			rec, _ := bot.handleEvent(&client.GenericEvent{
+				EventType: &strs[0], EventGUID: &strs[1], Action: &strs[2], Org: &strs[3], Repo: &strs[4],
+				Number: &strs[5], State: &strs[6], Author: &strs[7],
+			}, logger)
+
+			item, _ := forge.item(kindIssue, tc.org, "repo1", "1")
+			assert.Equal(t, tc.state, item.State)
+			if tc.policy == "" {
+				assert.Equal(t, (*auditRecord)(nil), rec)
+				return
+			}
+			assert.Equal(t, tc.policy, rec.Policy)
+			assert.Equal(t, tc.closer, rec.Actor)
+			assert.Equal(t, "author1", rec.Author)
+			assert.Equal(t, actionReopen, rec.Action)
+
+			comments := forge.listComments()
+			if tc.state == "opened" {
+				assert.Equal(t, 1, len(comments))
+				assert.Equal(t, true, strings.Contains(comments[0].Body, "@"+tc.closer))
+				// The reopen by the guard itself is not guarded again
+				assert.Equal(t, true, bot.guard.isOwn(key, "opened"))
+			} else {
+				assert.Equal(t, 0, len(comments))
+			}
+		})
+	}
+}
@@ -28,20 +28,42 @@ type repoConfig struct {
 	// true: issue can be closed only when its linking PR exists
 	// false: issue can be directly closed
 	NeedIssueHasLinkPullRequests bool `json:"need_issue_has_link_pull_requests,omitempty"`
+	// Mode is empty or shadow, the robot only logs what it would do on the platform in the shadow mode
+	Mode string `json:"mode,omitempty"`
+	// Sinks receive the lifecycle events of the repositories in the CloudEvents format
+	Sinks []sinkConfig `json:"sinks,omitempty"`
+	// CloseGuard reopens the issues closed on the web UI without the linked pull requests
+	CloseGuard closeGuardConfig `json:"close_guard,omitempty"`
 }
 
-// validate to check the repoConfig data's validation, returns an error if invalid
-func (c *repoConfig) validate() error {
+// validate to check the repoConfig data's validation, returns an error if invalid.
+// closeGuardComment is the template of the comment on the issues reopened by the close guard.
+func (c *repoConfig) validate(closeGuardComment string) error {
 	// If the bot is not configured to monitor any repositories, return an error.
 	if len(c.Repos) == 0 {
 		return errors.New("the repositories configuration can not be empty")
 	}
 
+	if c.Mode != "" && c.Mode != modeShadow {
+		return errors.New("unsupported mode: " + c.Mode)
+	}
+
+	if err := c.CloseGuard.validate(c.NeedIssueHasLinkPullRequests, closeGuardComment); err != nil {
+		return err
+	}
+
+	for i := range c.Sinks {
+		if err := c.Sinks[i].validate(); err != nil {
+			return err
+		}
+	}
+
 	return c.RepoFilter.Validate()
 }
 
 // configuration holds a list of repoConfig configurations.
 // It also  includes sig information url, community name, event states, comment templates.
+// The optional comment templates fall back to the built-in ones in defaultCommentTemplates when they are empty.
 type configuration struct {
 	ConfigItems []repoConfig `json:"config_items,omitempty"`
 	// Sig information url.
@@ -60,6 +82,47 @@ type configuration struct {
 	CommentListLinkingPullRequestsFailure string `json:"comment_list_linking_pull_requests_failure"  required:"true"`
 	// Comment template for when no permission to operate on a PR.
 	CommentNoPermissionOperatePR string `json:"comment_no_permission_operate_pr"  required:"true"`
+	// Comment template for when the issue or PR is already in the state which the command changes to.
+	CommentStateUnchanged string `json:"comment_state_unchanged,omitempty"`
+	// Comment template for when the state of the issue or PR failed to be changed after the retries.
+	CommentUpdateStateFailure string `json:"comment_update_state_failure,omitempty"`
+	// Comment template for when the token of the robot is not allowed to change the state of the issue or PR.
+	CommentUpdateStateForbidden string `json:"comment_update_state_forbidden,omitempty"`
+	// Comment template for when the permission of the commenter failed to be checked after the retries.
+	CommentCheckPermissionFailure string `json:"comment_check_permission_failure,omitempty"`
+	// Comment template for when the command fails fast, because the requests to the platform failed repeatedly.
+	CommentPlatformUnavailable string `json:"comment_platform_unavailable,omitempty"`
+	// Comment template for when the policy audit reopens an issue which was closed without a linked PR.
+	CommentPolicyAuditReopen string `json:"comment_policy_audit_reopen,omitempty"`
+	// Comment template for when the close guard reopens an issue which was closed without a linked PR,
+	// it is required when the close_guard of any repository is enabled.
+	CommentIssueClosedWithoutLinkPR string `json:"comment_issue_closed_without_link_pr,omitempty"`
+	// Audit configures the sink of the lifecycle audit records.
+	Audit auditConfig `json:"audit,omitempty"`
+	// EventDedup configures how long the handled events are remembered to drop the redelivered ones.
+	EventDedup dedupConfig `json:"event_dedup,omitempty"`
+	// EventQueue configures the queue which handles the events of an issue or pull request one by one.
+	EventQueue queueConfig `json:"event_queue,omitempty"`
+	// EventTimeout is the deadline in seconds of handling an event, it is 60 by default.
+	EventTimeout int `json:"event_timeout,omitempty"`
+	// ActionQueue configures the persistent queue of the changes made on the platform.
+	ActionQueue actionQueueConfig `json:"action_queue,omitempty"`
+	// Retry configures the retries of changing the state of an issue or PR, and of checking the permission.
+	Retry retryConfig `json:"retry,omitempty"`
+	// RateLimit limits the requests to the platform per token and per method on the client side.
+	RateLimit rateLimitConfig `json:"rate_limit,omitempty"`
+	// CircuitBreaker configures when the requests to the platform fail fast after the repeated failures.
+	CircuitBreaker circuitBreakerConfig `json:"circuit_breaker,omitempty"`
+	// Platform configures the requests to the OpenAPI of the platform.
+	Platform platformConfig `json:"platform,omitempty"`
+	// PermissionCache configures the cache of the permission and sig lookups.
+	PermissionCache permissionCacheConfig `json:"permission_cache,omitempty"`
+	// Polling configures the polling of the comments in the repositories which can't have webhooks.
+	Polling pollingConfig `json:"polling,omitempty"`
+	// Backfill configures the replay of the commands commented while the robot was down.
+	Backfill backfillConfig `json:"backfill,omitempty"`
+	// ChatNotification configures the messages to the channels of the sigs on the reopens and the denied commands.
+	ChatNotification chatConfig `json:"chat_notification,omitempty"`
 }
 
 // Validate to check the configmap data's validation, returns an error if invalid
@@ -71,11 +134,63 @@ func (c *configuration) Validate() error {
 	// Validate each repo configuration
 	items := c.ConfigItems
 	for i := range items {
-		if err := items[i].validate(); err != nil {
+		if err := items[i].validate(c.CommentIssueClosedWithoutLinkPR); err != nil {
 			return err
 		}
 	}
 
+	if err := c.Audit.validate(); err != nil {
+		return err
+	}
+
+	if err := c.EventDedup.validate(); err != nil {
+		return err
+	}
+
+	if err := c.EventQueue.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Retry.validate(); err != nil {
+		return err
+	}
+
+	if err := c.ActionQueue.validate(); err != nil {
+		return err
+	}
+
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+
+	if err := c.CircuitBreaker.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Platform.validate(); err != nil {
+		return err
+	}
+
+	if err := c.PermissionCache.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Polling.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Backfill.validate(); err != nil {
+		return err
+	}
+
+	if err := c.ChatNotification.validate(); err != nil {
+		return err
+	}
+
+	if c.EventTimeout < 0 {
+		return errors.New("the event_timeout can not be negative")
+	}
+
 	return c.validateGlobalConfig()
 }
 
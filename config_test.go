@@ -20,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestValidate(t *testing.T) {
@@ -91,6 +92,62 @@ func TestValidate(t *testing.T) {
 
 }
 
+func TestCommentTemplate(t *testing.T) {
+	cnf := &configuration{}
+	assert.Equal(t, defaultCommentTemplates[templateStateUnchanged], cnf.commentTemplate(templateStateUnchanged))
+	assert.Equal(t, "", cnf.commentTemplate(templateIssueNeedsLinkPR))
+
+	assert.Equal(t, nil, utils.LoadFromYaml(findTestdata(t, configYaml), cnf))
+	assert.Equal(t, cnf.CommentStateUnchanged, cnf.commentTemplate(templateStateUnchanged))
+	assert.Equal(t, cnf.CommentIssueNeedsLinkPR, cnf.commentTemplate(templateIssueNeedsLinkPR))
+}
+
+func TestValidateCloseGuardComment(t *testing.T) {
+	cnf := &configuration{}
+	assert.Equal(t, nil, utils.LoadFromYaml(findTestdata(t, configYaml), cnf))
+
+	cnf.CommentIssueClosedWithoutLinkPR = ""
+	assert.Equal(t, errors.New("the comment_issue_closed_without_link_pr is required when the close_guard is enabled"),
+		cnf.Validate())
+
+	cnf.ConfigItems[1].CloseGuard.Enabled = false
+	assert.Equal(t, nil, cnf.Validate())
+}
+
+func TestPlatformConfig(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		cnf     platformConfig
+		err     error
+		baseURL string
+		timeout time.Duration
+	}{
+		{"the default platform", platformConfig{}, nil, gitcodeAPIBaseURL, 30 * time.Second},
+		{
+			"the configured platform",
+			platformConfig{APIURL: "http://127.0.0.1:8080/api/v5", Timeout: 5},
+			nil, "http://127.0.0.1:8080/api/v5/", 5 * time.Second,
+		},
+		{
+			"the api_url is not an http URL",
+			platformConfig{APIURL: "api.gitcode.com/api/v5/"},
+			errors.New("the platform api_url must be an http or https URL"), "api.gitcode.com/api/v5/", 30 * time.Second,
+		},
+		{
+			"the timeout is negative",
+			platformConfig{Timeout: -1},
+			errors.New("the platform timeout can not be negative"), gitcodeAPIBaseURL, -time.Second,
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			assert.Equal(t, testCases[i].err, testCases[i].cnf.validate())
+			assert.Equal(t, testCases[i].baseURL, testCases[i].cnf.baseURL())
+			assert.Equal(t, testCases[i].timeout, testCases[i].cnf.timeout())
+		})
+	}
+}
+
 func TestGetRepoConfig(t *testing.T) {
 	cnf := &configuration{}
 	got := cnf.getRepoConfig("owner1", "")
@@ -0,0 +1,329 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/framework"
+	"github.com/opensourceways/robot-framework-lib/utils"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// consumerRetryInterval is how long to wait after the topic or the poison topic failed
+	consumerRetryInterval = 5 * time.Second
+	// consumerMaxAttempts is how many times the event is handled before it is moved to the poison topic
+	consumerMaxAttempts = 3
+
+	headerPoisonReason    = "poison-reason"
+	headerSourceTopic     = "source-topic"
+	headerSourcePartition = "source-partition"
+	headerSourceOffset    = "source-offset"
+)
+
+// consumerMetrics counts the messages of the consumer mode by their results, they are handled or poisoned
+var consumerMetrics = expvar.NewMap("lifecycle_event_consumer")
+
+// eventMessage is a message of the topic, its value is the JSON of a client.GenericEvent
+type eventMessage struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+}
+
+// eventSource reads the messages of a consumer group
+type eventSource interface {
+	// fetch returns the next message, it blocks until there is one or ctx is done
+	fetch(ctx context.Context) (eventMessage, error)
+	// commit marks the message and the ones before it in the partition as consumed by the group
+	commit(ctx context.Context, msg eventMessage) error
+	close() error
+}
+
+// eventPublisher writes the messages to a topic
+type eventPublisher interface {
+	publish(ctx context.Context, topic string, msg eventMessage) error
+	close() error
+}
+
+// eventHandleFunc handles the event, the error tells the event is not handled
+type eventHandleFunc func(evt *client.GenericEvent, logger *logrus.Entry) error
+
+// eventHandlers are the handlers which the robot registers, they are dispatched as the framework does
+type eventHandlers struct {
+	push, issue, pullRequest, issueComment, pullRequestComment eventHandleFunc
+}
+
+// handler returns the handler of the event, or nil if nothing handles it
+func (h *eventHandlers) handler(evt *client.GenericEvent) eventHandleFunc {
+	switch utils.GetString(evt.EventType) {
+	case framework.IssueEvent:
+		return h.issue
+	case framework.PullRequestEvent:
+		return h.pullRequest
+	case framework.PushEvent:
+		return h.push
+	case framework.NoteEvent:
+		switch utils.GetString(evt.CommentKind) {
+		case client.CommentOnIssue:
+			return h.issueComment
+		case client.CommentOnPR:
+			return h.pullRequestComment
+		}
+	}
+	return nil
+}
+
+// eventConsumer feeds the events of a topic to the handlers registered by the robot.
+// The messages are handled one by one, and the offset is committed after the message is handled,
+// so the messages not handled are redelivered to the group. The message which still fails after
+// consumerMaxAttempts, or can't be handled at all, is written to the poison topic before it is committed.
+type eventConsumer struct {
+	source      eventSource
+	poison      eventPublisher
+	poisonTopic string
+	handlers    eventHandlers
+	log         *logrus.Entry
+	// retryInterval is how long to wait before the failed event or commit is tried again
+	retryInterval time.Duration
+}
+
+func newEventConsumer(bot *robot, source eventSource, poison eventPublisher, poisonTopic string) *eventConsumer {
+	c := &eventConsumer{
+		source:        source,
+		poison:        poison,
+		poisonTopic:   poisonTopic,
+		log:           bot.GetLogger().WithField("mode", "consumer"),
+		retryInterval: consumerRetryInterval,
+	}
+	bot.registerEventOutcomeHandlers(&c.handlers)
+	return c
+}
+
+// poisonError is the error of the message which can never be handled, it is not retried
+type poisonError struct {
+	err error
+}
+
+func (e *poisonError) Error() string {
+	return e.err.Error()
+}
+
+// run consumes the messages until ctx is done
+func (c *eventConsumer) run(ctx context.Context) {
+	for {
+		msg, err := c.source.fetch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.log.WithError(err).Error("failed to fetch the message")
+			if sleepContext(ctx, c.retryInterval) != nil {
+				return
+			}
+			continue
+		}
+
+		if !c.handle(ctx, msg) {
+			return
+		}
+	}
+}
+
+// handle handles the message and commits it, it returns false if the consumer should stop
+// because the message is left to be redelivered
+func (c *eventConsumer) handle(ctx context.Context, msg eventMessage) bool {
+	err := c.dispatch(msg)
+	var perr *poisonError
+	for i := 1; err != nil && i < consumerMaxAttempts && !errors.As(err, &perr); i++ {
+		// The event canceled on the shutdown is redelivered to the group
+		if errors.Is(err, errEventInterrupted) {
+			return false
+		}
+		c.log.WithError(err).Warningf("failed to handle the message %s, retry it", msgPosition(msg))
+		if sleepContext(ctx, c.retryInterval) != nil {
+			return false
+		}
+		err = c.dispatch(msg)
+	}
+
+	switch {
+	case errors.Is(err, errEventInterrupted):
+		return false
+	case err != nil:
+		c.log.WithError(err).Errorf("move the message %s to the poison topic", msgPosition(msg))
+		if !c.publishPoison(ctx, msg, err) {
+			return false
+		}
+		consumerMetrics.Add("poisoned", 1)
+	default:
+		consumerMetrics.Add("handled", 1)
+	}
+
+	return c.keepTrying(ctx, "commit the message "+msgPosition(msg), func(ctx context.Context) error {
+		return c.source.commit(ctx, msg)
+	})
+}
+
+// keepTrying calls fn until it succeeds or ctx is done. The first attempt is made even if ctx is done,
+// so the message handled on the shutdown is still committed.
+func (c *eventConsumer) keepTrying(ctx context.Context, what string, fn func(context.Context) error) bool {
+	for {
+		actx, cancel := context.WithTimeout(context.WithoutCancel(ctx), consumerRetryInterval)
+		err := fn(actx)
+		cancel()
+		if err == nil {
+			return true
+		}
+		c.log.WithError(err).Error("failed to " + what)
+		if sleepContext(ctx, c.retryInterval) != nil {
+			return false
+		}
+	}
+}
+
+// dispatch decodes the event of the message and runs its handler. The *poisonError is returned
+// if the message can never be handled, the other errors are returned by the handler.
+func (c *eventConsumer) dispatch(msg eventMessage) (err error) {
+	evt := new(client.GenericEvent)
+	if err = json.Unmarshal(msg.Value, evt); err != nil {
+		return &poisonError{fmt.Errorf("invalid event: %w", err)}
+	}
+	if evt.EventType == nil {
+		return &poisonError{errors.New("invalid event: the event type is missing")}
+	}
+
+	fn := c.handlers.handler(evt)
+	if fn == nil {
+		c.log.Warningf("there is no function to handle the %s message %s", *evt.EventType, msgPosition(msg))
+		return nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = &poisonError{fmt.Errorf("the handler panicked: %v", r)}
+		}
+	}()
+	return fn(evt, c.log.WithFields(*evt.CollectLoggingFields()))
+}
+
+// publishPoison writes the message to the poison topic, it keeps trying until ctx is done.
+// The message is dropped if there is no poison topic.
+func (c *eventConsumer) publishPoison(ctx context.Context, msg eventMessage, reason error) bool {
+	if c.poison == nil {
+		return true
+	}
+
+	p := msg
+	p.Headers = map[string]string{
+		headerPoisonReason:    reason.Error(),
+		headerSourceTopic:     msg.Topic,
+		headerSourcePartition: strconv.Itoa(msg.Partition),
+		headerSourceOffset:    strconv.FormatInt(msg.Offset, 10),
+	}
+	return c.keepTrying(ctx, "write the message "+msgPosition(msg)+" to the poison topic", func(ctx context.Context) error {
+		return c.poison.publish(ctx, c.poisonTopic, p)
+	})
+}
+
+func msgPosition(msg eventMessage) string {
+	return fmt.Sprintf("%s/%d@%d", msg.Topic, msg.Partition, msg.Offset)
+}
+
+// kafkaSource reads the messages of a Kafka consumer group, the offsets are committed synchronously
+type kafkaSource struct {
+	r *kafka.Reader
+}
+
+func newKafkaSource(brokers, topics []string, group string) *kafkaSource {
+	return &kafkaSource{r: kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     brokers,
+		GroupID:     group,
+		GroupTopics: topics,
+		// The new group starts from the latest events, the old commands beyond the dedup TTL are not run again
+		StartOffset: kafka.LastOffset,
+	})}
+}
+
+func (s *kafkaSource) fetch(ctx context.Context) (eventMessage, error) {
+	m, err := s.r.FetchMessage(ctx)
+	if err != nil {
+		return eventMessage{}, err
+	}
+
+	msg := eventMessage{
+		Topic: m.Topic, Partition: m.Partition, Offset: m.Offset, Key: m.Key, Value: m.Value,
+		Headers: map[string]string{},
+	}
+	for _, h := range m.Headers {
+		msg.Headers[h.Key] = string(h.Value)
+	}
+	return msg, nil
+}
+
+func (s *kafkaSource) commit(ctx context.Context, msg eventMessage) error {
+	return s.r.CommitMessages(ctx, kafka.Message{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset})
+}
+
+func (s *kafkaSource) close() error {
+	return s.r.Close()
+}
+
+// kafkaPublisher writes the messages to Kafka
+type kafkaPublisher struct {
+	w *kafka.Writer
+}
+
+func newKafkaPublisher(brokers []string) *kafkaPublisher {
+	return &kafkaPublisher{w: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}}
+}
+
+func (p *kafkaPublisher) publish(ctx context.Context, topic string, msg eventMessage) error {
+	m := kafka.Message{Topic: topic, Key: msg.Key, Value: msg.Value}
+	for k, v := range msg.Headers {
+		m.Headers = append(m.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	return p.w.WriteMessages(ctx, m)
+}
+
+func (p *kafkaPublisher) close() error {
+	return p.w.Close()
+}
+
+// splitList splits the comma separated list, the empty items are dropped
+func splitList(s string) []string {
+	var items []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			items = append(items, v)
+		}
+	}
+	return items
+}
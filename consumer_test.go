@@ -0,0 +1,264 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryBroker is an in-memory stand-in of Kafka, every topic has one partition
+type memoryBroker struct {
+	mu     sync.Mutex
+	topics map[string][]eventMessage
+	// committed is the next offset of every group on every topic
+	committed map[string]int64
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{topics: map[string][]eventMessage{}, committed: map[string]int64{}}
+}
+
+func (b *memoryBroker) produce(topic string, value []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.topics[topic] = append(b.topics[topic], eventMessage{
+		Topic: topic, Offset: int64(len(b.topics[topic])), Value: value,
+	})
+}
+
+func (b *memoryBroker) messages(topic string) []eventMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]eventMessage(nil), b.topics[topic]...)
+}
+
+func (b *memoryBroker) committedOffset(group, topic string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.committed[group+"/"+topic]
+}
+
+func (b *memoryBroker) publish(_ context.Context, topic string, msg eventMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	msg.Topic, msg.Offset = topic, int64(len(b.topics[topic]))
+	b.topics[topic] = append(b.topics[topic], msg)
+	return nil
+}
+
+func (b *memoryBroker) close() error {
+	return nil
+}
+
+// consumer joins the group, it starts from the offsets committed by the group
+func (b *memoryBroker) consumer(group string, topics ...string) *memorySource {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	next := map[string]int64{}
+	for _, topic := range topics {
+		next[topic] = b.committed[group+"/"+topic]
+	}
+	return &memorySource{b: b, group: group, topics: topics, next: next}
+}
+
+type memorySource struct {
+	b      *memoryBroker
+	group  string
+	topics []string
+	next   map[string]int64
+}
+
+func (s *memorySource) fetch(ctx context.Context) (eventMessage, error) {
+	for {
+		s.b.mu.Lock()
+		for _, topic := range s.topics {
+			if msgs := s.b.topics[topic]; s.next[topic] < int64(len(msgs)) {
+				msg := msgs[s.next[topic]]
+				s.next[topic]++
+				s.b.mu.Unlock()
+				return msg, nil
+			}
+		}
+		s.b.mu.Unlock()
+
+		if err := sleepContext(ctx, time.Millisecond); err != nil {
+			return eventMessage{}, err
+		}
+	}
+}
+
+func (s *memorySource) commit(_ context.Context, msg eventMessage) error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+
+	s.b.committed[s.group+"/"+msg.Topic] = msg.Offset + 1
+	return nil
+}
+
+func (s *memorySource) close() error {
+	return nil
+}
+
+func marshalEvent(t *testing.T, evt *client.GenericEvent) []byte {
+	data, err := json.Marshal(evt)
+	assert.Equal(t, nil, err)
+	return data
+}
+
+func TestEventConsumer(t *testing.T) {
+	broker := newMemoryBroker()
+	broker.produce("events", marshalEvent(t, newCloseEvent("guid1")))
+	broker.produce("events", []byte("not an event"))
+	broker.produce("events", []byte(`{"eventType":"Push Hook"}`))
+	broker.produce("events", marshalEvent(t, newCloseEvent("guid1")))
+
+	mc := &mockClient{successfulCheckPermission: true, permission: true, successfulUpdateIssue: true}
+	bot := newShutdownTestRobot(t, mc)
+
+	for _, group := range []string{"lifecycle", "another"} {
+		c := newEventConsumer(bot, broker.consumer(group, "events"), broker, "poison")
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			c.run(ctx)
+			close(done)
+		}()
+
+		// every group consumes all the messages
+		assert.Eventually(t, func() bool {
+			return broker.committedOffset(group, "events") == 4
+		}, time.Second, time.Millisecond)
+		cancel()
+		<-done
+	}
+	assert.Equal(t, "UpdateIssue", mc.method)
+
+	poison := broker.messages("poison")
+	assert.Equal(t, 2, len(poison))
+	assert.Equal(t, []byte("not an event"), poison[0].Value)
+	assert.Equal(t, "events", poison[0].Headers[headerSourceTopic])
+	assert.Equal(t, "1", poison[0].Headers[headerSourceOffset])
+	assert.Equal(t, true, strings.HasPrefix(poison[0].Headers[headerPoisonReason], "invalid event"))
+}
+
+func TestEventConsumerRedelivery(t *testing.T) {
+	broker := newMemoryBroker()
+	broker.produce("events", marshalEvent(t, newCloseEvent("guid1")))
+	broker.produce("events", marshalEvent(t, newCloseEvent("guid2")))
+	broker.produce("events", marshalEvent(t, newCloseEvent("guid3")))
+	broker.produce("events", marshalEvent(t, newCloseEvent("guid4")))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	interrupted := false
+	c := &eventConsumer{
+		source:      broker.consumer("lifecycle", "events"),
+		poison:      broker,
+		poisonTopic: "poison",
+		log:         logrus.NewEntry(logger),
+	}
+	var handled []string
+	attempts := map[string]int{}
+	c.handlers.issueComment = func(evt *client.GenericEvent, _ *logrus.Entry) error {
+		guid := *evt.EventGUID
+		attempts[guid]++
+		switch {
+		case guid == "guid1":
+			panic("unexpected event")
+		case interrupted:
+			return errEventInterrupted
+		case guid == "guid3" && attempts[guid] < consumerMaxAttempts:
+			return errQueueFull
+		case guid == "guid4":
+			return errQueueFull
+		}
+		handled = append(handled, guid)
+		return nil
+	}
+
+	// the message whose handler panicked is poisoned
+	msg, _ := c.source.fetch(context.Background())
+	assert.Equal(t, true, c.handle(context.Background(), msg))
+	assert.Equal(t, int64(1), broker.committedOffset("lifecycle", "events"))
+	assert.Equal(t, "the handler panicked: unexpected event", broker.messages("poison")[0].Headers[headerPoisonReason])
+
+	// the message canceled on the shutdown is not committed
+	interrupted = true
+	msg, _ = c.source.fetch(context.Background())
+	assert.Equal(t, false, c.handle(context.Background(), msg))
+	assert.Equal(t, int64(1), broker.committedOffset("lifecycle", "events"))
+
+	// the next consumer of the group gets the message again
+	interrupted = false
+	c.source = broker.consumer("lifecycle", "events")
+	msg, _ = c.source.fetch(context.Background())
+	assert.Equal(t, int64(1), msg.Offset)
+	assert.Equal(t, true, c.handle(context.Background(), msg))
+	assert.Equal(t, []string{"guid2"}, handled)
+	assert.Equal(t, int64(2), broker.committedOffset("lifecycle", "events"))
+
+	// the message failed for a while is retried until it is handled
+	msg, _ = c.source.fetch(context.Background())
+	assert.Equal(t, true, c.handle(context.Background(), msg))
+	assert.Equal(t, []string{"guid2", "guid3"}, handled)
+	assert.Equal(t, int64(3), broker.committedOffset("lifecycle", "events"))
+	assert.Equal(t, 1, len(broker.messages("poison")))
+
+	// the message which keeps failing is poisoned after the last attempt
+	msg, _ = c.source.fetch(context.Background())
+	assert.Equal(t, true, c.handle(context.Background(), msg))
+	assert.Equal(t, consumerMaxAttempts, attempts["guid4"])
+	assert.Equal(t, int64(4), broker.committedOffset("lifecycle", "events"))
+	assert.Equal(t, errQueueFull.Error(), broker.messages("poison")[1].Headers[headerPoisonReason])
+}
+
+func TestEventConsumerInterrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unfinished_events.json")
+	broker := newMemoryBroker()
+	broker.produce("events", marshalEvent(t, newCloseEvent("guid1")))
+
+	cli := &blockingClient{started: make(chan struct{})}
+	bot := newShutdownTestRobot(t, cli)
+	bot.unfinished = &unfinishedEvents{path: path}
+	c := newEventConsumer(bot, broker.consumer("lifecycle", "events"), broker, "poison")
+
+	msg, _ := c.source.fetch(context.Background())
+	handled := make(chan bool)
+	go func() {
+		handled <- c.handle(context.Background(), msg)
+	}()
+	<-cli.started
+
+	// the consumed event is left to Kafka instead of the unfinished events file
+	assert.Equal(t, nil, bot.shutdown(20*time.Millisecond))
+	assert.Equal(t, false, <-handled)
+	assert.Equal(t, int64(0), broker.committedOffset("lifecycle", "events"))
+	_, err := os.Stat(path)
+	assert.Equal(t, true, os.IsNotExist(err))
+}
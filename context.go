@@ -0,0 +1,58 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultEventTimeout = 60
+
+	logFieldEventGUID = "event_guid"
+)
+
+type contextKey int
+
+const (
+	contextKeyEventGUID contextKey = iota
+)
+
+func withEventGUID(ctx context.Context, guid string) context.Context {
+	return context.WithValue(ctx, contextKeyEventGUID, guid)
+}
+
+// eventGUIDFromContext returns the GUID of the event which ctx belongs to, it is empty if there is none
+func eventGUIDFromContext(ctx context.Context) string {
+	guid, _ := ctx.Value(contextKeyEventGUID).(string)
+	return guid
+}
+
+// eventContext returns the context of handling an event. It is canceled when the event_timeout
+// is reached, or when the robot shuts down.
+func (bot *robot) eventContext(guid string) (context.Context, context.CancelFunc) {
+	parent := bot.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	timeout := defaultEventTimeout * time.Second
+	if bot.cnf != nil && bot.cnf.EventTimeout > 0 {
+		timeout = time.Duration(bot.cnf.EventTimeout) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	return withEventGUID(ctx, guid), cancel
+}
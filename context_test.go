@@ -0,0 +1,71 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEventContext(t *testing.T) {
+	parent, shutdown := context.WithCancel(context.Background())
+	bot := &robot{cnf: &configuration{EventTimeout: 5}, ctx: parent}
+
+	ctx, cancel := bot.eventContext("guid1")
+	defer cancel()
+	assert.Equal(t, "guid1", eventGUIDFromContext(ctx))
+	deadline, ok := ctx.Deadline()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, time.Until(deadline) <= 5*time.Second && time.Until(deadline) > 4*time.Second)
+
+	// the events are canceled on the shutdown
+	shutdown()
+	<-ctx.Done()
+	assert.Equal(t, context.Canceled, ctx.Err())
+
+	// the default timeout is used without the configuration
+	ctx, cancel = (&robot{}).eventContext("")
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	assert.Equal(t, true, time.Until(deadline) > (defaultEventTimeout-1)*time.Second)
+	assert.Equal(t, "", eventGUIDFromContext(ctx))
+}
+
+func TestGitcodeClientDeadline(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the platform is too slow
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	cli := newForgeClient(srv.URL, &configuration{}, logrus.NewEntry(logger))
+
+	ctx, cancel := context.WithTimeout(withEventGUID(context.Background(), "guid1"), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := cli.CheckPermission(ctx, "owner1", "repo1", "user1")
+	assert.Equal(t, true, errors.Is(err, errTransient))
+	assert.Equal(t, true, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, true, time.Since(start) < 5*time.Second)
+}
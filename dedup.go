@@ -0,0 +1,248 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupTTL        = 24 * 60 * 60
+	defaultDedupMaxEntries = 10000
+	// dedupPruneInterval is how many handled events are recorded between two prunes of the store
+	dedupPruneInterval = 256
+)
+
+var bucketHandledEvents = []byte("handled_events")
+
+// dedupConfig configures the deduplication of redelivered webhooks
+type dedupConfig struct {
+	// TTL is how long in seconds a handled event is remembered, it is one day by default.
+	TTL int `json:"ttl,omitempty"`
+	// MaxEntries bounds the number of events remembered in memory.
+	MaxEntries int `json:"max_entries,omitempty"`
+	// Persistent keeps the handled events in the store, so they are remembered across restarts.
+	Persistent bool `json:"persistent,omitempty"`
+}
+
+func (c *dedupConfig) validate() error {
+	if c.TTL < 0 || c.MaxEntries < 0 {
+		return errors.New("the event_dedup ttl and max_entries can not be negative")
+	}
+	return nil
+}
+
+// handledEvent is the result of an event, it is returned when the event is redelivered
+type handledEvent struct {
+	HandledAt time.Time `json:"handled_at"`
+	Command   string    `json:"command,omitempty"`
+	Policy    string    `json:"policy,omitempty"`
+	Outcome   string    `json:"outcome,omitempty"`
+}
+
+func newHandledEvent(rec *auditRecord) *handledEvent {
+	if rec == nil {
+		return &handledEvent{HandledAt: time.Now().UTC()}
+	}
+	return &handledEvent{HandledAt: rec.Time, Command: rec.Action, Policy: rec.Policy, Outcome: rec.Outcome}
+}
+
+type dedupEntry struct {
+	guid    string
+	expires time.Time
+	// result is nil while the event is being handled
+	result *handledEvent
+}
+
+// eventDeduper drops the events whose GUID was seen before.
+// The GUIDs are remembered in a bounded in-memory cache, and optionally in the store.
+type eventDeduper struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List
+	st         *store
+	writes     int
+	now        func() time.Time
+}
+
+func newEventDeduper(c *dedupConfig, st *store) (*eventDeduper, error) {
+	d := &eventDeduper{
+		ttl:        time.Duration(c.TTL) * time.Second,
+		maxEntries: c.MaxEntries,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+		now:        time.Now,
+	}
+	if d.ttl == 0 {
+		d.ttl = defaultDedupTTL * time.Second
+	}
+	if d.maxEntries == 0 {
+		d.maxEntries = defaultDedupMaxEntries
+	}
+
+	if c.Persistent && st != nil {
+		err := st.db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(bucketHandledEvents)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		d.st = st
+	}
+
+	return d, nil
+}
+
+// begin marks the event as being handled. If the event was seen before, dup is true and
+// prev is its original result, prev is nil when the first delivery is still being handled.
+func (d *eventDeduper) begin(guid string) (prev *handledEvent, dup bool) {
+	if d == nil || guid == "" {
+		return nil, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	if e, ok := d.entries[guid]; ok {
+		entry := e.Value.(*dedupEntry)
+		if now.Before(entry.expires) {
+			return entry.result, true
+		}
+		d.remove(e)
+	}
+
+	if prev = d.load(guid, now); prev != nil {
+		d.add(&dedupEntry{guid: guid, expires: prev.HandledAt.Add(d.ttl), result: prev})
+		return prev, true
+	}
+
+	d.add(&dedupEntry{guid: guid, expires: now.Add(d.ttl)})
+	return nil, false
+}
+
+// finish records the result of the event
+func (d *eventDeduper) finish(guid string, result *handledEvent) error {
+	if d == nil || guid == "" {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.entries[guid]; ok {
+		e.Value.(*dedupEntry).result = result
+	} else {
+		d.add(&dedupEntry{guid: guid, expires: d.now().Add(d.ttl), result: result})
+	}
+
+	if d.st == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	err = d.st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketHandledEvents).Put([]byte(guid), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	if d.writes++; d.writes%dedupPruneInterval == 0 {
+		return d.prune()
+	}
+	return nil
+}
+
+// forget removes the event being handled, so it is handled when it is redelivered
+func (d *eventDeduper) forget(guid string) {
+	if d == nil || guid == "" {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.entries[guid]; ok {
+		d.remove(e)
+	}
+}
+
+// load returns the result of the event kept in the store if it is not expired
+func (d *eventDeduper) load(guid string, now time.Time) (result *handledEvent) {
+	if d.st == nil {
+		return nil
+	}
+
+	_ = d.st.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketHandledEvents).Get([]byte(guid))
+		if v == nil {
+			return nil
+		}
+
+		r := &handledEvent{}
+		if err := json.Unmarshal(v, r); err == nil && now.Before(r.HandledAt.Add(d.ttl)) {
+			result = r
+		}
+		return nil
+	})
+	return
+}
+
+// prune deletes the expired events from the store
+func (d *eventDeduper) prune() error {
+	deadline := d.now().Add(-d.ttl)
+	return d.st.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketHandledEvents)
+		// The keys are deleted after the iteration, the bucket must not be changed while it is iterated
+		var expired [][]byte
+		_ = b.ForEach(func(k, v []byte) error {
+			r := handledEvent{}
+			if err := json.Unmarshal(v, &r); err != nil || r.HandledAt.Before(deadline) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// add remembers the entry in memory, and evicts the oldest entries beyond the bound
+func (d *eventDeduper) add(entry *dedupEntry) {
+	d.entries[entry.guid] = d.order.PushBack(entry)
+	for d.order.Len() > d.maxEntries {
+		d.remove(d.order.Front())
+	}
+}
+
+func (d *eventDeduper) remove(e *list.Element) {
+	delete(d.entries, e.Value.(*dedupEntry).guid)
+	d.order.Remove(e)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"testing"
+	"time"
+)
+
+func TestDedupConfigValidate(t *testing.T) {
+	c := &dedupConfig{TTL: -1}
+	assert.Equal(t, errors.New("the event_dedup ttl and max_entries can not be negative"), c.validate())
+	assert.Equal(t, nil, (&dedupConfig{}).validate())
+}
+
+func TestEventDeduper(t *testing.T) {
+	d, err := newEventDeduper(&dedupConfig{TTL: 60, MaxEntries: 2}, nil)
+	assert.Equal(t, nil, err)
+	now := time.Date(2024, 12, 15, 10, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	// the events without a GUID are always handled
+	_, dup := d.begin("")
+	assert.Equal(t, false, dup)
+
+	prev, dup := d.begin("guid1")
+	assert.Equal(t, false, dup)
+	assert.Equal(t, (*handledEvent)(nil), prev)
+
+	// the first delivery is still being handled
+	prev, dup = d.begin("guid1")
+	assert.Equal(t, true, dup)
+	assert.Equal(t, (*handledEvent)(nil), prev)
+
+	result := &handledEvent{HandledAt: now, Command: actionClose, Policy: policyAllowed, Outcome: outcomeSuccess}
+	assert.Equal(t, nil, d.finish("guid1", result))
+	prev, dup = d.begin("guid1")
+	assert.Equal(t, true, dup)
+	assert.Equal(t, result, prev)
+
+	// the event is forgotten after the ttl
+	now = now.Add(61 * time.Second)
+	_, dup = d.begin("guid1")
+	assert.Equal(t, false, dup)
+
+	// the oldest event is evicted beyond the bound
+	_, _ = d.begin("guid2")
+	_, _ = d.begin("guid3")
+	assert.Equal(t, 2, len(d.entries))
+	_, dup = d.begin("guid1")
+	assert.Equal(t, false, dup)
+}
+
+func TestPersistentEventDeduper(t *testing.T) {
+	st := newTestStore(t)
+	d, err := newEventDeduper(&dedupConfig{TTL: 60, Persistent: true}, st)
+	assert.Equal(t, nil, err)
+	now := time.Date(2024, 12, 15, 10, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	_, _ = d.begin("guid1")
+	result := &handledEvent{HandledAt: now, Command: actionReopen, Policy: policyNoPermission, Outcome: outcomeSkipped}
+	assert.Equal(t, nil, d.finish("guid1", result))
+	_, _ = d.begin("guid2")
+	assert.Equal(t, nil, d.finish("guid2", &handledEvent{HandledAt: now.Add(-time.Hour)}))
+	_, _ = d.begin("guid3")
+	assert.Equal(t, nil, d.finish("guid3", &handledEvent{HandledAt: now.Add(-time.Hour)}))
+
+	// a restarted robot still remembers the event
+	d, err = newEventDeduper(&dedupConfig{TTL: 60, Persistent: true}, st)
+	assert.Equal(t, nil, err)
+	d.now = func() time.Time { return now }
+	prev, dup := d.begin("guid1")
+	assert.Equal(t, true, dup)
+	assert.Equal(t, result.Outcome, prev.Outcome)
+	assert.Equal(t, result.Policy, prev.Policy)
+
+	// the expired events are pruned, even the ones next to each other
+	assert.Equal(t, nil, d.prune())
+	assert.Equal(t, (*handledEvent)(nil), d.load("guid2", now.Add(-2*time.Hour)))
+	var left []string
+	_ = st.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketHandledEvents).ForEach(func(k, _ []byte) error {
+			left = append(left, string(k))
+			return nil
+		})
+	})
+	assert.Equal(t, []string{"guid1"}, left)
+	assert.NotEqual(t, (*handledEvent)(nil), d.load("guid1", now))
+}
@@ -0,0 +1,34 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+const (
+	// modeShadow evaluates every event of the repository without changing anything on the platform
+	modeShadow = "shadow"
+
+	// outcomeShadowed means the decision was only logged because of the dry-run or shadow mode
+	outcomeShadowed = "shadowed"
+)
+
+// withRepoMode returns the robot which handles the events of the repository,
+// it is a copy which only logs the planned actions in the dry-run or shadow mode.
+func (bot *robot) withRepoMode(repoCnf *repoConfig) *robot {
+	if !bot.dryRun && repoCnf.Mode != modeShadow {
+		return bot
+	}
+
+	b := *bot
+	b.shadow = true
+	return &b
+}
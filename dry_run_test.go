@@ -0,0 +1,95 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	sconfig "github.com/opensourceways/server-common-lib/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestRepoConfigMode(t *testing.T) {
+	c := &repoConfig{RepoFilter: sconfig.RepoFilter{Repos: []string{"owner1"}}, Mode: "silent"}
+	assert.Equal(t, errors.New("unsupported mode: silent"), c.validate(""))
+
+	c.Mode = modeShadow
+	assert.Equal(t, nil, c.validate(""))
+}
+
+func TestShadowMode(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		dryRun  bool
+		mode    string
+		method  string
+		outcome string
+	}{
+		{
+			"the repository runs normally",
+			false,
+			"",
+			"UpdateIssue",
+			outcomeSuccess,
+		},
+		{
+			"the repository runs in the shadow mode",
+			false,
+			modeShadow,
+			"GetIssueState",
+			outcomeShadowed,
+		},
+		{
+			"the robot runs in the dry-run mode",
+			true,
+			"",
+			"GetIssueState",
+			outcomeShadowed,
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			mc := &mockClient{successfulCheckPermission: true, permission: true, successfulUpdateIssue: true}
+			bot := &robot{cli: mc, cnf: &configuration{
+				ConfigItems: []repoConfig{{
+					RepoFilter: sconfig.RepoFilter{Repos: []string{org}},
+					Mode:       testCases[i].mode,
+				}},
+				EventStateOpened: "opened",
+				EventStateClosed: "closed",
+			}, audit: &writerAuditSink{w: buf}, dryRun: testCases[i].dryRun}
+
+			event := new(client.GenericEvent)
+			data, _ := os.ReadFile(findTestdata(t, "note_event.json"))
+			assert.Equal(t, nil, json.Unmarshal(data, event))
+			*event.Org, *event.Repo, *event.Number = org, repo, number
+			*event.Comment = comment
+			*event.CommentKind = client.CommentOnIssue
+
+			bot.handleCommentEvent(event, bot.cnf, nil)
+			// the platform is still read, but the issue is not closed in shadow
+			assert.Equal(t, testCases[i].method, mc.method)
+
+			rec := auditRecord{}
+			assert.Equal(t, nil, json.Unmarshal(buf.Bytes(), &rec))
+			assert.Equal(t, testCases[i].outcome, rec.Outcome)
+		})
+	}
+}
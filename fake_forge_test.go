@@ -0,0 +1,302 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// issueActionStates are the states of the issues after the actions, which name the updates of the
+// OpenAPI and the issue events
+var issueActionStates = map[string]string{"close": "closed", "reopen": "opened"}
+
+// prActionStates are the states of the pull requests after the updates of the OpenAPI
+var prActionStates = map[string]string{"closed": "closed", "open": "opened"}
+
+const (
+	fakeForgeAPIPath = "/api/v5/"
+	fakeForgeSigPath = "/sig"
+
+	kindIssue       = "issue"
+	kindPullRequest = "pull_request"
+)
+
+// forgeItem is an issue or a pull request kept by the fake forge
+type forgeItem struct {
+	Org                string    `json:"org"`
+	Repo               string    `json:"repo"`
+	Number             string    `json:"number"`
+	State              string    `json:"state"`
+	Author             string    `json:"author"`
+	LinkedPullRequests int       `json:"linked_pull_requests"`
+	Title              string    `json:"title,omitempty"`
+	ClosedAt           time.Time `json:"closed_at,omitempty"`
+}
+
+func (i *forgeItem) key() string {
+	return i.Org + "/" + i.Repo + "/" + i.Number
+}
+
+// forgeComment is a comment the robot created on the fake forge
+type forgeComment struct {
+	Kind   string `json:"kind"`
+	Org    string `json:"org"`
+	Repo   string `json:"repo"`
+	Number string `json:"number"`
+	Body   string `json:"body"`
+}
+
+// fakeForge is an in-process stand-in of the platform OpenAPI and the sig information service
+type fakeForge struct {
+	mu       sync.Mutex
+	issues   map[string]*forgeItem
+	prs      map[string]*forgeItem
+	admins   []string
+	sigs     map[string][]client.SigInfo
+	comments []forgeComment
+}
+
+func newFakeForge() *fakeForge {
+	f := &fakeForge{}
+	f.reset(nil, nil, nil, nil)
+	return f
+}
+
+// reset replaces the whole state of the forge
+func (f *fakeForge) reset(issues, prs []forgeItem, admins []string, sigs map[string][]client.SigInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.issues, f.prs = map[string]*forgeItem{}, map[string]*forgeItem{}
+	for i := range issues {
+		item := issues[i]
+		f.issues[item.key()] = &item
+	}
+	for i := range prs {
+		item := prs[i]
+		f.prs[item.key()] = &item
+	}
+	f.admins, f.sigs, f.comments = admins, sigs, nil
+}
+
+func (f *fakeForge) item(kind, org, repo, number string) (forgeItem, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	items := f.issues
+	if kind == kindPullRequest {
+		items = f.prs
+	}
+	item, ok := items[org+"/"+repo+"/"+number]
+	if !ok {
+		return forgeItem{}, false
+	}
+	return *item, true
+}
+
+// setState changes the state of the issue or the pull request like the web UI does
+func (f *fakeForge) setState(kind, org, repo, number, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	items := f.issues
+	if kind == kindPullRequest {
+		items = f.prs
+	}
+	if item, ok := items[org+"/"+repo+"/"+number]; ok {
+		item.State = state
+	}
+}
+
+func (f *fakeForge) listComments() []forgeComment {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]forgeComment(nil), f.comments...)
+}
+
+func (f *fakeForge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == fakeForgeSigPath {
+		f.serveSigInfo(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, fakeForgeAPIPath) || r.Header.Get("Authorization") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p := strings.Split(strings.TrimPrefix(r.URL.Path, fakeForgeAPIPath), "/")
+
+	switch {
+	// GET repos/{org}/{repo}/collaborators/{username}/permission
+	case r.Method == http.MethodGet && len(p) == 6 && p[3] == "collaborators" && p[5] == "permission":
+		permission := "read"
+		if slices.Contains(f.admins, p[1]+"/"+p[2]+"/"+p[4]) {
+			permission = permissionAdmin
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"permission": permission})
+
+	// PATCH repos/{org}/issues/{number}
+	case r.Method == http.MethodPatch && len(p) == 4 && p[2] == "issues":
+		req := map[string]string{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		f.updateState(w, f.issues[p[1]+"/"+req["repo"]+"/"+p[3]], issueActionStates[req["state"]])
+
+	// PATCH repos/{org}/{repo}/pulls/{number}
+	case r.Method == http.MethodPatch && len(p) == 5 && p[3] == "pulls":
+		req := map[string]string{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		f.updateState(w, f.prs[p[1]+"/"+p[2]+"/"+p[4]], prActionStates[req["state"]])
+
+	// GET repos/{org}/{repo}/issues|pulls/{number}
+	case r.Method == http.MethodGet && len(p) == 5 && (p[3] == "issues" || p[3] == "pulls"):
+		items := f.issues
+		if p[3] == "pulls" {
+			items = f.prs
+		}
+		item, ok := items[p[1]+"/"+p[2]+"/"+p[4]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// the OpenAPI names the opened state open
+		state := item.State
+		if state == "opened" {
+			state = "open"
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"number": item.Number, "state": state, "user": map[string]string{"login": item.Author},
+		})
+
+	// GET orgs/{org}/repos, the pages are not supported
+	case r.Method == http.MethodGet && len(p) == 3 && p[0] == "orgs" && p[2] == "repos":
+		repos := []map[string]string{}
+		if r.URL.Query().Get("page") == "1" {
+			seen := map[string]bool{}
+			for _, item := range f.issues {
+				if item.Org == p[1] && !seen[item.Repo] {
+					seen[item.Repo] = true
+					repos = append(repos, map[string]string{"path": item.Repo})
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, repos)
+
+	// GET repos/{org}/{repo}/issues?state=closed, the pages are not supported
+	case r.Method == http.MethodGet && len(p) == 4 && p[3] == "issues":
+		issues := []map[string]interface{}{}
+		if r.URL.Query().Get("page") == "1" {
+			for _, item := range f.issues {
+				if item.Org == p[1] && item.Repo == p[2] && item.State == "closed" {
+					issues = append(issues, map[string]interface{}{
+						"number": item.Number, "title": item.Title, "closed_at": item.ClosedAt,
+						"user": map[string]string{"login": item.Author},
+					})
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, issues)
+
+	// GET repos/{org}/{repo}/issues/{number}/pull_requests
+	case r.Method == http.MethodGet && len(p) == 6 && p[3] == "issues" && p[5] == "pull_requests":
+		item, ok := f.issues[p[1]+"/"+p[2]+"/"+p[4]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, make([]struct{}, item.LinkedPullRequests))
+
+	// POST repos/{org}/{repo}/issues|pulls/{number}/comments
+	case r.Method == http.MethodPost && len(p) == 6 && p[5] == "comments":
+		req := map[string]string{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		kind := kindIssue
+		if p[3] == "pulls" {
+			kind = kindPullRequest
+		}
+		f.comments = append(f.comments, forgeComment{
+			Kind: kind, Org: p[1], Repo: p[2], Number: p[4], Body: req["body"],
+		})
+		writeJSON(w, http.StatusCreated, req)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeForge) updateState(w http.ResponseWriter, item *forgeItem, state string) {
+	if item == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if state == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	item.State = state
+	writeJSON(w, http.StatusOK, item)
+}
+
+func (f *fakeForge) serveSigInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"data": f.sigs[r.URL.Query().Get("repo")],
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// forgeSigs stands in for the client of robot-framework-lib, which can't be pointed at the fake forge
+type forgeSigs struct {
+	srvURL string
+}
+
+func (s forgeSigs) ListSigAllMember(org, repo string) ([]client.SigInfo, bool) {
+	resp, err := http.Get(s.srvURL + fakeForgeSigPath + "?repo=" + url.QueryEscape(org+"/"+repo))
+	if err != nil {
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	data := struct {
+		Data []client.SigInfo `json:"data"`
+	}{}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&data) != nil {
+		return nil, false
+	}
+	return data.Data, true
+}
+
+// newForgeClient creates the client which requests the server at srvURL instead of the platform,
+// the api_url of cnf is set to the server
+func newForgeClient(srvURL string, cnf *configuration, logger *logrus.Entry) *gitcodeClient {
+	cnf.Platform.APIURL = srvURL + fakeForgeAPIPath
+	return newGitcodeClient(cnf, forgeSigs{srvURL: srvURL}, []byte("token"), logger)
+}
@@ -0,0 +1,431 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	gitcodeAPIBaseURL = "https://api.gitcode.com/api/v5/"
+	// defaultPlatformTimeout is the timeout in seconds of a request to the OpenAPI
+	defaultPlatformTimeout = 30
+
+	permissionAdmin = "admin"
+)
+
+// platformConfig configures the requests to the GitCode OpenAPI v5
+type platformConfig struct {
+	// APIURL is the base URL of the OpenAPI, it is https://api.gitcode.com/api/v5/ by default.
+	APIURL string `json:"api_url,omitempty"`
+	// Timeout is the timeout in seconds of a request, it is 30 by default.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func (c *platformConfig) validate() error {
+	if c.Timeout < 0 {
+		return errors.New("the platform timeout can not be negative")
+	}
+	if c.APIURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.APIURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("the platform api_url must be an http or https URL")
+	}
+	return nil
+}
+
+// baseURL returns the base URL of the OpenAPI which ends with a slash
+func (c *platformConfig) baseURL() string {
+	if c.APIURL == "" {
+		return gitcodeAPIBaseURL
+	}
+	return strings.TrimSuffix(c.APIURL, "/") + "/"
+}
+
+func (c *platformConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return defaultPlatformTimeout * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// sigSource lists the sigs of a repository. It is the client of robot-framework-lib,
+// which requests the service set by client.SetSigInfoBaseURL and client.SetCommunityName.
+type sigSource interface {
+	ListSigAllMember(org, repo string) (result []client.SigInfo, success bool)
+}
+
+// gitcodeClient implements iClient with the GitCode OpenAPI v5 at the base URL of the platform configuration,
+// the sigs are looked up with sigs
+type gitcodeClient struct {
+	baseURL string
+	token   []byte
+	cli     *http.Client
+	sigs    sigSource
+	log     *logrus.Entry
+	// cache is shared by the permission and sig lookups
+	cache *permissionCache
+}
+
+func newGitcodeClient(cnf *configuration, sigs sigSource, token []byte, logger *logrus.Entry) *gitcodeClient {
+	return &gitcodeClient{
+		baseURL: cnf.Platform.baseURL(),
+		token:   token,
+		cli:     &http.Client{Timeout: cnf.Platform.timeout()},
+		sigs:    sigs,
+		log:     logger,
+		cache:   newPermissionCache(&cnf.PermissionCache),
+	}
+}
+
+// do sends the request and decodes the response body into receiver, it returns the response of the request
+func (c *gitcodeClient) do(ctx context.Context, method, urlStr string, body, receiver interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "OpenSourceCommunityRobot/1.0.0")
+	req.Header.Set("Authorization", "Bearer "+string(c.token))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if receiver != nil && resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		err = json.NewDecoder(resp.Body).Decode(receiver)
+	} else {
+		_, _ = io.Copy(io.Discard, resp.Body)
+	}
+	return resp, err
+}
+
+// call sends the request to the OpenAPI, it returns the classified error if the response status
+// is not one of the expected
+func (c *gitcodeClient) call(ctx context.Context, method, path string, body, receiver interface{}, expected ...int) error {
+	op := method + " " + path
+	resp, err := c.do(ctx, method, c.baseURL+path, body, receiver)
+	if err != nil {
+		c.logger(ctx).WithError(err).Errorf("failed to request %s", op)
+		return newTransientError(op, err)
+	}
+
+	if !slices.Contains(expected, resp.StatusCode) {
+		err = newStatusError(op, resp.StatusCode, resp.Header)
+		c.logger(ctx).WithError(err).Errorf("failed to request %s", op)
+		return err
+	}
+	return nil
+}
+
+func (c *gitcodeClient) CreatePRComment(ctx context.Context, org, repo, number, comment string) error {
+	return c.call(ctx, http.MethodPost, fmt.Sprintf("repos/%s/%s/pulls/%s/comments", org, repo, number),
+		map[string]string{"body": comment}, nil, http.StatusOK, http.StatusCreated)
+}
+
+func (c *gitcodeClient) CreateIssueComment(ctx context.Context, org, repo, number, comment string) error {
+	return c.call(ctx, http.MethodPost, fmt.Sprintf("repos/%s/%s/issues/%s/comments", org, repo, number),
+		map[string]string{"body": comment}, nil, http.StatusOK, http.StatusCreated)
+}
+
+// logger returns the logger with the GUID of the event in ctx
+func (c *gitcodeClient) logger(ctx context.Context) *logrus.Entry {
+	if guid := eventGUIDFromContext(ctx); guid != "" {
+		return c.log.WithField(logFieldEventGUID, guid)
+	}
+	return c.log
+}
+
+// CheckPermission passes the admins of the repository, and the maintainers and committers of its sigs.
+// A failed lookup of the admin falls back to the sig, so only the error of the sig lookup is returned.
+// The results are cached, a denied permission is only cached when both lookups succeeded.
+func (c *gitcodeClient) CheckPermission(ctx context.Context, org, repo, username string) (pass bool, err error) {
+	key := permissionCacheKey(org, repo, username)
+	if v, ok := c.cache.get(key); ok {
+		return v.(bool), nil
+	}
+
+	member := struct {
+		Permission string `json:"permission"`
+	}{}
+	err = c.call(ctx, http.MethodGet, fmt.Sprintf("repos/%s/%s/collaborators/%s/permission", org, repo, username),
+		nil, &member, http.StatusOK)
+	if err == nil && member.Permission == permissionAdmin {
+		c.logger(ctx).Infof("[%s] is a %s/%s admin", username, org, repo)
+		c.cache.set(key, true, true)
+		return true, nil
+	}
+
+	pass, sigErr := c.checkSigPermission(ctx, org, repo, username)
+	if sigErr == nil && (pass || err == nil || errors.Is(err, errNotFound)) {
+		c.cache.set(key, pass, pass)
+	}
+	return pass, sigErr
+}
+
+// listSigs returns the sigs which the repository belongs to
+func (c *gitcodeClient) listSigs(ctx context.Context, org, repo string) ([]client.SigInfo, error) {
+	key := permissionCacheKey(org, repo, "")
+	if v, ok := c.cache.get(key); ok {
+		return v.([]client.SigInfo), nil
+	}
+
+	// The lookup of robot-framework-lib can't be canceled, so it isn't started after the deadline
+	op := "list the sigs of " + org + "/" + repo
+	if err := ctx.Err(); err != nil {
+		return nil, newTransientError(op, err)
+	}
+	sigs, ok := c.sigs.ListSigAllMember(org, repo)
+	if !ok {
+		err := newTransientError(op, errors.New("the sig information service failed"))
+		c.logger(ctx).WithError(err).Error("failed to " + op)
+		return nil, err
+	}
+
+	c.cache.set(key, sigs, true)
+	return sigs, nil
+}
+
+func (c *gitcodeClient) checkSigPermission(ctx context.Context, org, repo, username string) (pass bool, err error) {
+	sigs, err := c.listSigs(ctx, org, repo)
+	for i := range sigs {
+		if slices.Contains(sigs[i].Maintainers, username) || slices.Contains(sigs[i].Committers, username) {
+			c.logger(ctx).Infof("[%s] is a %s/%s maintainer or committer of %s", username, org, repo, sigs[i].SigName)
+			return true, err
+		}
+	}
+	return
+}
+
+// UpdateIssue changes the state of the issue, the state is opened or closed
+func (c *gitcodeClient) UpdateIssue(ctx context.Context, org, repo, number, state string) error {
+	switch state {
+	case "opened":
+		state = "reopen"
+	case "closed":
+		state = "close"
+	default:
+		return &apiError{kind: errUnexpected, op: "update the issue", err: errors.New("unknown state " + state)}
+	}
+
+	return c.call(ctx, http.MethodPatch, fmt.Sprintf("repos/%s/issues/%s", org, number),
+		map[string]string{"repo": repo, "state": state}, nil, http.StatusOK, http.StatusCreated)
+}
+
+func (c *gitcodeClient) UpdatePR(ctx context.Context, org, repo, number, state string) error {
+	switch state {
+	case "opened":
+		state = "open"
+	case "closed":
+	default:
+		return &apiError{kind: errUnexpected, op: "update the pull request", err: errors.New("unknown state " + state)}
+	}
+
+	return c.call(ctx, http.MethodPatch, fmt.Sprintf("repos/%s/%s/pulls/%s", org, repo, number),
+		map[string]string{"state": state}, nil, http.StatusOK, http.StatusCreated)
+}
+
+// GetIssueState returns the state of the issue in the states of the webhook, it is opened or closed
+func (c *gitcodeClient) GetIssueState(ctx context.Context, org, repo, number string) (string, error) {
+	return c.getState(ctx, fmt.Sprintf("repos/%s/%s/issues/%s", org, repo, number))
+}
+
+// GetPRState returns the state of the pull request in the states of the webhook, such as opened, closed or merged
+func (c *gitcodeClient) GetPRState(ctx context.Context, org, repo, number string) (string, error) {
+	return c.getState(ctx, fmt.Sprintf("repos/%s/%s/pulls/%s", org, repo, number))
+}
+
+func (c *gitcodeClient) getState(ctx context.Context, path string) (string, error) {
+	state, _, err := c.getItem(ctx, path)
+	return state, err
+}
+
+// getItem returns the state in the states of the webhook and the author of the issue or pull request
+func (c *gitcodeClient) getItem(ctx context.Context, path string) (state, author string, err error) {
+	item := struct {
+		State string `json:"state"`
+		User  struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}{}
+	if err = c.call(ctx, http.MethodGet, path, nil, &item, http.StatusOK); err != nil {
+		return "", "", err
+	}
+
+	// The OpenAPI names the state open, while the webhook names it opened
+	if item.State == "open" {
+		return "opened", item.User.Login, nil
+	}
+	return item.State, item.User.Login, nil
+}
+
+// GetItem returns the state and the author of the issue or the pull request, commentKind tells which it is
+func (c *gitcodeClient) GetItem(ctx context.Context, org, repo, commentKind, number string) (state, author string, err error) {
+	return c.getItem(ctx, fmt.Sprintf("repos/%s/%s/%s/%s", org, repo, itemPath(commentKind), number))
+}
+
+// ListComments lists a page of the comments on the issues or the pull requests of the repository,
+// which are created since the time. The comments are in the order they are created.
+func (c *gitcodeClient) ListComments(ctx context.Context, org, repo, commentKind string, since time.Time, page, perPage int) (
+	[]polledComment, error) {
+	query := url.Values{}
+	query.Set("since", since.UTC().Format(time.RFC3339))
+	query.Set("page", strconv.Itoa(page))
+	query.Set("per_page", strconv.Itoa(perPage))
+	query.Set("direction", "asc")
+
+	var items []struct {
+		ID        int64     `json:"id"`
+		Body      string    `json:"body"`
+		CreatedAt time.Time `json:"created_at"`
+		User      struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Target struct {
+			Issue struct {
+				Number flexibleNumber `json:"number"`
+			} `json:"issue"`
+			PullRequest struct {
+				Number flexibleNumber `json:"number"`
+			} `json:"pull_request"`
+		} `json:"target"`
+	}
+	err := c.call(ctx, http.MethodGet, fmt.Sprintf("repos/%s/%s/%s/comments?%s", org, repo, itemPath(commentKind),
+		query.Encode()), nil, &items, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	comments := make([]polledComment, 0, len(items))
+	for i := range items {
+		number := items[i].Target.Issue.Number
+		if commentKind != client.CommentOnIssue {
+			number = items[i].Target.PullRequest.Number
+		}
+		comments = append(comments, polledComment{
+			ID: items[i].ID, Number: string(number), Body: items[i].Body,
+			Commenter: items[i].User.Login, CreatedAt: items[i].CreatedAt,
+		})
+	}
+	return comments, nil
+}
+
+// ListClosedIssues lists a page of the closed issues of the repository, which are updated since the time.
+// The issues are in the order they are updated.
+func (c *gitcodeClient) ListClosedIssues(ctx context.Context, org, repo string, since time.Time, page, perPage int) (
+	[]closedIssue, error) {
+	query := url.Values{}
+	query.Set("state", "closed")
+	query.Set("since", since.UTC().Format(time.RFC3339))
+	query.Set("sort", "updated")
+	query.Set("direction", "asc")
+	query.Set("page", strconv.Itoa(page))
+	query.Set("per_page", strconv.Itoa(perPage))
+
+	var items []struct {
+		Number   flexibleNumber `json:"number"`
+		Title    string         `json:"title"`
+		ClosedAt time.Time      `json:"closed_at"`
+		User     struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}
+	err := c.call(ctx, http.MethodGet, fmt.Sprintf("repos/%s/%s/issues?%s", org, repo, query.Encode()),
+		nil, &items, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	issues := make([]closedIssue, 0, len(items))
+	for i := range items {
+		issues = append(issues, closedIssue{
+			Number: string(items[i].Number), Title: items[i].Title,
+			Author: items[i].User.Login, ClosedAt: items[i].ClosedAt,
+		})
+	}
+	return issues, nil
+}
+
+// ListOrgRepos lists a page of the repositories of the organization
+func (c *gitcodeClient) ListOrgRepos(ctx context.Context, org string, page, perPage int) ([]string, error) {
+	var items []struct {
+		Path string `json:"path"`
+	}
+	err := c.call(ctx, http.MethodGet, fmt.Sprintf("orgs/%s/repos?page=%d&per_page=%d", org, page, perPage),
+		nil, &items, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]string, 0, len(items))
+	for i := range items {
+		repos = append(repos, items[i].Path)
+	}
+	return repos, nil
+}
+
+func itemPath(commentKind string) string {
+	if commentKind == client.CommentOnIssue {
+		return "issues"
+	}
+	return "pulls"
+}
+
+// flexibleNumber is the number of an issue or pull request, which is a string or a number in the JSON
+type flexibleNumber string
+
+func (n *flexibleNumber) UnmarshalJSON(data []byte) error {
+	*n = flexibleNumber(strings.Trim(string(data), `"`))
+	if *n == "null" {
+		*n = ""
+	}
+	return nil
+}
+
+func (c *gitcodeClient) GetIssueLinkedPRNumber(ctx context.Context, org, repo, number string) (int, error) {
+	var list []json.RawMessage
+	err := c.call(ctx, http.MethodGet, fmt.Sprintf("repos/%s/%s/issues/%s/pull_requests", org, repo, number),
+		nil, &list, http.StatusOK)
+	return len(list), err
+}
@@ -5,14 +5,18 @@ go 1.21
 require (
 	github.com/opensourceways/robot-framework-lib v0.2.1
 	github.com/opensourceways/server-common-lib v1.0.0
+	github.com/segmentio/kafka-go v0.4.47
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.9.0
+	go.etcd.io/bbolt v1.3.9
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/go-resty/resty/v2 v2.11.0 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
 	github.com/opensourceways/go-gitcode v0.2.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.2 // indirect
 	golang.org/x/net v0.23.0 // indirect
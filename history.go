@@ -0,0 +1,166 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const historyPath = "/history/"
+
+var bucketHistory = []byte("history")
+
+// historyEntry is a close or reopen transition applied by the robot
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason"`
+	EventGUID string    `json:"event_guid"`
+}
+
+// lifecycleHistory records the transitions of every issue and pull request
+type lifecycleHistory struct {
+	s *store
+}
+
+func newLifecycleHistory(s *store) (*lifecycleHistory, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketHistory)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &lifecycleHistory{s: s}, nil
+}
+
+func historyKey(org, repo, number string) []byte {
+	return []byte(org + "/" + repo + "/" + number)
+}
+
+// add appends an entry to the history of the issue or pull request
+func (h *lifecycleHistory) add(org, repo, number string, entry *historyEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return h.s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(bucketHistory).CreateBucketIfNotExists(historyKey(org, repo, number))
+		if err != nil {
+			return err
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(seq), data)
+	})
+}
+
+// list returns the history of the issue or pull request, the oldest entry comes first
+func (h *lifecycleHistory) list(org, repo, number string) (entries []historyEntry, err error) {
+	err = h.s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketHistory).Bucket(historyKey(org, repo, number))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			entry := historyEntry{}
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return
+}
+
+type historyResponse struct {
+	Entries      []historyEntry `json:"entries"`
+	LastClosedBy string         `json:"last_closed_by"`
+	ReopenTimes  int            `json:"reopen_times"`
+}
+
+// ServeHTTP serves GET /history/{org}/{repo}/{number}
+func (h *lifecycleHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, historyPath), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	entries, err := h.list(parts[0], parts[1], parts[2])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := historyResponse{Entries: entries}
+	for i := range entries {
+		switch entries[i].Action {
+		case actionClose:
+			resp.LastClosedBy = entries[i].Actor
+		case actionReopen:
+			resp.ReopenTimes++
+		}
+	}
+	if resp.Entries == nil {
+		resp.Entries = []historyEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+func newHistoryEntry(rec *auditRecord) *historyEntry {
+	reason := "/" + rec.Action + " command by the " + rec.Role
+	if rec.Policy == policyClosedWithoutLinkPR {
+		reason = "reopened by the close guard, it was closed without a linked pull request"
+	}
+	return &historyEntry{
+		Time:      rec.Time,
+		Action:    rec.Action,
+		Actor:     rec.Actor,
+		Reason:    reason,
+		EventGUID: rec.EventGUID,
+	}
+}
+
+// recordHistory adds the transition to the history once the platform applied it, failures are only logged.
+// The queued transition is recorded by the action queue when it is delivered.
+func (bot *robot) recordHistory(org, repo, number string, rec *auditRecord) {
+	if bot.history == nil || rec.Outcome != outcomeSuccess {
+		return
+	}
+
+	err := bot.history.add(org, repo, number, newHistoryEntry(rec))
+	if err != nil && bot.log != nil {
+		bot.log.WithError(err).Error("failed to record the history of " + rec.Target)
+	}
+}
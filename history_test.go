@@ -0,0 +1,150 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *store {
+	st, err := openStore(filepath.Join(t.TempDir(), "robot.db"))
+	assert.Equal(t, nil, err)
+	t.Cleanup(func() {
+		_ = st.close()
+	})
+	return st
+}
+
+func TestLifecycleHistory(t *testing.T) {
+	h, err := newLifecycleHistory(newTestStore(t))
+	assert.Equal(t, nil, err)
+
+	entries, err := h.list(org, repo, number)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(entries))
+
+	for _, e := range []historyEntry{
+		{Action: actionClose, Actor: "user1"},
+		{Action: actionReopen, Actor: "user2"},
+		{Action: actionClose, Actor: "user3"},
+		{Action: actionReopen, Actor: "user1"},
+	} {
+		assert.Equal(t, nil, h.add(org, repo, number, &e))
+	}
+	assert.Equal(t, nil, h.add(org, repo, "2", &historyEntry{Action: actionClose, Actor: "user4"}))
+
+	entries, err = h.list(org, repo, number)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(entries))
+	assert.Equal(t, "user2", entries[1].Actor)
+
+	testCases := []struct {
+		desc   string
+		method string
+		path   string
+		status int
+		out    historyResponse
+	}{
+		{
+			"query the history",
+			http.MethodGet,
+			"/history/org1/repo1/1",
+			http.StatusOK,
+			historyResponse{LastClosedBy: "user3", ReopenTimes: 2},
+		},
+		{
+			"no history",
+			http.MethodGet,
+			"/history/org1/repo1/3",
+			http.StatusOK,
+			historyResponse{Entries: []historyEntry{}},
+		},
+		{
+			"the number is missing",
+			http.MethodGet,
+			"/history/org1/repo1",
+			http.StatusBadRequest,
+			historyResponse{},
+		},
+		{
+			"unsupported method",
+			http.MethodPost,
+			"/history/org1/repo1/1",
+			http.StatusMethodNotAllowed,
+			historyResponse{},
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(testCases[i].method, testCases[i].path, nil))
+			assert.Equal(t, testCases[i].status, w.Code)
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			got := historyResponse{}
+			assert.Equal(t, nil, json.Unmarshal(w.Body.Bytes(), &got))
+			assert.Equal(t, testCases[i].out.LastClosedBy, got.LastClosedBy)
+			assert.Equal(t, testCases[i].out.ReopenTimes, got.ReopenTimes)
+			if testCases[i].out.Entries != nil {
+				assert.Equal(t, testCases[i].out.Entries, got.Entries)
+			}
+		})
+	}
+}
+
+func TestHandleEventRecordsHistory(t *testing.T) {
+	h, err := newLifecycleHistory(newTestStore(t))
+	assert.Equal(t, nil, err)
+
+	mc := &mockClient{successfulUpdateIssue: true}
+	bot := &robot{cli: mc, cnf: &configuration{
+		EventStateOpened: "opened",
+		EventStateClosed: "closed",
+	}, history: h}
+
+	event := new(client.GenericEvent)
+	data, _ := os.ReadFile(findTestdata(t, "note_event.json"))
+	assert.Equal(t, nil, json.Unmarshal(data, event))
+	*event.CommentKind = client.CommentOnIssue
+	author := commenter
+	event.Author = &author
+
+	*event.Comment = comment
+	bot.handleCloseEvent(context.Background(), event, &repoConfig{}, org, repo, number)
+	*event.Comment = comment1
+	*event.State = "closed"
+	bot.handleReopenEvent(context.Background(), event, org, repo, number)
+	// a failed update is not a transition
+	mc.successfulUpdateIssue = false
+	bot.handleReopenEvent(context.Background(), event, org, repo, number)
+
+	entries, err := h.list(org, repo, number)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, actionClose, entries[0].Action)
+	assert.Equal(t, actionReopen, entries[1].Action)
+	assert.Equal(t, commenter, entries[1].Actor)
+	assert.Equal(t, "/reopen command by the author", entries[1].Reason)
+	assert.Equal(t, "01641beb-95e8-415b-9032-c6eeca3f47ce", entries[1].EventGUID)
+}
@@ -0,0 +1,425 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerOpenInterval     = 30
+)
+
+// clientMetrics counts the requests held back on the client side, they are throttled by the rate limit
+// or rejected by the open circuit, and the times the circuits opened
+var clientMetrics = expvar.NewMap("lifecycle_platform_client")
+
+// rateLimit is the rate of a token bucket
+type rateLimit struct {
+	// RequestsPerMinute is the rate of the requests, they are unlimited if it is 0.
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	// Burst is the number of requests which can be sent at once, it is 1 by default.
+	Burst int `json:"burst,omitempty"`
+}
+
+func (l *rateLimit) validate() error {
+	if l.RequestsPerMinute < 0 || l.Burst < 0 {
+		return errors.New("the rate_limit requests_per_minute and burst can not be negative")
+	}
+	return nil
+}
+
+// rateLimitConfig limits the requests to the platform on the client side
+type rateLimitConfig struct {
+	// rateLimit limits all the requests sent with the token of the robot
+	rateLimit
+	// Methods limits the requests of a method of the client, such as CheckPermission, in addition to the token
+	Methods map[string]rateLimit `json:"methods,omitempty"`
+}
+
+func (c *rateLimitConfig) validate() error {
+	if err := c.rateLimit.validate(); err != nil {
+		return err
+	}
+
+	t := reflect.TypeOf((*platformClient)(nil)).Elem()
+	for name, l := range c.Methods {
+		if _, ok := t.MethodByName(name); !ok {
+			return errors.New("unknown method in the rate_limit methods: " + name)
+		}
+		if err := l.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// circuitBreakerConfig configures the circuit breaker of every method of the client
+type circuitBreakerConfig struct {
+	// FailureThreshold is the number of the consecutive failures which open the circuit, it is 5 by default.
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+	// OpenInterval is how long in seconds the requests fail fast before one is tried again, it is 30 by default.
+	OpenInterval int `json:"open_interval,omitempty"`
+}
+
+func (c *circuitBreakerConfig) validate() error {
+	if c.FailureThreshold < 0 || c.OpenInterval < 0 {
+		return errors.New("the circuit_breaker failure_threshold and open_interval can not be negative")
+	}
+	return nil
+}
+
+// tokenBucket allows the requests at a rate with bursts
+type tokenBucket struct {
+	mu sync.Mutex
+	// rate is the tokens added per second, the requests are unlimited if it is 0
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// pausedUntil is when the rate limit of the platform is reset
+	pausedUntil time.Time
+}
+
+func newTokenBucket(l rateLimit) *tokenBucket {
+	b := &tokenBucket{rate: float64(l.RequestsPerMinute) / 60, burst: float64(l.Burst)}
+	if b.burst == 0 {
+		b.burst = 1
+	}
+	b.tokens = b.burst
+	return b
+}
+
+// reserve takes a token, and returns how long to wait before the request is sent
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var d time.Duration
+	if b.pausedUntil.After(now) {
+		d = b.pausedUntil.Sub(now)
+	}
+	if b.rate == 0 {
+		return d
+	}
+
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens < 0 {
+		d = max(d, time.Duration(-b.tokens/b.rate*float64(time.Second)))
+	}
+	return d
+}
+
+// cancel gives back the token of a request which is not sent
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate != 0 {
+		b.tokens = min(b.burst, b.tokens+1)
+	}
+}
+
+// pause holds the requests back until the rate limit of the platform is reset
+func (b *tokenBucket) pause(until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker fails the requests fast after the consecutive failures, until one request is tried
+// again after the open interval. The circuit closes if it succeeds, or opens again if it fails.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	interval  time.Duration
+	state     circuitState
+	failures  int
+	openedAt  time.Time
+	// probing is set while the request in the half-open state is being sent
+	probing bool
+}
+
+func newCircuitBreaker(c *circuitBreakerConfig) *circuitBreaker {
+	b := &circuitBreaker{
+		threshold: c.FailureThreshold,
+		interval:  time.Duration(c.OpenInterval) * time.Second,
+	}
+	if b.threshold == 0 {
+		b.threshold = defaultBreakerFailureThreshold
+	}
+	if b.interval == 0 {
+		b.interval = defaultBreakerOpenInterval * time.Second
+	}
+	return b
+}
+
+// allow reports if the request can be sent, otherwise it returns when the circuit is half-open
+func (b *circuitBreaker) allow(now time.Time) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		retryAt := b.openedAt.Add(b.interval)
+		if now.Before(retryAt) {
+			return retryAt, false
+		}
+		b.state, b.probing = circuitHalfOpen, true
+	case circuitHalfOpen:
+		if b.probing {
+			return now.Add(b.interval), false
+		}
+		b.probing = true
+	}
+	return time.Time{}, true
+}
+
+// done records the result of an allowed request
+func (b *circuitBreaker) done(now time.Time, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.state, b.failures = circuitClosed, 0
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.state, b.openedAt = circuitOpen, now
+		clientMetrics.Add("circuit_opened", 1)
+	}
+}
+
+// abort releases an allowed request which got no result, for example it was canceled
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// limitedClient limits the requests of the client with the rate limits and the circuit breakers.
+// The client holds one token, so the token bucket of the client is the limit of the token.
+type limitedClient struct {
+	cli      platformClient
+	token    *tokenBucket
+	methods  map[string]*tokenBucket
+	breakers map[string]*circuitBreaker
+	now      func() time.Time
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+func newLimitedClient(cli platformClient, rc *rateLimitConfig, bc *circuitBreakerConfig) *limitedClient {
+	c := &limitedClient{
+		cli:      cli,
+		token:    newTokenBucket(rc.rateLimit),
+		methods:  map[string]*tokenBucket{},
+		breakers: map[string]*circuitBreaker{},
+		now:      time.Now,
+		sleep:    sleepContext,
+	}
+
+	t := reflect.TypeOf((*platformClient)(nil)).Elem()
+	for i := 0; i < t.NumMethod(); i++ {
+		c.breakers[t.Method(i).Name] = newCircuitBreaker(bc)
+	}
+	for name, l := range rc.Methods {
+		if l.RequestsPerMinute > 0 {
+			c.methods[name] = newTokenBucket(l)
+		}
+	}
+	return c
+}
+
+// call sends the request by fn when the circuit of the method is not open and the rate limits allow it
+func (c *limitedClient) call(ctx context.Context, method string, fn func() error) error {
+	b := c.breakers[method]
+	if retryAt, ok := b.allow(c.now()); !ok {
+		clientMetrics.Add("rejected", 1)
+		return &apiError{kind: errCircuitOpen, op: method, resetAt: retryAt}
+	}
+
+	if err := c.wait(ctx, method); err != nil {
+		b.abort()
+		return err
+	}
+
+	err := fn()
+	if resetAt, ok := rateLimitReset(err); ok {
+		c.token.pause(resetAt)
+	}
+	if err != nil && ctx.Err() != nil {
+		b.abort()
+		return err
+	}
+	b.done(c.now(), isRetryable(err))
+	return err
+}
+
+// wait waits for the rate limits of the token and the method. The request fails as a rate limited one
+// at once if it can't be sent before the deadline of ctx.
+func (c *limitedClient) wait(ctx context.Context, method string) error {
+	now := c.now()
+	d := c.token.reserve(now)
+	m := c.methods[method]
+	if m != nil {
+		d = max(d, m.reserve(now))
+	}
+	if d <= 0 {
+		return nil
+	}
+
+	clientMetrics.Add("throttled", 1)
+	err := newThrottledError(method, now.Add(d))
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Before(now.Add(d)) {
+		if err = c.sleep(ctx, d); err == nil {
+			return nil
+		}
+		err = newTransientError(method, err)
+	}
+
+	c.token.cancel()
+	if m != nil {
+		m.cancel()
+	}
+	return err
+}
+
+func newThrottledError(op string, resetAt time.Time) error {
+	return &apiError{kind: errRateLimited, op: op, resetAt: resetAt, err: errors.New("throttled on the client side")}
+}
+
+func (c *limitedClient) CreatePRComment(ctx context.Context, org, repo, number, comment string) error {
+	return c.call(ctx, "CreatePRComment", func() error {
+		return c.cli.CreatePRComment(ctx, org, repo, number, comment)
+	})
+}
+
+func (c *limitedClient) CreateIssueComment(ctx context.Context, org, repo, number, comment string) error {
+	return c.call(ctx, "CreateIssueComment", func() error {
+		return c.cli.CreateIssueComment(ctx, org, repo, number, comment)
+	})
+}
+
+func (c *limitedClient) CheckPermission(ctx context.Context, org, repo, username string) (pass bool, err error) {
+	err = c.call(ctx, "CheckPermission", func() (err error) {
+		pass, err = c.cli.CheckPermission(ctx, org, repo, username)
+		return
+	})
+	return
+}
+
+func (c *limitedClient) UpdateIssue(ctx context.Context, org, repo, number, state string) error {
+	return c.call(ctx, "UpdateIssue", func() error {
+		return c.cli.UpdateIssue(ctx, org, repo, number, state)
+	})
+}
+
+func (c *limitedClient) UpdatePR(ctx context.Context, org, repo, number, state string) error {
+	return c.call(ctx, "UpdatePR", func() error {
+		return c.cli.UpdatePR(ctx, org, repo, number, state)
+	})
+}
+
+func (c *limitedClient) GetIssueState(ctx context.Context, org, repo, number string) (state string, err error) {
+	err = c.call(ctx, "GetIssueState", func() (err error) {
+		state, err = c.cli.GetIssueState(ctx, org, repo, number)
+		return
+	})
+	return
+}
+
+func (c *limitedClient) GetPRState(ctx context.Context, org, repo, number string) (state string, err error) {
+	err = c.call(ctx, "GetPRState", func() (err error) {
+		state, err = c.cli.GetPRState(ctx, org, repo, number)
+		return
+	})
+	return
+}
+
+func (c *limitedClient) GetIssueLinkedPRNumber(ctx context.Context, org, repo, number string) (num int, err error) {
+	err = c.call(ctx, "GetIssueLinkedPRNumber", func() (err error) {
+		num, err = c.cli.GetIssueLinkedPRNumber(ctx, org, repo, number)
+		return
+	})
+	return
+}
+
+func (c *limitedClient) ListComments(ctx context.Context, org, repo, commentKind string, since time.Time, page,
+	perPage int) (comments []polledComment, err error) {
+	err = c.call(ctx, "ListComments", func() (err error) {
+		comments, err = c.cli.ListComments(ctx, org, repo, commentKind, since, page, perPage)
+		return
+	})
+	return
+}
+
+func (c *limitedClient) GetItem(ctx context.Context, org, repo, commentKind, number string) (
+	state, author string, err error) {
+	err = c.call(ctx, "GetItem", func() (err error) {
+		state, author, err = c.cli.GetItem(ctx, org, repo, commentKind, number)
+		return
+	})
+	return
+}
+
+func (c *limitedClient) ListClosedIssues(ctx context.Context, org, repo string, since time.Time, page, perPage int) (
+	issues []closedIssue, err error) {
+	err = c.call(ctx, "ListClosedIssues", func() (err error) {
+		issues, err = c.cli.ListClosedIssues(ctx, org, repo, since, page, perPage)
+		return
+	})
+	return
+}
+
+func (c *limitedClient) ListOrgRepos(ctx context.Context, org string, page, perPage int) (repos []string, err error) {
+	err = c.call(ctx, "ListOrgRepos", func() (err error) {
+		repos, err = c.cli.ListOrgRepos(ctx, org, page, perPage)
+		return
+	})
+	return
+}
+
+func (c *limitedClient) listSigs(ctx context.Context, org, repo string) (sigs []client.SigInfo, err error) {
+	err = c.call(ctx, "listSigs", func() (err error) {
+		sigs, err = c.cli.listSigs(ctx, org, repo)
+		return
+	})
+	return
+}
@@ -0,0 +1,192 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	b := newTokenBucket(rateLimit{RequestsPerMinute: 60, Burst: 2})
+
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.Equal(t, time.Second, b.reserve(now))
+	b.cancel()
+
+	// a token is added every second
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.Equal(t, time.Second, b.reserve(now))
+
+	// the requests wait for the rate limit of the platform to be reset
+	now = now.Add(10 * time.Second)
+	b.pause(now.Add(5 * time.Second))
+	assert.Equal(t, 5*time.Second, b.reserve(now))
+
+	unlimited := newTokenBucket(rateLimit{})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, time.Duration(0), unlimited.reserve(now))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(&circuitBreakerConfig{FailureThreshold: 2, OpenInterval: 30})
+
+	_, ok := b.allow(now)
+	assert.Equal(t, true, ok)
+	b.done(now, true)
+	_, ok = b.allow(now)
+	assert.Equal(t, true, ok)
+	b.done(now, true)
+
+	// the requests fail fast until the open interval passes
+	retryAt, ok := b.allow(now.Add(time.Second))
+	assert.Equal(t, false, ok)
+	assert.Equal(t, now.Add(30*time.Second), retryAt)
+
+	// only one request is tried in the half-open state, and its failure opens the circuit again
+	now = now.Add(30 * time.Second)
+	_, ok = b.allow(now)
+	assert.Equal(t, true, ok)
+	_, ok = b.allow(now)
+	assert.Equal(t, false, ok)
+	b.done(now, true)
+	_, ok = b.allow(now.Add(time.Second))
+	assert.Equal(t, false, ok)
+
+	// the circuit closes when the request in the half-open state succeeds
+	now = now.Add(30 * time.Second)
+	_, ok = b.allow(now)
+	assert.Equal(t, true, ok)
+	b.done(now, false)
+	_, ok = b.allow(now)
+	assert.Equal(t, true, ok)
+	_, ok = b.allow(now)
+	assert.Equal(t, true, ok)
+}
+
+// limitedTestClient serves the requests of the limited client with the mock client and the fake lister
+type limitedTestClient struct {
+	*mockClient
+	*fakeLister
+	issueLister
+	sigLister
+}
+
+func TestLimitedClient(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	mc := &mockClient{}
+	c := newLimitedClient(limitedTestClient{mockClient: mc}, &rateLimitConfig{
+		Methods: map[string]rateLimit{"GetIssueLinkedPRNumber": {RequestsPerMinute: 6}},
+	}, &circuitBreakerConfig{FailureThreshold: 2})
+	c.now = func() time.Time { return now }
+	var slept []time.Duration
+	c.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	// the circuit of the method opens after the failures
+	for i := 0; i < 2; i++ {
+		_, err := c.CheckPermission(context.Background(), org, repo, commenter)
+		assert.Equal(t, true, errors.Is(err, errTransient))
+	}
+	mc.method = ""
+	_, err := c.CheckPermission(context.Background(), org, repo, commenter)
+	assert.Equal(t, true, errors.Is(err, errCircuitOpen))
+	assert.Equal(t, "", mc.method)
+	at, _ := retryAt(err)
+	assert.Equal(t, now.Add(defaultBreakerOpenInterval*time.Second), at)
+
+	// the other methods are not affected
+	mc.successfulCreateIssueComment = true
+	assert.Equal(t, nil, c.CreateIssueComment(context.Background(), org, repo, number, "try later"))
+
+	// the method waits for its own rate limit
+	mc.successfulGetIssueLinkedPRNumber = true
+	_, _ = c.GetIssueLinkedPRNumber(context.Background(), org, repo, number)
+	_, _ = c.GetIssueLinkedPRNumber(context.Background(), org, repo, number)
+	assert.Equal(t, []time.Duration{10 * time.Second}, slept)
+
+	// the request fails at once if the rate limit is reset after the deadline
+	mc.failure = &apiError{kind: errRateLimited, op: "UpdateIssue", status: http.StatusTooManyRequests,
+		resetAt: now.Add(time.Minute)}
+	assert.Equal(t, true, errors.Is(c.UpdateIssue(context.Background(), org, repo, number, "closed"), errRateLimited))
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(10*time.Second))
+	defer cancel()
+	mc.method = ""
+	assert.Equal(t, true, errors.Is(c.UpdatePR(ctx, org, repo, number, "closed"), errRateLimited))
+	assert.Equal(t, "", mc.method)
+}
+
+func TestLimitedClientListing(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	mc := &mockClient{}
+	lister := &fakeLister{comments: map[string][]polledComment{}}
+	c := newLimitedClient(limitedTestClient{mockClient: mc, fakeLister: lister}, &rateLimitConfig{
+		Methods: map[string]rateLimit{"ListComments": {RequestsPerMinute: 6}},
+	}, &circuitBreakerConfig{FailureThreshold: 1})
+	c.now = func() time.Time { return now }
+	var slept []time.Duration
+	c.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	// the listing waits for its own rate limit like the other requests
+	_, _ = c.ListComments(context.Background(), org, repo, client.CommentOnIssue, now, 1, 10)
+	_, _ = c.ListComments(context.Background(), org, repo, client.CommentOnIssue, now, 1, 10)
+	assert.Equal(t, []time.Duration{10 * time.Second}, slept)
+	assert.Equal(t, 2, lister.pages)
+
+	// the rate limit of the token pauses the listing too
+	mc.failure = &apiError{kind: errRateLimited, op: "UpdateIssue", status: http.StatusTooManyRequests,
+		resetAt: now.Add(time.Minute)}
+	_ = c.UpdateIssue(context.Background(), org, repo, number, "closed")
+	slept = nil
+	_, _, err := c.GetItem(context.Background(), org, repo, client.CommentOnIssue, number)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []time.Duration{time.Minute}, slept)
+}
+
+func TestPlanPlatformUnavailable(t *testing.T) {
+	mc := &mockClient{}
+	bot := &robot{cli: newLimitedClient(limitedTestClient{mockClient: mc}, &rateLimitConfig{},
+		&circuitBreakerConfig{FailureThreshold: 1}),
+		cnf: &configuration{EventStateOpened: "opened", EventStateClosed: "closed"}}
+
+	// the failed lookup opens the circuit, and the next command fails fast
+	event := newCloseEvent("guid")
+	plan := bot.planClose(context.Background(), event, &repoConfig{}, org, repo, number)
+	assert.Equal(t, policyPermissionCheckFailed, plan.Policy)
+
+	mc.method = ""
+	plan = bot.planClose(context.Background(), event, &repoConfig{}, org, repo, number)
+	assert.Equal(t, "", mc.method)
+	assert.Equal(t, policyPlatformUnavailable, plan.Policy)
+	assert.Equal(t, []plannedAction{commentAction(templatePlatformUnavailable, map[string]string{
+		placeholderCommenter: "maintainer1",
+		placeholderAction:    actionClose,
+	})}, plan.Actions)
+	assert.Equal(t, client.CommentOnIssue, plan.CommentKind)
+}
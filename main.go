@@ -14,15 +14,56 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/opensourceways/robot-framework-lib/framework"
+	"github.com/opensourceways/server-common-lib/interrupts"
+	"github.com/sirupsen/logrus"
+	"net/http"
 	"os"
+	"time"
 )
 
 const component = "robot-universal-lifecycle"
 
+// startConsumer consumes the events from Kafka until the process is interrupted
+func startConsumer(bot *robot, opt *robotOptions) {
+	brokers := splitList(opt.kafkaBrokers)
+	source := newKafkaSource(brokers, splitList(opt.kafkaTopics), opt.kafkaGroup)
+	var poison eventPublisher
+	if opt.kafkaPoisonTopic != "" {
+		poison = newKafkaPublisher(brokers)
+	}
+
+	consumer := newEventConsumer(bot, source, poison, opt.kafkaPoisonTopic)
+	interrupts.Run(func(ctx context.Context) {
+		consumer.run(ctx)
+		if err := source.close(); err != nil {
+			logrus.WithError(err).Error("failed to close the consumer")
+		}
+		if poison != nil {
+			_ = poison.close()
+		}
+	})
+}
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == replayCommand {
+		if err := runReplay(os.Args[2:], os.Stdout); err != nil {
+			logrus.WithError(err).Error("failed to replay the events")
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == policyAuditCommand {
+		if err := runPolicyAudit(os.Args[2:], os.Stdout); err != nil {
+			logrus.WithError(err).Error("failed to audit the closed issues")
+			os.Exit(1)
+		}
+		return
+	}
+
 	opt := new(robotOptions)
 	// Gather the necessary arguments from command line for project startup
 	cnf, token := opt.gatherOptions(flag.NewFlagSet(os.Args[0], flag.ExitOnError), os.Args[1:]...)
@@ -30,6 +71,66 @@ func main() {
 		return
 	}
 
-	bot := newRobot(cnf, token)
-	framework.StartupServer(framework.NewServer(bot, opt.service), opt.service)
+	var st *store
+	if opt.storePath != "" {
+		var err error
+		if st, err = openStore(opt.storePath); err != nil {
+			logrus.WithError(err).Error("fatal error occurred while opening the store")
+			return
+		}
+		defer st.close()
+	}
+
+	bot, err := newRobot(cnf, token, opt, st)
+	if err != nil {
+		logrus.WithError(err).Error("fatal error occurred while creating the robot")
+		return
+	}
+	// The commands missed while the robot was down are found before any event is handled,
+	// because handling an event moves the last processed time to now
+	var since time.Time
+	if opt.backfillSince != "" {
+		since, _ = parseBackfillSince(opt.backfillSince, time.Now())
+	}
+	since = bot.backfillSince(since)
+
+	// Drains the lifecycle events on the graceful shutdown, and resumes the ones left by the previous instance
+	interrupts.OnInterrupt(func() {
+		if err := bot.shutdown(opt.shutdownTimeout); err != nil {
+			logrus.WithError(err).Error("failed to record the unfinished events")
+		}
+		bot.closeAudit()
+	})
+	go func() {
+		if err := bot.resumeUnfinishedEvents(); err != nil {
+			logrus.WithError(err).Error("failed to resume the unfinished events")
+		}
+	}()
+
+	server := framework.NewServer(bot, opt.service)
+	if bot.actions != nil {
+		go bot.runActionQueue()
+	}
+	if bot.poller != nil {
+		go bot.runPoller()
+	}
+	// Replays the commands missed while the robot was down
+	go bot.runBackfill(since)
+	// The history shows who closed and reopened the issues, so it is served with the admin endpoints
+	if opt.adminToken != nil {
+		if bot.history != nil {
+			http.Handle(historyPath, requireAdminToken(opt.adminToken, bot.history))
+		}
+		if bot.actions != nil {
+			http.Handle(deadLettersPath, requireAdminToken(opt.adminToken, bot.actions))
+		}
+		if bot.permissions != nil {
+			http.Handle(permissionsPath, requireAdminToken(opt.adminToken, bot.permissions))
+		}
+		http.Handle(issuesPath, requireAdminToken(opt.adminToken, http.HandlerFunc(bot.serveIssueCommand)))
+	}
+	if opt.kafkaBrokers != "" {
+		startConsumer(bot, opt)
+	}
+	framework.StartupServer(server, opt.service)
 }
@@ -0,0 +1,284 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/opensourceways/server-common-lib/secret"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	cloudEventSpecVersion    = "1.0"
+	cloudEventContentType    = "application/cloudevents+json"
+	cloudEventTypeTransition = "org.opensourceways.robot.lifecycle.transition"
+	cloudEventTypeDenial     = "org.opensourceways.robot.lifecycle.denial"
+
+	// headerSignature carries the HMAC-SHA256 of the request body in the form of sha256=<hex>
+	headerSignature = "X-Lifecycle-Signature"
+
+	defaultSinkTimeout = 5
+)
+
+// sinkConfig is an HTTP endpoint which receives the lifecycle events in the CloudEvents format
+type sinkConfig struct {
+	// URL is the endpoint which the events are posted to.
+	URL string `json:"url"`
+	// SecretFile is the file containing the secret of the HMAC signature, the events are not signed if it is empty.
+	SecretFile string `json:"secret_file,omitempty"`
+	// Timeout is the request timeout in seconds, it is 5 by default.
+	Timeout int `json:"timeout,omitempty"`
+
+	// secret is loaded from the SecretFile once the configuration is validated
+	secret []byte
+}
+
+// validate checks the sink and loads its secret
+func (c *sinkConfig) validate() error {
+	if u, err := url.Parse(c.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New("invalid sink url: " + c.URL)
+	}
+	if c.Timeout < 0 {
+		return errors.New("the sink timeout can not be negative")
+	}
+
+	if c.SecretFile != "" {
+		key, err := secret.LoadSingleSecret(c.SecretFile)
+		if err != nil || len(key) == 0 {
+			return errors.New("failed to load the secret of the sink " + c.URL)
+		}
+		c.secret = key
+	}
+	return nil
+}
+
+// publishers tracks the lifecycle events being published, the shutdown waits for them
+type publishers struct {
+	mu      sync.Mutex
+	closed  bool
+	running sync.WaitGroup
+}
+
+// start reports false once the publishers are closed, the event is not published then
+func (p *publishers) start() bool {
+	if p == nil {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+	p.running.Add(1)
+	return true
+}
+
+func (p *publishers) done() {
+	if p != nil {
+		p.running.Done()
+	}
+}
+
+// close stops starting the publishers, and waits for the running ones until ctx is done.
+// It reports if none of them is left.
+func (p *publishers) close(ctx context.Context) bool {
+	if p == nil {
+		return true
+	}
+
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		p.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// lifecycleEventData is the data of the lifecycle events
+type lifecycleEventData struct {
+	Actor      string `json:"actor"`
+	Author     string `json:"author"`
+	Target     string `json:"target"`
+	TargetKind string `json:"target_kind"`
+	Action     string `json:"action"`
+	Reason     string `json:"reason"`
+	Role       string `json:"role"`
+	Policy     string `json:"policy"`
+	Outcome    string `json:"outcome"`
+	EventGUID  string `json:"event_guid"`
+}
+
+// cloudEvent is a lifecycle event in the structured mode of CloudEvents 1.0
+type cloudEvent struct {
+	SpecVersion     string             `json:"specversion"`
+	ID              string             `json:"id"`
+	Source          string             `json:"source"`
+	Type            string             `json:"type"`
+	Subject         string             `json:"subject"`
+	Time            time.Time          `json:"time"`
+	DataContentType string             `json:"datacontenttype"`
+	Data            lifecycleEventData `json:"data"`
+}
+
+// newCloudEvent returns the event of a successful transition or a denied command,
+// ok is false if the decision is neither of them
+func newCloudEvent(org, repo string, rec *auditRecord) (evt *cloudEvent, ok bool) {
+	var typ, reason string
+	switch {
+	case rec.Outcome == outcomeSuccess:
+		typ, reason = cloudEventTypeTransition, newHistoryEntry(rec).Reason
+	case rec.Policy == policyNoPermission || rec.Policy == policyNeedsLinkPR:
+		typ, reason = cloudEventTypeDenial, "/"+rec.Action+" command denied by the policy "+rec.Policy
+	default:
+		return nil, false
+	}
+
+	return &cloudEvent{
+		SpecVersion:     cloudEventSpecVersion,
+		ID:              randomID(),
+		Source:          component + "/" + org + "/" + repo,
+		Type:            typ,
+		Subject:         rec.Target,
+		Time:            rec.Time,
+		DataContentType: "application/json",
+		Data: lifecycleEventData{
+			Actor: rec.Actor, Author: rec.Author, Target: rec.Target, TargetKind: rec.TargetKind,
+			Action: rec.Action, Reason: reason, Role: rec.Role, Policy: rec.Policy, Outcome: rec.Outcome,
+			EventGUID: rec.EventGUID,
+		},
+	}, true
+}
+
+// randomID returns 16 random bytes in hex
+func randomID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// signPayload returns the HMAC-SHA256 signature of the body
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify publishes the decision to the sinks of the repository and the chat channels in the background.
+// Nothing is published in the shadow mode, because nothing is changed.
+func (bot *robot) notify(org, repo string, rec *auditRecord) {
+	if bot.shadow || bot.cnf == nil {
+		return
+	}
+
+	bot.publishEvents(org, repo, rec)
+	bot.notifyChat(org, repo, rec)
+}
+
+// publishEvents publishes the transition or the denied command to the sinks of the repository
+func (bot *robot) publishEvents(org, repo string, rec *auditRecord) {
+	repoCnf := bot.cnf.getRepoConfig(org, repo)
+	if repoCnf == nil || len(repoCnf.Sinks) == 0 {
+		return
+	}
+
+	evt, ok := newCloudEvent(org, repo, rec)
+	if !ok {
+		return
+	}
+	body, err := json.Marshal(evt)
+	if err != nil {
+		bot.logError(err, "failed to encode the lifecycle event of "+rec.Target)
+		return
+	}
+
+	for i := range repoCnf.Sinks {
+		if !bot.publishing.start() {
+			bot.logError(errInterrupted, "the lifecycle event "+evt.ID+" is not published to "+repoCnf.Sinks[i].URL)
+			continue
+		}
+		go func(s sinkConfig) {
+			defer bot.publishing.done()
+			bot.publishEvent(s, evt.ID, body)
+		}(repoCnf.Sinks[i])
+	}
+}
+
+// publishEvent posts the event to the sink, the transient failures are retried with backoff
+func (bot *robot) publishEvent(s sinkConfig, id string, body []byte) {
+	ctx := bot.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	err := bot.retry.do(ctx, func() error {
+		return postCloudEvent(ctx, &s, body)
+	})
+	if err != nil {
+		bot.logError(err, "failed to publish the lifecycle event "+id+" to "+s.URL)
+	}
+}
+
+func postCloudEvent(ctx context.Context, s *sinkConfig, body []byte) error {
+	op := "publish the lifecycle event to " + s.URL
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultSinkTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return &apiError{kind: errUnexpected, op: op, err: err}
+	}
+	req.Header.Set("Content-Type", cloudEventContentType)
+	if len(s.secret) > 0 {
+		req.Header.Set(headerSignature, signPayload(s.secret, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return newTransientError(op, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return newStatusError(op, resp.StatusCode, resp.Header)
+	}
+	return nil
+}
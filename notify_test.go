@@ -0,0 +1,216 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/opensourceways/server-common-lib/config"
+	"github.com/opensourceways/server-common-lib/secret"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSinkConfigValidate(t *testing.T) {
+	testCases := []struct {
+		desc string
+		in   sinkConfig
+		out  error
+	}{
+		{"valid sink", sinkConfig{URL: "https://events.example.com/lifecycle", Timeout: 3}, nil},
+		{"empty url", sinkConfig{}, errors.New("invalid sink url: ")},
+		{"relative url", sinkConfig{URL: "/lifecycle"}, errors.New("invalid sink url: /lifecycle")},
+		{
+			"negative timeout",
+			sinkConfig{URL: "https://events.example.com", Timeout: -1},
+			errors.New("the sink timeout can not be negative"),
+		},
+		{
+			"missing secret file",
+			sinkConfig{URL: "https://events.example.com", SecretFile: "testdata/no_secret"},
+			errors.New("failed to load the secret of the sink https://events.example.com"),
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			assert.Equal(t, testCases[i].out, testCases[i].in.validate())
+		})
+	}
+}
+
+func TestNewCloudEvent(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		in     auditRecord
+		ok     bool
+		typ    string
+		reason string
+	}{
+		{
+			"successful transition",
+			auditRecord{Action: "close", Role: roleAuthor, Policy: policyAllowed, Outcome: outcomeSuccess},
+			true, cloudEventTypeTransition, "/close command by the author",
+		},
+		{
+			"denied on the permission",
+			auditRecord{Action: "reopen", Role: roleNone, Policy: policyNoPermission, Outcome: outcomeSkipped},
+			true, cloudEventTypeDenial, "/reopen command denied by the policy no-permission",
+		},
+		{
+			"denied without the linked pull request",
+			auditRecord{Action: "close", Role: roleAuthor, Policy: policyNeedsLinkPR, Outcome: outcomeSkipped},
+			true, cloudEventTypeDenial, "/close command denied by the policy needs-link-pr",
+		},
+		{
+			"already in the state",
+			auditRecord{Action: "close", Role: roleAuthor, Policy: policyAlreadyInState, Outcome: outcomeSkipped},
+			false, "", "",
+		},
+		{
+			"failed transition",
+			auditRecord{Action: "close", Role: roleAuthor, Policy: policyAllowed, Outcome: outcomeFailure},
+			false, "", "",
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			rec := testCases[i].in
+			rec.Target, rec.Actor = "owner/repo#1", "user1"
+			evt, ok := newCloudEvent("owner", "repo", &rec)
+			assert.Equal(t, testCases[i].ok, ok)
+			if !ok {
+				return
+			}
+			assert.Equal(t, cloudEventSpecVersion, evt.SpecVersion)
+			assert.Equal(t, component+"/owner/repo", evt.Source)
+			assert.Equal(t, "owner/repo#1", evt.Subject)
+			assert.Equal(t, 32, len(evt.ID))
+			assert.Equal(t, testCases[i].typ, evt.Type)
+			assert.Equal(t, testCases[i].reason, evt.Data.Reason)
+			assert.Equal(t, "user1", evt.Data.Actor)
+		})
+	}
+}
+
+// eventSink is a stand-in sink, it fails the first requests with failures
+type eventSink struct {
+	failures int
+	requests chan *http.Request
+	bodies   chan []byte
+}
+
+func newEventSink(t *testing.T, failures int) (*eventSink, *httptest.Server) {
+	s := &eventSink{failures: failures, requests: make(chan *http.Request, 10), bodies: make(chan []byte, 10)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.requests <- r
+		s.bodies <- body
+		if s.failures > 0 {
+			s.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func noSleepRetrier(maxAttempts int) *retrier {
+	r := newRetrier(&retryConfig{MaxAttempts: maxAttempts})
+	r.sleep = func(context.Context, time.Duration) error { return nil }
+	return r
+}
+
+func TestPublishEvent(t *testing.T) {
+	sink, srv := newEventSink(t, 1)
+	bot := &robot{retry: noSleepRetrier(3)}
+
+	// the secret is loaded once the sink is validated
+	s := sinkConfig{URL: srv.URL, SecretFile: "testdata/token"}
+	assert.Equal(t, nil, s.validate())
+	body := []byte(`{"specversion":"1.0"}`)
+	bot.publishEvent(s, "1", body)
+
+	key, err := secret.LoadSingleSecret("testdata/token")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(sink.requests))
+	for len(sink.requests) > 0 {
+		r := <-sink.requests
+		assert.Equal(t, cloudEventContentType, r.Header.Get("Content-Type"))
+		assert.Equal(t, signPayload(key, body), r.Header.Get(headerSignature))
+		assert.Equal(t, body, <-sink.bodies)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	sink, srv := newEventSink(t, 0)
+	cnf := &configuration{ConfigItems: []repoConfig{{
+		RepoFilter: config.RepoFilter{Repos: []string{"owner/repo"}},
+		Sinks:      []sinkConfig{{URL: srv.URL}},
+	}}}
+	rec := &auditRecord{
+		Target: "owner/repo#1", TargetKind: "issue", Actor: "user1", Author: "user2", Action: "close",
+		Role: roleNone, Policy: policyNoPermission, Outcome: outcomeSkipped,
+	}
+
+	// Nothing is published in the shadow mode or for the repository without sinks
+	(&robot{cnf: cnf, shadow: true}).notify("owner", "repo", rec)
+	(&robot{cnf: cnf}).notify("owner", "other", rec)
+
+	(&robot{cnf: cnf}).notify("owner", "repo", rec)
+	select {
+	case <-sink.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event was not published")
+	}
+
+	var evt cloudEvent
+	assert.Equal(t, nil, json.Unmarshal(<-sink.bodies, &evt))
+	assert.Equal(t, cloudEventTypeDenial, evt.Type)
+	assert.Equal(t, lifecycleEventData{
+		Actor: "user1", Author: "user2", Target: "owner/repo#1", TargetKind: "issue", Action: "close",
+		Reason: "/close command denied by the policy no-permission", Role: roleNone,
+		Policy: policyNoPermission, Outcome: outcomeSkipped,
+	}, evt.Data)
+	assert.Equal(t, 0, len(sink.requests))
+}
+
+func TestShutdownWaitsForPublishing(t *testing.T) {
+	release := make(chan struct{})
+	published := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		published <- struct{}{}
+	}))
+	t.Cleanup(srv.Close)
+
+	bot := newShutdownTestRobot(t, &mockClient{})
+	bot.cnf.ConfigItems[0].Sinks = []sinkConfig{{URL: srv.URL}}
+	bot.retry = noSleepRetrier(1)
+	bot.publishing = &publishers{}
+	rec := &auditRecord{Target: "owner1/repo1#1", Action: actionClose, Outcome: outcomeSuccess}
+	bot.notify("owner1", "repo1", rec)
+
+	// the event being published is waited for, the later ones are not published
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	assert.Equal(t, nil, bot.shutdown(time.Minute))
+	assert.Equal(t, 1, len(published))
+	assert.Equal(t, false, bot.publishing.start())
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/opensourceways/server-common-lib/secret"
 	"github.com/sirupsen/logrus"
 	"os"
+	"time"
 )
 
 type robotOptions struct {
@@ -27,6 +28,22 @@ type robotOptions struct {
 	delToken  bool
 	interrupt bool
 	tokenPath string
+	storePath string
+	dryRun    bool
+
+	shutdownTimeout      time.Duration
+	unfinishedEventsPath string
+	adminTokenPath       string
+	// adminToken is loaded from the adminTokenPath with the other options, before anything starts
+	adminToken []byte
+
+	// the consumer mode reads the events from Kafka when the brokers are set
+	kafkaBrokers     string
+	kafkaTopics      string
+	kafkaGroup       string
+	kafkaPoisonTopic string
+
+	backfillSince string
 }
 
 func (o *robotOptions) addFlags(fs *flag.FlagSet) {
@@ -39,6 +56,49 @@ func (o *robotOptions) addFlags(fs *flag.FlagSet) {
 		&o.delToken, "del-token", true,
 		"An flag to delete token secret file.",
 	)
+	fs.StringVar(
+		&o.storePath, "store-path", "",
+		"Path to the embedded database file keeping the lifecycle history. The history is disabled if it is empty, "+
+			"and it is served as one of the admin endpoints.",
+	)
+	fs.BoolVar(
+		&o.dryRun, "dry-run", false,
+		"Evaluate every event but only log the changes which would be made on the platform.",
+	)
+	fs.DurationVar(
+		&o.shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout*time.Second,
+		"How long to wait for the lifecycle events being handled on the shutdown. It must be shorter than a minute, "+
+			"which is how long the process waits for all the workers.",
+	)
+	fs.StringVar(
+		&o.unfinishedEventsPath, "unfinished-events-file", "",
+		"Path to the file where the events not done on the shutdown are written, and resumed from on the startup.",
+	)
+	fs.StringVar(
+		&o.adminTokenPath, "admin-token-path", "",
+		"Path to the file containing the token of the admin endpoints. The admin endpoints are disabled if it is empty.",
+	)
+	fs.StringVar(
+		&o.kafkaBrokers, "kafka-brokers", "",
+		"Comma separated addresses of the Kafka brokers. The events are also consumed from Kafka if it is set.",
+	)
+	fs.StringVar(
+		&o.kafkaTopics, "kafka-topics", "",
+		"Comma separated topics of the events in the consumer mode.",
+	)
+	fs.StringVar(
+		&o.kafkaGroup, "kafka-group", component,
+		"Consumer group of the robot in the consumer mode.",
+	)
+	fs.StringVar(
+		&o.kafkaPoisonTopic, "kafka-poison-topic", "",
+		"Topic where the events which can't be handled are written in the consumer mode. They are dropped if it is empty.",
+	)
+	fs.StringVar(
+		&o.backfillSince, "backfill-since", "",
+		"Replay the lifecycle commands commented since the time in RFC3339, or since the duration ago such as 2h, "+
+			"instead of since the last processed event.",
+	)
 }
 
 func (o *robotOptions) validateFlags() (*configuration, []byte) {
@@ -48,6 +108,26 @@ func (o *robotOptions) validateFlags() (*configuration, []byte) {
 		return nil, nil
 	}
 
+	if o.kafkaBrokers != "" && (len(splitList(o.kafkaTopics)) == 0 || o.kafkaGroup == "") {
+		logrus.Error("the kafka-topics and kafka-group are required in the consumer mode")
+		o.interrupt = true
+		return nil, nil
+	}
+
+	if o.shutdownTimeout < 0 || o.shutdownTimeout >= maxShutdownTimeout {
+		logrus.Errorf("the shutdown-timeout must be shorter than %s", maxShutdownTimeout)
+		o.interrupt = true
+		return nil, nil
+	}
+
+	if o.backfillSince != "" {
+		if _, err := parseBackfillSince(o.backfillSince, time.Now()); err != nil {
+			logrus.WithError(err).Error("invalid backfill options")
+			o.interrupt = true
+			return nil, nil
+		}
+	}
+
 	configmap, err := config.NewConfigmapAgent(&configuration{}, o.service.ConfigFile)
 	if err != nil {
 		logrus.WithError(err).Error("fatal error occurred while loading and parsing configmap")
@@ -60,6 +140,12 @@ func (o *robotOptions) validateFlags() (*configuration, []byte) {
 		logrus.WithError(err).Error("fatal error occurred while loading token")
 		o.interrupt = true
 	}
+	if o.adminTokenPath != "" {
+		if o.adminToken, err = secret.LoadSingleSecret(o.adminTokenPath); err != nil || len(o.adminToken) == 0 {
+			logrus.WithError(err).Error("fatal error occurred while loading the admin token")
+			o.interrupt = true
+		}
+	}
 	if o.delToken {
 		if err = os.Remove(o.tokenPath); err != nil {
 			logrus.WithError(err).Error("fatal error occurred while deleting token")
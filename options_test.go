@@ -87,4 +87,26 @@ func TestGatherOptions(t *testing.T) {
 	_ = utils.LoadFromYaml(findTestdata(t, configYaml), want)
 	assert.Equal(t, *want, *got)
 	assert.Equal(t, "1231****55324", string(token))
+
+	// the process exits a minute after the interrupt, so the events can't be waited for longer
+	for _, timeout := range []string{"--shutdown-timeout=1m", "--shutdown-timeout=-1s"} {
+		opt = new(robotOptions)
+		_, _ = opt.gatherOptions(flag.NewFlagSet(args[0], flag.ExitOnError), append(args[1:], timeout)...)
+		assert.Equal(t, true, opt.interrupt)
+	}
+	opt = new(robotOptions)
+	_, _ = opt.gatherOptions(flag.NewFlagSet(args[0], flag.ExitOnError), append(args[1:], "--shutdown-timeout=59s")...)
+	assert.Equal(t, false, opt.interrupt)
+
+	// the admin token is loaded with the other options
+	args = append(args, "--admin-token-path=admin_token")
+	opt = new(robotOptions)
+	_, _ = opt.gatherOptions(flag.NewFlagSet(args[0], flag.ExitOnError), args[1:]...)
+	assert.Equal(t, true, opt.interrupt)
+
+	args[len(args)-1] = "--admin-token-path=" + findTestdata(t, "token")
+	opt = new(robotOptions)
+	_, _ = opt.gatherOptions(flag.NewFlagSet(args[0], flag.ExitOnError), args[1:]...)
+	assert.Equal(t, false, opt.interrupt)
+	assert.Equal(t, "1231****55324", string(opt.adminToken))
 }
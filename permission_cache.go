@@ -0,0 +1,181 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"container/list"
+	"errors"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPermissionCachePositiveTTL = 10 * 60
+	defaultPermissionCacheNegativeTTL = 60
+	defaultPermissionCacheMaxEntries  = 10000
+)
+
+// permissionCacheMetrics counts the lookups of the permission cache by their results, they are hit or miss
+var permissionCacheMetrics = expvar.NewMap("lifecycle_permission_cache")
+
+// permissionCacheConfig configures the cache of the permission and sig lookups
+type permissionCacheConfig struct {
+	// Disabled makes every permission check ask the platform.
+	Disabled bool `json:"disabled,omitempty"`
+	// PositiveTTL is how long in seconds a granted permission is cached, it is 10 minutes by default.
+	PositiveTTL int `json:"positive_ttl,omitempty"`
+	// NegativeTTL is how long in seconds a denied permission is cached, it is 1 minute by default.
+	NegativeTTL int `json:"negative_ttl,omitempty"`
+	// MaxEntries bounds the number of the cached lookups, the least recently used ones are evicted.
+	MaxEntries int `json:"max_entries,omitempty"`
+}
+
+func (c *permissionCacheConfig) validate() error {
+	if c.PositiveTTL < 0 || c.NegativeTTL < 0 || c.MaxEntries < 0 {
+		return errors.New("the permission_cache positive_ttl, negative_ttl and max_entries can not be negative")
+	}
+	return nil
+}
+
+type permissionCacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// permissionCache caches the results of the permission lookups of the users and the sigs of the repositories.
+// The keys are org/repo/user for the permissions and org/repo/ for the sigs, so they are invalidated together.
+type permissionCache struct {
+	mu          sync.Mutex
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	entries     map[string]*list.Element
+	// order is from the most recently used entry to the least
+	order *list.List
+	now   func() time.Time
+}
+
+// newPermissionCache returns nil if the cache is disabled, the nil cache caches nothing
+func newPermissionCache(c *permissionCacheConfig) *permissionCache {
+	if c.Disabled {
+		return nil
+	}
+
+	pc := &permissionCache{
+		positiveTTL: time.Duration(c.PositiveTTL) * time.Second,
+		negativeTTL: time.Duration(c.NegativeTTL) * time.Second,
+		maxEntries:  c.MaxEntries,
+		entries:     map[string]*list.Element{},
+		order:       list.New(),
+		now:         time.Now,
+	}
+	if pc.positiveTTL == 0 {
+		pc.positiveTTL = defaultPermissionCachePositiveTTL * time.Second
+	}
+	if pc.negativeTTL == 0 {
+		pc.negativeTTL = defaultPermissionCacheNegativeTTL * time.Second
+	}
+	if pc.maxEntries == 0 {
+		pc.maxEntries = defaultPermissionCacheMaxEntries
+	}
+	return pc
+}
+
+func permissionCacheKey(org, repo, user string) string {
+	return org + "/" + repo + "/" + user
+}
+
+// get returns the cached value of key if it is not expired
+func (c *permissionCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || !c.now().Before(e.Value.(*permissionCacheEntry).expires) {
+		if ok {
+			c.remove(e)
+		}
+		permissionCacheMetrics.Add("miss", 1)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	permissionCacheMetrics.Add("hit", 1)
+	return e.Value.(*permissionCacheEntry).value, true
+}
+
+// set caches the value of key, positive tells which TTL it is cached for
+func (c *permissionCache) set(key string, value interface{}, positive bool) {
+	if c == nil {
+		return
+	}
+
+	ttl := c.negativeTTL
+	if positive {
+		ttl = c.positiveTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&permissionCacheEntry{key: key, value: value, expires: c.now().Add(ttl)})
+
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate removes the cached lookups of the org, the repo or the user, the empty arguments match all.
+// It returns the number of the removed entries.
+func (c *permissionCache) invalidate(org, repo, user string) int {
+	if c == nil {
+		return 0
+	}
+
+	prefix := org + "/"
+	if repo != "" {
+		prefix += repo + "/"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key, e := range c.entries {
+		if org != "" && !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if user != "" && key[strings.LastIndex(key, "/")+1:] != user {
+			continue
+		}
+		c.remove(e)
+		n++
+	}
+	return n
+}
+
+func (c *permissionCache) remove(e *list.Element) {
+	delete(c.entries, e.Value.(*permissionCacheEntry).key)
+	c.order.Remove(e)
+}
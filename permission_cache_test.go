@@ -0,0 +1,134 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPermissionCache(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	c := newPermissionCache(&permissionCacheConfig{PositiveTTL: 60, NegativeTTL: 10, MaxEntries: 3})
+	c.now = func() time.Time { return now }
+
+	c.set(permissionCacheKey(org, repo, "user1"), true, true)
+	c.set(permissionCacheKey(org, repo, "user2"), false, false)
+
+	// the denied permission expires earlier
+	now = now.Add(10 * time.Second)
+	v, ok := c.get(permissionCacheKey(org, repo, "user1"))
+	assert.Equal(t, []interface{}{true, true}, []interface{}{v, ok})
+	_, ok = c.get(permissionCacheKey(org, repo, "user2"))
+	assert.Equal(t, false, ok)
+
+	// the least recently used entry is evicted
+	c.set(permissionCacheKey(org, repo, "user3"), true, true)
+	c.set(permissionCacheKey(org, repo, ""), []client.SigInfo{}, true)
+	_, ok = c.get(permissionCacheKey(org, repo, "user1"))
+	assert.Equal(t, true, ok)
+	c.set(permissionCacheKey("org2", repo, "user1"), true, true)
+	_, ok = c.get(permissionCacheKey(org, repo, "user3"))
+	assert.Equal(t, false, ok)
+
+	assert.Equal(t, 2, c.invalidate("", "", "user1"))
+	assert.Equal(t, 1, c.invalidate(org, repo, ""))
+	assert.Equal(t, 0, len(c.entries))
+
+	var disabled *permissionCache
+	disabled.set("key", true, true)
+	_, ok = disabled.get("key")
+	assert.Equal(t, false, ok)
+}
+
+func TestGitcodeClientPermissionCache(t *testing.T) {
+	forge := newFakeForge()
+	forge.reset(nil, nil, []string{"owner1/repo1/admin1"},
+		map[string][]client.SigInfo{"owner1/repo1": {{SigName: "sig1", Maintainers: []string{"maintainer1"}}}})
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		forge.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	cli := newForgeClient(srv.URL, &configuration{}, logrus.NewEntry(logger))
+
+	testCases := []struct {
+		desc     string
+		user     string
+		pass     bool
+		requests int32
+	}{
+		{
+			"the admin is looked up",
+			"admin1",
+			true,
+			1,
+		},
+		{
+			"the admin is cached",
+			"admin1",
+			true,
+			1,
+		},
+		{
+			"the maintainer is looked up with the sigs",
+			"maintainer1",
+			true,
+			3,
+		},
+		{
+			"the sigs are cached for the other users",
+			"user1",
+			false,
+			4,
+		},
+		{
+			"the denied permission is cached",
+			"user1",
+			false,
+			4,
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			pass, err := cli.CheckPermission(context.Background(), "owner1", "repo1", testCases[i].user)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, testCases[i].pass, pass)
+			assert.Equal(t, testCases[i].requests, atomic.LoadInt32(&requests))
+		})
+	}
+
+	// the invalidated permissions are looked up again
+	h := requireAdminToken([]byte("secret"), cli.cache)
+	r := httptest.NewRequest(http.MethodDelete, "/admin/permissions/owner1/repo1?user=user1", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"invalidated":1}`+"\n", w.Body.String())
+
+	_, _ = cli.CheckPermission(context.Background(), "owner1", "repo1", "user1")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&requests))
+}
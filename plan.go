@@ -0,0 +1,302 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/sirupsen/logrus"
+	"reflect"
+	"strings"
+)
+
+type actionKind string
+
+const (
+	actionKindUpdateIssue actionKind = "UpdateIssue"
+	actionKindUpdatePR    actionKind = "UpdatePR"
+	actionKindComment     actionKind = "Comment"
+	actionKindSkip        actionKind = "Skip"
+
+	// the names of the comment templates, they are the json keys in the configuration
+	templateNoPermissionOperateIssue       = "comment_no_permission_operate_issue"
+	templateIssueNeedsLinkPR               = "comment_issue_needs_link_pr"
+	templateListLinkingPullRequestsFailure = "comment_list_linking_pull_requests_failure"
+	templateNoPermissionOperatePR          = "comment_no_permission_operate_pr"
+	templateStateUnchanged                 = "comment_state_unchanged"
+	templateUpdateStateFailure             = "comment_update_state_failure"
+	templateUpdateStateForbidden           = "comment_update_state_forbidden"
+	templateCheckPermissionFailure         = "comment_check_permission_failure"
+	templatePlatformUnavailable            = "comment_platform_unavailable"
+	templatePolicyAuditReopen              = "comment_policy_audit_reopen"
+	templateIssueClosedWithoutLinkPR       = "comment_issue_closed_without_link_pr"
+)
+
+// plannedAction is one step of a lifecycle plan
+type plannedAction struct {
+	Kind actionKind `json:"kind"`
+	// State is the target state of UpdateIssue and UpdatePR
+	State string `json:"state,omitempty"`
+	// Template is the name of the comment template of Comment
+	Template string `json:"template,omitempty"`
+	// Vars are the values of the placeholders in the comment template
+	Vars map[string]string `json:"vars,omitempty"`
+	// Reason explains why nothing is done for Skip
+	Reason string `json:"reason,omitempty"`
+}
+
+func commentAction(template string, vars map[string]string) plannedAction {
+	return plannedAction{Kind: actionKindComment, Template: template, Vars: vars}
+}
+
+// lifecyclePlan is the decision made on a lifecycle command, it is applied by executePlan
+type lifecyclePlan struct {
+	Org         string          `json:"org"`
+	Repo        string          `json:"repo"`
+	Number      string          `json:"number"`
+	CommentKind string          `json:"comment_kind"`
+	Command     string          `json:"command"`
+	Role        string          `json:"role"`
+	Policy      string          `json:"policy"`
+	Actions     []plannedAction `json:"actions"`
+	// Operator runs the command with the admin API, Force tells if the policy checks are skipped
+	Operator string `json:"operator,omitempty"`
+	Force    bool   `json:"force,omitempty"`
+}
+
+func newLifecyclePlan(org, repo, number, commentKind, command string) *lifecyclePlan {
+	return &lifecyclePlan{Org: org, Repo: repo, Number: number, CommentKind: commentKind, Command: command}
+}
+
+func (p *lifecyclePlan) add(a plannedAction) {
+	p.Actions = append(p.Actions, a)
+}
+
+// defaultCommentTemplates are used for the optional comment templates which are not configured,
+// so the config written before they were added is still valid
+var defaultCommentTemplates = map[string]string{
+	templateStateUnchanged: " [@__commenter__](https://gitcode.com/__commenter__)  " +
+		"the __action__ command is ignored, because it is already __state__.",
+	templateUpdateStateFailure: " [@__commenter__](https://gitcode.com/__commenter__)  " +
+		"fail to __action__ it on the platform, please retry later.",
+	templateUpdateStateForbidden: " [@__commenter__](https://gitcode.com/__commenter__)  " +
+		"the robot is not allowed to __action__ it, please contact the administrators of the robot.",
+	templateCheckPermissionFailure: " [@__commenter__](https://gitcode.com/__commenter__)  " +
+		"fail to check your permission to __action__ it, please retry later.",
+	templatePlatformUnavailable: " [@__commenter__](https://gitcode.com/__commenter__)  " +
+		"the platform is not available now, please try to __action__ it later.",
+	templatePolicyAuditReopen: " [@__author__](https://gitcode.com/__author__)  " +
+		"this issue is reopened, because it was closed without a linked pull request.",
+}
+
+// commentTemplate returns the comment template whose json key is name, or its default if it is not configured
+func (c *configuration) commentTemplate(name string) string {
+	k := reflect.TypeOf(*c)
+	v := reflect.ValueOf(*c)
+
+	n := k.NumField()
+	for i := 0; i < n; i++ {
+		if strings.Split(k.Field(i).Tag.Get("json"), ",")[0] == name {
+			if s, _ := v.Field(i).Interface().(string); s != "" {
+				return s
+			}
+			break
+		}
+	}
+
+	return defaultCommentTemplates[name]
+}
+
+// renderComment fills the placeholders of the comment template
+func (c *configuration) renderComment(a *plannedAction) string {
+	s := c.commentTemplate(a.Template)
+	for k, v := range a.Vars {
+		s = strings.ReplaceAll(s, k, v)
+	}
+	return s
+}
+
+// executePlan applies the plan on the platform, and records the audit and history of it.
+// Nothing is changed on the platform when the robot handles the event in the shadow mode.
+func (bot *robot) executePlan(ctx context.Context, evt *client.GenericEvent, plan *lifecyclePlan) (rec *auditRecord) {
+	rec = newAuditRecord(evt, plan.Org, plan.Repo, plan.Number, plan.Command)
+	rec.Role, rec.Policy = plan.Role, plan.Policy
+	rec.Operator, rec.Force = plan.Operator, plan.Force
+	defer bot.recordDecision(plan.Org, plan.Repo, plan.Number, rec)
+
+	bot.tracef("command: /%s on %s by the %s, policy: %s", plan.Command, rec.Target, plan.Role, plan.Policy)
+	for i := range plan.Actions {
+		a := &plan.Actions[i]
+		bot.traceAction(a)
+		if bot.shadow {
+			bot.logWouldDo(plan, a)
+			if a.Kind == actionKindUpdateIssue || a.Kind == actionKindUpdatePR {
+				rec.Outcome = outcomeShadowed
+			}
+			continue
+		}
+
+		switch a.Kind {
+		case actionKindUpdateIssue, actionKindUpdatePR:
+			// The update is delivered by the action queue if it is enabled
+			if bot.actions != nil && bot.queueUpdate(plan, rec, a) {
+				break
+			}
+			err := bot.updateState(ctx, plan, a)
+			rec.setOutcome(err == nil)
+			bot.handleUpdateError(ctx, plan, rec, a, err)
+		case actionKindComment:
+			if bot.actions != nil {
+				bot.enqueueComment(rec.EventGUID, plan.Org, plan.Repo, plan.Number, plan.CommentKind,
+					bot.cnf.renderComment(a))
+				break
+			}
+			bot.createComment(ctx, plan, a)
+		case actionKindSkip:
+			if bot.log != nil {
+				bot.log.Info("skip the " + plan.Command + " command: " + a.Reason)
+			}
+		}
+	}
+	return
+}
+
+// updateState changes the state of the issue or pull request,
+// the transient and rate limited failures are retried with backoff
+func (bot *robot) updateState(ctx context.Context, plan *lifecyclePlan, a *plannedAction) error {
+	err := bot.retry.do(ctx, func() error {
+		if a.Kind == actionKindUpdatePR {
+			return bot.cli.UpdatePR(ctx, plan.Org, plan.Repo, plan.Number, a.State)
+		}
+		return bot.cli.UpdateIssue(ctx, plan.Org, plan.Repo, plan.Number, a.State)
+	})
+	if err == nil {
+		bot.guard.recordOwn(closeGuardKey(plan.Org, plan.Repo, plan.Number), a.State)
+	}
+	return err
+}
+
+// handleUpdateError tells the commenter that the command failed, so it is not silently lost.
+// Nothing is commented on the issue or pull request which doesn't exist any more, or which
+// was changed to the state by someone else at the same time.
+func (bot *robot) handleUpdateError(ctx context.Context, plan *lifecyclePlan, rec *auditRecord, a *plannedAction, err error) {
+	if err == nil {
+		return
+	}
+
+	switch {
+	case errors.Is(err, errNotFound):
+		bot.logError(err, "drop the "+plan.Command+" command, "+rec.Target+" doesn't exist")
+	case errors.Is(err, errForbidden):
+		// Retrying never helps, the token of the robot has to be granted the permission
+		bot.logError(err, "the token is not allowed to "+plan.Command+" "+rec.Target)
+	case errors.Is(err, errConflict) && bot.inState(ctx, plan, a):
+		bot.dropChangedAtSameTime(plan, a, rec)
+		return
+	default:
+		bot.logError(err, "failed to "+plan.Command+" "+rec.Target)
+	}
+
+	if template := updateFailureTemplate(err); template != "" {
+		bot.createComment(ctx, plan, updateFailureComment(template, rec))
+	}
+}
+
+// updateFailureTemplate returns the template of the comment which tells the commenter that the update failed
+// for good, it is empty if the issue or pull request doesn't exist any more
+func updateFailureTemplate(err error) string {
+	switch {
+	case errors.Is(err, errNotFound):
+		return ""
+	case errors.Is(err, errForbidden):
+		return templateUpdateStateForbidden
+	}
+	return failureTemplate(err, templateUpdateStateFailure)
+}
+
+func updateFailureComment(template string, rec *auditRecord) *plannedAction {
+	return &plannedAction{
+		Kind:     actionKindComment,
+		Template: template,
+		Vars:     map[string]string{placeholderCommenter: rec.Actor, placeholderAction: rec.Action},
+	}
+}
+
+// dropChangedAtSameTime records the update which conflicted, because someone else changed the issue or
+// pull request to the state at the same time, as nothing to do
+func (bot *robot) dropChangedAtSameTime(plan *lifecyclePlan, a *plannedAction, rec *auditRecord) {
+	if bot.log != nil {
+		bot.log.Infof("drop the %s command, %s was changed to %s at the same time", plan.Command, rec.Target, a.State)
+	}
+	rec.Policy, rec.Outcome = policyAlreadyInState, outcomeSkipped
+}
+
+// inState reads the state of the issue or pull request again, and reports if it is already the target state
+func (bot *robot) inState(ctx context.Context, plan *lifecyclePlan, a *plannedAction) bool {
+	var current string
+	var err error
+	if a.Kind == actionKindUpdatePR {
+		current, err = bot.cli.GetPRState(ctx, plan.Org, plan.Repo, plan.Number)
+	} else {
+		current, err = bot.cli.GetIssueState(ctx, plan.Org, plan.Repo, plan.Number)
+	}
+	if err != nil {
+		bot.logError(err, "failed to get the current state of "+plan.Org+"/"+plan.Repo+"#"+plan.Number)
+		return false
+	}
+	return current == a.State
+}
+
+// failureTemplate returns the template of the comment on a failed request, it asks to try later
+// if the request failed fast on the open circuit
+func failureTemplate(err error, template string) string {
+	if errors.Is(err, errCircuitOpen) {
+		return templatePlatformUnavailable
+	}
+	return template
+}
+
+func (bot *robot) createComment(ctx context.Context, plan *lifecyclePlan, a *plannedAction) {
+	var err error
+	if plan.CommentKind == client.CommentOnIssue {
+		err = bot.cli.CreateIssueComment(ctx, plan.Org, plan.Repo, plan.Number, bot.cnf.renderComment(a))
+	} else {
+		err = bot.cli.CreatePRComment(ctx, plan.Org, plan.Repo, plan.Number, bot.cnf.renderComment(a))
+	}
+	if err != nil {
+		bot.logError(err, "failed to comment "+a.Template+" on "+plan.Org+"/"+plan.Repo+"#"+plan.Number)
+	}
+}
+
+func (bot *robot) logError(err error, msg string) {
+	if bot.log != nil {
+		bot.log.WithError(err).Error(msg)
+	}
+}
+
+func (bot *robot) logWouldDo(plan *lifecyclePlan, a *plannedAction) {
+	if bot.log == nil {
+		return
+	}
+
+	bot.log.WithFields(logrus.Fields{
+		"dry-run":  true,
+		"target":   plan.Org + "/" + plan.Repo + "#" + plan.Number,
+		"action":   a.Kind,
+		"state":    a.State,
+		"template": a.Template,
+		"reason":   a.Reason,
+	}).Info("would do " + string(a.Kind))
+}
@@ -0,0 +1,387 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/framework"
+	"github.com/opensourceways/server-common-lib/secret"
+	sutils "github.com/opensourceways/server-common-lib/utils"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	policyAuditCommand = "policy-audit"
+
+	reportFormatCSV  = "csv"
+	reportFormatJSON = "json"
+
+	// the actions taken on a violating issue
+	auditActionReopened = "reopened"
+	auditActionShadowed = "shadowed"
+	auditActionFailed   = "failed"
+
+	defaultAuditPageSize = 100
+	maxAuditPages        = 1000
+)
+
+// closedIssue is an issue listed by the policy audit
+type closedIssue struct {
+	Number   string
+	Title    string
+	Author   string
+	ClosedAt time.Time
+}
+
+// issueLister lists the repositories and their closed issues for the policy audit
+type issueLister interface {
+	ListClosedIssues(ctx context.Context, org, repo string, since time.Time, page, perPage int) ([]closedIssue, error)
+	ListOrgRepos(ctx context.Context, org string, page, perPage int) ([]string, error)
+}
+
+// auditedIssue is a row of the report of the policy audit
+type auditedIssue struct {
+	Org                string    `json:"org"`
+	Repo               string    `json:"repo"`
+	Number             string    `json:"number"`
+	Title              string    `json:"title"`
+	Author             string    `json:"author"`
+	ClosedAt           time.Time `json:"closed_at"`
+	LinkedPullRequests int       `json:"linked_pull_requests"`
+	// Violation tells if the issue was closed without a linked pull request
+	Violation bool `json:"violation"`
+	// Action is what was done on the violating issue, it is empty if nothing was done
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// policyAuditor checks the issues closed in a time range against the linked pull request policy
+type policyAuditor struct {
+	bot      *robot
+	issues   issueLister
+	pageSize int
+	// reopen reopens the violating issues with the explanation
+	reopen bool
+}
+
+// run audits the closed issues of the repositories which need the linked pull requests,
+// only the repositories matched by filter are audited if it is not empty
+func (a *policyAuditor) run(ctx context.Context, since, until time.Time, filter []string) ([]auditedIssue, error) {
+	repos, err := a.repos(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var report []auditedIssue
+	for _, r := range repos {
+		org, repo, _ := strings.Cut(r, "/")
+		issues, err := a.closedIssues(ctx, org, repo, since, until)
+		if err != nil {
+			return report, err
+		}
+		for i := range issues {
+			report = append(report, a.audit(ctx, org, repo, &issues[i]))
+		}
+	}
+	return report, nil
+}
+
+// repos returns the org/repo whose config needs the linked pull requests. The orgs in the config
+// are expanded to their repositories, and the excluded repositories are skipped.
+func (a *policyAuditor) repos(ctx context.Context, filter []string) ([]string, error) {
+	cnf := a.bot.cnf
+	seen := map[string]bool{}
+	var repos []string
+	for i := range cnf.ConfigItems {
+		item := &cnf.ConfigItems[i]
+		if !item.NeedIssueHasLinkPullRequests {
+			continue
+		}
+
+		for _, entry := range item.Repos {
+			candidates := []string{entry}
+			if !strings.Contains(entry, "/") {
+				var err error
+				if candidates, err = a.orgRepos(ctx, entry); err != nil {
+					return nil, err
+				}
+			}
+
+			for _, r := range candidates {
+				org, repo, _ := strings.Cut(r, "/")
+				if seen[r] || cnf.getRepoConfig(org, repo) != item || !matchRepoFilter(filter, org, repo) {
+					continue
+				}
+				seen[r] = true
+				repos = append(repos, r)
+			}
+		}
+	}
+	return repos, nil
+}
+
+// matchRepoFilter reports if the repository is one of the org/repo or org in the filter, an empty filter matches all
+func matchRepoFilter(filter []string, org, repo string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if f == org || f == org+"/"+repo {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *policyAuditor) orgRepos(ctx context.Context, org string) ([]string, error) {
+	var repos []string
+	for page := 1; page <= maxAuditPages; page++ {
+		items, err := a.issues.ListOrgRepos(ctx, org, page, a.pageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range items {
+			repos = append(repos, org+"/"+repo)
+		}
+		if len(items) < a.pageSize {
+			break
+		}
+	}
+	return repos, nil
+}
+
+// closedIssues lists the issues of the repository closed in [since, until), in the order they were closed
+func (a *policyAuditor) closedIssues(ctx context.Context, org, repo string, since, until time.Time) (
+	[]closedIssue, error) {
+	var issues []closedIssue
+	for page := 1; page <= maxAuditPages; page++ {
+		items, err := a.issues.ListClosedIssues(ctx, org, repo, since, page, a.pageSize)
+		if err != nil {
+			return nil, err
+		}
+		for i := range items {
+			if !items[i].ClosedAt.Before(since) && items[i].ClosedAt.Before(until) {
+				issues = append(issues, items[i])
+			}
+		}
+		if len(items) < a.pageSize {
+			break
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].ClosedAt.Before(issues[j].ClosedAt)
+	})
+	return issues, nil
+}
+
+// audit checks the linked pull requests of the issue, and reopens it if it violates the policy and reopen is set
+func (a *policyAuditor) audit(ctx context.Context, org, repo string, issue *closedIssue) auditedIssue {
+	row := auditedIssue{
+		Org: org, Repo: repo, Number: issue.Number, Title: issue.Title, Author: issue.Author, ClosedAt: issue.ClosedAt,
+	}
+
+	bot := a.bot
+	var err error
+	if row.LinkedPullRequests, err = bot.linkedPRNumber(ctx, org, repo, issue.Number); err != nil {
+		row.Error = err.Error()
+		return row
+	}
+	row.Violation = row.LinkedPullRequests == 0
+	if !row.Violation || !a.reopen {
+		return row
+	}
+
+	if bot.withRepoMode(bot.cnf.getRepoConfig(org, repo)).shadow {
+		row.Action = auditActionShadowed
+		return row
+	}
+
+	rec := &auditRecord{
+		Time: time.Now().UTC(), EventGUID: policyAuditCommand + "-" + randomID(), Actor: component,
+		Author: issue.Author, Target: org + "/" + repo + "#" + issue.Number, TargetKind: client.CommentOnIssue,
+		Action: actionReopen, Role: roleOperator, Policy: policyNeedsLinkPR,
+	}
+	defer bot.writeAudit(rec)
+
+	err = bot.retry.do(ctx, func() error {
+		return bot.cli.UpdateIssue(ctx, org, repo, issue.Number, bot.cnf.EventStateOpened)
+	})
+	rec.setOutcome(err == nil)
+	if err != nil {
+		row.Action, row.Error = auditActionFailed, err.Error()
+		return row
+	}
+	row.Action = auditActionReopened
+
+	comment := bot.cnf.renderComment(&plannedAction{
+		Kind:     actionKindComment,
+		Template: templatePolicyAuditReopen,
+		Vars:     map[string]string{placeholderAuthor: issue.Author},
+	})
+	if err = bot.cli.CreateIssueComment(ctx, org, repo, issue.Number, comment); err != nil {
+		row.Error = err.Error()
+	}
+	return row
+}
+
+var auditReportHeader = []string{
+	"org", "repo", "number", "title", "author", "closed_at", "linked_pull_requests", "violation", "action", "error",
+}
+
+// writeAuditReport writes the report in csv or json
+func writeAuditReport(w io.Writer, format string, report []auditedIssue) error {
+	if format == reportFormatJSON {
+		if report == nil {
+			report = []auditedIssue{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write(auditReportHeader)
+	for i := range report {
+		r := &report[i]
+		_ = cw.Write([]string{
+			r.Org, r.Repo, r.Number, r.Title, r.Author, r.ClosedAt.UTC().Format(time.RFC3339),
+			strconv.Itoa(r.LinkedPullRequests), strconv.FormatBool(r.Violation), r.Action, r.Error,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// policyAuditOptions are the flags of the policy-audit command
+type policyAuditOptions struct {
+	configFile string
+	tokenPath  string
+	since      time.Time
+	until      time.Time
+	repos      []string
+	reopen     bool
+	format     string
+	output     string
+}
+
+func parsePolicyAuditOptions(args []string, out io.Writer) (*policyAuditOptions, error) {
+	fs := flag.NewFlagSet(policyAuditCommand, flag.ContinueOnError)
+	fs.SetOutput(out)
+	configFile := fs.String("config-file", "", "Path to the configuration file of the robot.")
+	tokenPath := fs.String("token-path", "", "Path to the file containing the token secret.")
+	sinceStr := fs.String("since", "", "Audit the issues closed since the time in RFC3339, or since the duration ago such as 720h.")
+	untilStr := fs.String("until", "", "Audit the issues closed before the time in RFC3339, it is now by default.")
+	repos := fs.String("repos", "", "Comma separated org/repo or org to audit, all the configured repositories by default.")
+	reopen := fs.Bool("reopen", false, "Reopen the violating issues with the comment_policy_audit_reopen comment.")
+	format := fs.String("format", reportFormatCSV, "Format of the report, csv or json.")
+	output := fs.String("output", "", "Path to the report file, it is written to the stdout by default.")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *configFile == "" || *tokenPath == "" || *sinceStr == "" {
+		return nil, errors.New("usage: policy-audit --config-file=<config> --token-path=<token> --since=<time> " +
+			"[--until=<time>] [--repos=<org/repo,...>] [--reopen] [--format=csv|json] [--output=<file>]")
+	}
+	if *format != reportFormatCSV && *format != reportFormatJSON {
+		return nil, errors.New("unsupported report format: " + *format)
+	}
+
+	now := time.Now()
+	since, err := parseBackfillSince(*sinceStr, now)
+	if err != nil {
+		return nil, errors.New("invalid since: " + *sinceStr)
+	}
+	until := now
+	if *untilStr != "" {
+		if until, err = time.Parse(time.RFC3339, *untilStr); err != nil {
+			return nil, errors.New("invalid until: " + *untilStr)
+		}
+	}
+
+	return &policyAuditOptions{
+		configFile: *configFile, tokenPath: *tokenPath, since: since, until: until,
+		repos: splitList(*repos), reopen: *reopen, format: *format, output: *output,
+	}, nil
+}
+
+// runPolicyAudit is the policy-audit command. It reports the issues closed in the time range,
+// which violate the linked pull request policy of the current config, and reopens them if asked.
+func runPolicyAudit(args []string, out io.Writer) error {
+	opt, err := parsePolicyAuditOptions(args, out)
+	if err != nil {
+		return err
+	}
+
+	cnf := &configuration{}
+	if err = sutils.LoadFromYaml(opt.configFile, cnf); err != nil {
+		return err
+	}
+	if err = cnf.Validate(); err != nil {
+		return err
+	}
+	token, err := secret.LoadSingleSecret(opt.tokenPath)
+	if err != nil {
+		return err
+	}
+	client.SetSigInfoBaseURL(cnf.SigInfoURL)
+	client.SetCommunityName(cnf.CommunityName)
+
+	cli, err := newPlatformClient(cnf, token, framework.NewLogger().WithField("component", component))
+	if err != nil {
+		return err
+	}
+	bot, err := newRobotWithClient(cnf, cli, &robotOptions{}, nil)
+	if err != nil {
+		return err
+	}
+	defer bot.closeAudit()
+
+	return opt.audit(bot, bot.issues, out)
+}
+
+// audit audits the issues listed with issues, and writes the report to the output or to out
+func (o *policyAuditOptions) audit(bot *robot, issues issueLister, out io.Writer) error {
+	auditor := &policyAuditor{bot: bot, issues: issues, pageSize: defaultAuditPageSize, reopen: o.reopen}
+	report, err := auditor.run(context.Background(), o.since, o.until, o.repos)
+
+	w := out
+	if o.output != "" {
+		f, ferr := os.Create(o.output)
+		if ferr != nil {
+			return ferr
+		}
+		defer f.Close()
+		w = f
+	}
+	// The partial report is written when the listing fails
+	if werr := writeAuditReport(w, o.format, report); werr != nil {
+		return werr
+	}
+	if err != nil {
+		return fmt.Errorf("the report is partial: %w", err)
+	}
+	return nil
+}
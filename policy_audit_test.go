@@ -0,0 +1,142 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/opensourceways/server-common-lib/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newPolicyAuditForge(t *testing.T) (*fakeForge, string) {
+	closedAt := time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)
+	forge := newFakeForge()
+	forge.reset([]forgeItem{
+		{Org: "owner3", Repo: "repo1", Number: "1", State: "closed", Author: "author1", Title: "crash", ClosedAt: closedAt},
+		{Org: "owner3", Repo: "repo1", Number: "2", State: "closed", Author: "author2", Title: "fixed",
+			ClosedAt: closedAt.Add(time.Hour), LinkedPullRequests: 1},
+		{Org: "owner3", Repo: "repo1", Number: "3", State: "closed", Author: "author1", ClosedAt: closedAt.AddDate(0, -1, 0)},
+		{Org: "owner3", Repo: "repo1", Number: "4", State: "opened", Author: "author1"},
+		{Org: "owner4", Repo: "repo2", Number: "1", State: "closed", Author: "author3", Title: "typo", ClosedAt: closedAt},
+		{Org: "owner1", Repo: "repo1", Number: "1", State: "closed", Author: "author1", ClosedAt: closedAt},
+	}, nil, nil, nil)
+
+	srv := httptest.NewServer(forge)
+	t.Cleanup(srv.Close)
+	return forge, srv.URL
+}
+
+func TestRunPolicyAudit(t *testing.T) {
+	forge, forgeURL := newPolicyAuditForge(t)
+	args := []string{
+		"--config-file=" + findTestdata(t, configYaml),
+		"--token-path=" + findTestdata(t, "token"),
+		"--since=2024-05-01T00:00:00Z",
+		"--until=2024-06-01T00:00:00Z",
+	}
+	cnf := &configuration{}
+	assert.Equal(t, nil, utils.LoadFromYaml(findTestdata(t, configYaml), cnf))
+	logger := logrus.NewEntry(logrus.New())
+	logger.Logger.SetLevel(logrus.PanicLevel)
+	cli := newForgeClient(forgeURL, cnf, logger)
+	bot, err := newRobotWithClient(cnf, cli, &robotOptions{}, nil)
+	assert.Equal(t, nil, err)
+	// the audit runs with the client of the fake forge instead of the one of the platform
+	audit := func(args []string, out io.Writer) error {
+		opt, err := parsePolicyAuditOptions(args, out)
+		if err != nil {
+			return err
+		}
+		return opt.audit(bot, cli, out)
+	}
+	closedAt := time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)
+
+	out := new(bytes.Buffer)
+	assert.Equal(t, nil, audit(append(args, "--format=json"), out))
+	var report []auditedIssue
+	assert.Equal(t, nil, json.Unmarshal(out.Bytes(), &report))
+	assert.Equal(t, []auditedIssue{
+		{Org: "owner3", Repo: "repo1", Number: "1", Title: "crash", Author: "author1", ClosedAt: closedAt,
+			Violation: true},
+		{Org: "owner3", Repo: "repo1", Number: "2", Title: "fixed", Author: "author2", ClosedAt: closedAt.Add(time.Hour),
+			LinkedPullRequests: 1},
+		{Org: "owner4", Repo: "repo2", Number: "1", Title: "typo", Author: "author3", ClosedAt: closedAt,
+			Violation: true},
+	}, report)
+	assert.Equal(t, 0, len(forge.listComments()))
+
+	path := filepath.Join(t.TempDir(), "report.csv")
+	assert.Equal(t, nil, audit(append(args, "--repos=owner3", "--reopen", "--output="+path), out))
+	f, err := os.Open(path)
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]string{
+		auditReportHeader,
+		{"owner3", "repo1", "1", "crash", "author1", "2024-05-10T00:00:00Z", "0", "true", auditActionReopened, ""},
+		{"owner3", "repo1", "2", "fixed", "author2", "2024-05-10T01:00:00Z", "1", "false", "", ""},
+	}, rows)
+
+	item, _ := forge.item(kindIssue, "owner3", "repo1", "1")
+	assert.Equal(t, "opened", item.State)
+	item, _ = forge.item(kindIssue, "owner4", "repo2", "1")
+	assert.Equal(t, "closed", item.State)
+	comments := forge.listComments()
+	assert.Equal(t, 1, len(comments))
+	assert.Equal(t, true, strings.Contains(comments[0].Body, "@author1"))
+}
+
+func TestRunPolicyAuditArgs(t *testing.T) {
+	usage := errors.New("usage: policy-audit --config-file=<config> --token-path=<token> --since=<time> " +
+		"[--until=<time>] [--repos=<org/repo,...>] [--reopen] [--format=csv|json] [--output=<file>]")
+	testCases := []struct {
+		desc string
+		args []string
+		out  error
+	}{
+		{"without the since", []string{"--config-file=config.yaml", "--token-path=token"}, usage},
+		{
+			"unsupported format",
+			[]string{"--config-file=config.yaml", "--token-path=token", "--since=24h", "--format=xml"},
+			errors.New("unsupported report format: xml"),
+		},
+		{
+			"invalid since",
+			[]string{"--config-file=config.yaml", "--token-path=token", "--since=yesterday"},
+			errors.New("invalid since: yesterday"),
+		},
+		{
+			"invalid until",
+			[]string{"--config-file=config.yaml", "--token-path=token", "--since=24h", "--until=now"},
+			errors.New("invalid until: now"),
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			assert.Equal(t, testCases[i].out, runPolicyAudit(testCases[i].args, new(bytes.Buffer)))
+		})
+	}
+}
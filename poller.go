@@ -0,0 +1,295 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/framework"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPollInterval = 60
+	defaultPollPageSize = 50
+	// maxPollPages bounds the pages listed in one poll, the rest are listed in the next poll
+	maxPollPages = 100
+)
+
+var bucketPollWatermarks = []byte("poll_watermarks")
+
+// pollingConfig configures the polling of the repositories which can't have webhooks
+type pollingConfig struct {
+	// Repos are the repositories in the form of org/repo, whose comments are polled.
+	Repos []string `json:"repos,omitempty"`
+	// Interval is how often in seconds the comments are polled, it is 60 by default.
+	Interval int `json:"interval,omitempty"`
+	// PageSize is the number of the comments listed in a request, it is 50 by default.
+	PageSize int `json:"page_size,omitempty"`
+}
+
+func (c *pollingConfig) validate() error {
+	if c.Interval < 0 || c.PageSize < 0 {
+		return errors.New("the polling interval and page_size can not be negative")
+	}
+	return validateRepoList("polling", c.Repos)
+}
+
+// validateRepoList checks the repositories are in the form of org/repo
+func validateRepoList(name string, repos []string) error {
+	for _, r := range repos {
+		if v := strings.Split(r, "/"); len(v) != 2 || v[0] == "" || v[1] == "" {
+			return errors.New("invalid repo in the " + name + " repos: " + r)
+		}
+	}
+	return nil
+}
+
+// polledComment is a comment listed from the platform
+type polledComment struct {
+	ID        int64
+	Number    string
+	Body      string
+	Commenter string
+	CreatedAt time.Time
+}
+
+// after reports if the comment is after the watermark
+func (c *polledComment) after(w *pollWatermark) bool {
+	return c.CreatedAt.After(w.Since) || (c.CreatedAt.Equal(w.Since) && c.ID > w.LastID)
+}
+
+// commentLister lists the comments and reads the issues and pull requests of the polled repositories
+type commentLister interface {
+	ListComments(ctx context.Context, org, repo, commentKind string, since time.Time, page, perPage int) (
+		[]polledComment, error)
+	GetItem(ctx context.Context, org, repo, commentKind, number string) (state, author string, err error)
+}
+
+// pollWatermark is the last comment handled in a repository
+type pollWatermark struct {
+	Since  time.Time `json:"since"`
+	LastID int64     `json:"last_id"`
+}
+
+// poller turns the new comments of the repositories into the events. The watermarks of the repositories
+// are kept in the store, so the comments are neither replayed nor skipped across restarts.
+type poller struct {
+	cli      commentLister
+	s        *store
+	repos    []string
+	interval time.Duration
+	pageSize int
+	now      func() time.Time
+}
+
+func newPoller(cli commentLister, s *store, c *pollingConfig) (*poller, error) {
+	if s == nil {
+		return nil, errors.New("the polling requires the store to keep the watermarks, set --store-path")
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketPollWatermarks)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &poller{
+		cli:      cli,
+		s:        s,
+		repos:    c.Repos,
+		interval: time.Duration(c.Interval) * time.Second,
+		pageSize: c.PageSize,
+		now:      time.Now,
+	}
+	if p.interval == 0 {
+		p.interval = defaultPollInterval * time.Second
+	}
+	if p.pageSize == 0 {
+		p.pageSize = defaultPollPageSize
+	}
+	return p, nil
+}
+
+func (p *poller) watermark(key string) (w pollWatermark, ok bool, err error) {
+	err = p.s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketPollWatermarks).Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &w)
+	})
+	return
+}
+
+func (p *poller) saveWatermark(key string, w *pollWatermark) error {
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return p.s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPollWatermarks).Put([]byte(key), data)
+	})
+}
+
+// listComments returns the comments after the watermark in the order they are created
+func listComments(ctx context.Context, cli commentLister, pageSize int, org, repo, commentKind string, w *pollWatermark) (
+	[]polledComment, error) {
+	var comments []polledComment
+	for page := 1; page <= maxPollPages; page++ {
+		items, err := cli.ListComments(ctx, org, repo, commentKind, w.Since, page, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		for i := range items {
+			if items[i].after(w) {
+				comments = append(comments, items[i])
+			}
+		}
+		if len(items) < pageSize {
+			break
+		}
+	}
+
+	sort.SliceStable(comments, func(i, j int) bool {
+		if comments[i].CreatedAt.Equal(comments[j].CreatedAt) {
+			return comments[i].ID < comments[j].ID
+		}
+		return comments[i].CreatedAt.Before(comments[j].CreatedAt)
+	})
+	return comments, nil
+}
+
+// runPoller polls the comments until the robot shuts down
+func (bot *robot) runPoller() {
+	if bot.poller == nil {
+		return
+	}
+
+	ticker := time.NewTicker(bot.poller.interval)
+	defer ticker.Stop()
+
+	for {
+		for _, r := range bot.poller.repos {
+			v := strings.Split(r, "/")
+			for _, kind := range []string{client.CommentOnIssue, client.CommentOnPR} {
+				if err := bot.pollComments(v[0], v[1], kind); err != nil {
+					bot.logError(err, "failed to poll the comments of "+r)
+				}
+			}
+		}
+
+		select {
+		case <-bot.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollComments handles the new comments of the repository one by one, and moves the watermark after
+// each of them which is handled. The first poll of a repository only sets the watermark, the earlier comments are not handled.
+func (bot *robot) pollComments(org, repo, commentKind string) error {
+	p := bot.poller
+	key := org + "/" + repo + "/" + commentKind
+	w, ok, err := p.watermark(key)
+	if err != nil || !ok {
+		if err == nil {
+			err = p.saveWatermark(key, &pollWatermark{Since: p.now().UTC()})
+		}
+		return err
+	}
+
+	ctx, cancel := bot.eventContext("")
+	defer cancel()
+
+	comments, err := listComments(ctx, p.cli, p.pageSize, org, repo, commentKind, &w)
+	if err != nil {
+		return err
+	}
+
+	for i := range comments {
+		c := &comments[i]
+		err := bot.handlePolledComment(ctx, org, repo, commentKind, c)
+		// The comment canceled on the shutdown is polled again by the next instance
+		if bot.interrupted() {
+			return nil
+		}
+		// The failed comment is polled again in the next round, the watermark stays before it
+		if err != nil {
+			return err
+		}
+
+		w = pollWatermark{Since: c.CreatedAt, LastID: c.ID}
+		if err := p.saveWatermark(key, &w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePolledComment handles the lifecycle command in the comment, the other comments are skipped.
+// The comment on the deleted issue or pull request is skipped too.
+func (bot *robot) handlePolledComment(ctx context.Context, org, repo, commentKind string, c *polledComment) error {
+	if !isLifecycleCommand(c.Body) {
+		return nil
+	}
+
+	evt, err := newCommentEvent(ctx, bot.poller.cli, org, repo, commentKind, c)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	// The comment is polled again, so it is not written to the unfinished events file on the shutdown
+	_, err = bot.handleEventFrom(evt, bot.log.WithFields(*evt.CollectLoggingFields()), true)
+	return err
+}
+
+// newCommentEvent builds the event of the listed comment as the webhook would deliver it.
+// The GUID of the event is derived from the comment, so a comment listed twice is dropped as a redelivery.
+func newCommentEvent(ctx context.Context, cli commentLister, org, repo, commentKind string, c *polledComment) (
+	*client.GenericEvent, error) {
+	state, author, err := cli.GetItem(ctx, org, repo, commentKind, c.Number)
+	if err != nil {
+		return nil, err
+	}
+
+	id := strconv.FormatInt(c.ID, 10)
+	strs := []string{
+		framework.NoteEvent, "comment-" + commentKind + "-" + id, org, repo, c.Number,
+		commentKind, c.Body, c.Commenter, author, state, id,
+	}
+	return &client.GenericEvent{
+		EventType: &strs[0], EventGUID: &strs[1], Org: &strs[2], Repo: &strs[3], Number: &strs[4],
+		CommentKind: &strs[5], Comment: &strs[6], Commenter: &strs[7], Author: &strs[8], State: &strs[9],
+		CommentID: &strs[10],
+	}, nil
+}
+
+// isLifecycleCommand reports if the comment is a command which the robot handles
+func isLifecycleCommand(comment string) bool {
+	comment = strings.TrimSpace(comment)
+	return regexpCloseComment.MatchString(comment) || regexpReopenComment.MatchString(comment)
+}
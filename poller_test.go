@@ -0,0 +1,206 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeLister serves the comments of one repository in pages
+type fakeLister struct {
+	comments map[string][]polledComment
+	pages    int
+}
+
+func (l *fakeLister) ListComments(_ context.Context, org, repo, commentKind string, since time.Time, page, perPage int) (
+	[]polledComment, error) {
+	l.pages++
+	var items []polledComment
+	for _, c := range l.comments[commentKind] {
+		if !c.CreatedAt.Before(since) {
+			items = append(items, c)
+		}
+	}
+	start, end := min((page-1)*perPage, len(items)), min(page*perPage, len(items))
+	return items[start:end], nil
+}
+
+func (l *fakeLister) GetItem(_ context.Context, org, repo, commentKind, number string) (string, string, error) {
+	if number == "404" {
+		return "", "", &apiError{kind: errNotFound, op: "GetItem", status: http.StatusNotFound}
+	}
+	return "opened", "author1", nil
+}
+
+func TestPollComments(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	st := newTestStore(t)
+	lister := &fakeLister{comments: map[string][]polledComment{}}
+	p, err := newPoller(lister, st, &pollingConfig{Repos: []string{"owner1/repo1"}, PageSize: 2})
+	assert.Equal(t, nil, err)
+	p.now = func() time.Time { return now }
+
+	mc := &mockClient{successfulCheckPermission: true, permission: true, successfulUpdateIssue: true}
+	bot := newShutdownTestRobot(t, mc)
+	bot.poller = p
+
+	// the first poll only sets the watermark
+	lister.comments[client.CommentOnIssue] = []polledComment{
+		{ID: 1, Number: "1", Body: "/close", Commenter: "maintainer1", CreatedAt: now.Add(-time.Hour)},
+	}
+	assert.Equal(t, nil, bot.pollComments("owner1", "repo1", client.CommentOnIssue))
+	assert.Equal(t, "", mc.method)
+
+	lister.comments[client.CommentOnIssue] = append(lister.comments[client.CommentOnIssue],
+		polledComment{ID: 2, Number: "404", Body: "/close", Commenter: "maintainer1", CreatedAt: now},
+		polledComment{ID: 3, Number: "2", Body: "looks good", Commenter: "user1", CreatedAt: now.Add(time.Minute)},
+		polledComment{ID: 4, Number: "3", Body: "/close", Commenter: "maintainer1", CreatedAt: now.Add(time.Minute)},
+	)
+	assert.Equal(t, nil, bot.pollComments("owner1", "repo1", client.CommentOnIssue))
+	assert.Equal(t, "UpdateIssue", mc.method)
+	assert.Equal(t, 2, lister.pages)
+
+	w, ok, err := p.watermark("owner1/repo1/" + client.CommentOnIssue)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, pollWatermark{Since: now.Add(time.Minute), LastID: 4}, w)
+
+	// the restarted poller doesn't replay the handled comments
+	p, err = newPoller(lister, st, &pollingConfig{Repos: []string{"owner1/repo1"}})
+	assert.Equal(t, nil, err)
+	bot = newShutdownTestRobot(t, mc)
+	bot.poller = p
+	mc.method = ""
+	assert.Equal(t, nil, bot.pollComments("owner1", "repo1", client.CommentOnIssue))
+	assert.Equal(t, "", mc.method)
+}
+
+func TestPollCommentsFailure(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	st := newTestStore(t)
+	lister := &fakeLister{comments: map[string][]polledComment{}}
+	p, err := newPoller(lister, st, &pollingConfig{Repos: []string{"owner1/repo1"}})
+	assert.Equal(t, nil, err)
+	p.now = func() time.Time { return now.Add(-time.Hour) }
+
+	mc := &mockClient{successfulCheckPermission: true, permission: true, successfulUpdateIssue: true}
+	bot := newShutdownTestRobot(t, mc)
+	bot.poller = p
+	bot.queue = newSerialQueue(&queueConfig{}, nil)
+	// no event waits behind the running one
+	bot.queue.maxPending = 0
+	assert.Equal(t, nil, bot.pollComments("owner1", "repo1", client.CommentOnIssue))
+
+	// the command dropped by the full queue stays after the watermark
+	lister.comments[client.CommentOnIssue] = []polledComment{
+		{ID: 1, Number: "3", Body: "/close", Commenter: "maintainer1", CreatedAt: now},
+		{ID: 2, Number: "4", Body: "/close", Commenter: "maintainer1", CreatedAt: now.Add(time.Minute)},
+	}
+	assert.Equal(t, nil, bot.queue.acquire("owner1/repo1#3"))
+	assert.Equal(t, errQueueFull, bot.pollComments("owner1", "repo1", client.CommentOnIssue))
+	assert.Equal(t, "", mc.method)
+	w, _, err := p.watermark("owner1/repo1/" + client.CommentOnIssue)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, pollWatermark{Since: now.Add(-time.Hour)}, w)
+
+	// the next poll handles it
+	bot.queue.release("owner1/repo1#3")
+	assert.Equal(t, nil, bot.pollComments("owner1", "repo1", client.CommentOnIssue))
+	assert.Equal(t, "UpdateIssue", mc.method)
+	w, _, err = p.watermark("owner1/repo1/" + client.CommentOnIssue)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, pollWatermark{Since: now.Add(time.Minute), LastID: 2}, w)
+}
+
+func TestPollingConfig(t *testing.T) {
+	testCases := []struct {
+		desc string
+		cnf  pollingConfig
+		err  string
+	}{
+		{
+			"valid config",
+			pollingConfig{Repos: []string{"owner1/repo1"}, Interval: 30},
+			"",
+		},
+		{
+			"the repo has no org",
+			pollingConfig{Repos: []string{"repo1"}},
+			"invalid repo in the polling repos: repo1",
+		},
+		{
+			"negative page size",
+			pollingConfig{PageSize: -1},
+			"the polling interval and page_size can not be negative",
+		},
+	}
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			err := testCases[i].cnf.validate()
+			if testCases[i].err == "" {
+				assert.Equal(t, nil, err)
+			} else {
+				assert.Equal(t, testCases[i].err, err.Error())
+			}
+		})
+	}
+
+	_, err := newPoller(&fakeLister{}, nil, &pollingConfig{})
+	assert.Equal(t, "the polling requires the store to keep the watermarks, set --store-path", err.Error())
+}
+
+func TestGitcodeClientListComments(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fakeForgeAPIPath + "repos/owner1/repo1/issues/comments":
+			assert.Equal(t, "2024-05-01T00:00:00Z", r.URL.Query().Get("since"))
+			assert.Equal(t, "20", r.URL.Query().Get("per_page"))
+			_, _ = fmt.Fprint(w, `[{"id":7,"body":"/close","created_at":"2024-05-01T00:01:00Z",
+				"user":{"login":"maintainer1"},"target":{"issue":{"number":"5"}}}]`)
+		case fakeForgeAPIPath + "repos/owner1/repo1/pulls/comments":
+			_, _ = fmt.Fprint(w, `[{"id":8,"body":"/close","created_at":"2024-05-01T00:02:00Z",
+				"user":{"login":"maintainer1"},"target":{"pull_request":{"number":6}}}]`)
+		case fakeForgeAPIPath + "repos/owner1/repo1/pulls/6":
+			_, _ = fmt.Fprint(w, `{"state":"open","user":{"login":"author1"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	cli := newForgeClient(srv.URL, &configuration{}, logrus.NewEntry(logger))
+	since := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	comments, err := cli.ListComments(context.Background(), "owner1", "repo1", client.CommentOnIssue, since, 1, 20)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []polledComment{{ID: 7, Number: "5", Body: "/close", Commenter: "maintainer1",
+		CreatedAt: since.Add(time.Minute)}}, comments)
+
+	comments, err = cli.ListComments(context.Background(), "owner1", "repo1", client.CommentOnPR, since, 1, 20)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "6", comments[0].Number)
+
+	state, author, err := cli.GetItem(context.Background(), "owner1", "repo1", client.CommentOnPR, "6")
+	assert.Equal(t, []interface{}{"opened", "author1", nil}, []interface{}{state, author, err})
+}
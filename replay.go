@@ -0,0 +1,186 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/utils"
+	sutils "github.com/opensourceways/server-common-lib/utils"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"slices"
+)
+
+const replayCommand = "replay"
+
+// replayFixture holds the recorded responses of the platform API used by the replay command.
+// A lookup which is not recorded is replayed as a failed request.
+type replayFixture struct {
+	// Permissions maps org/repo/username to the result of the permission check
+	Permissions map[string]bool `json:"permissions,omitempty"`
+	// LinkedPullRequests maps org/repo/number to the number of the linking pull requests of the issue
+	LinkedPullRequests map[string]int `json:"linked_pull_requests,omitempty"`
+	// States maps org/repo/number to the current state of the issue or pull request
+	States map[string]string `json:"states,omitempty"`
+	// FailedUpdates lists the org/repo/number whose state update fails
+	FailedUpdates []string `json:"failed_updates,omitempty"`
+}
+
+// fixtureClient answers the calls of the robot with the recorded responses and traces every call
+type fixtureClient struct {
+	fixture *replayFixture
+	out     io.Writer
+}
+
+func (c *fixtureClient) tracef(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(c.out, "  api: "+format+"\n", args...)
+}
+
+// errNotRecorded is the error of a request whose response is not recorded in the fixture
+var errNotRecorded = errors.New("the response is not recorded in the fixture")
+
+// result returns nil if the response of the request is recorded, otherwise it fails as a transient error
+func (c *fixtureClient) result(recorded bool, op string) error {
+	if recorded {
+		return nil
+	}
+	return newTransientError(op, errNotRecorded)
+}
+
+func (c *fixtureClient) CreatePRComment(_ context.Context, org, repo, number, comment string) error {
+	c.tracef("CreatePRComment %s/%s#%s %q", org, repo, number, comment)
+	return nil
+}
+
+func (c *fixtureClient) CreateIssueComment(_ context.Context, org, repo, number, comment string) error {
+	c.tracef("CreateIssueComment %s/%s#%s %q", org, repo, number, comment)
+	return nil
+}
+
+func (c *fixtureClient) CheckPermission(_ context.Context, org, repo, username string) (bool, error) {
+	pass, success := c.fixture.Permissions[org+"/"+repo+"/"+username]
+	c.tracef("CheckPermission %s/%s %s => pass=%t success=%t", org, repo, username, pass, success)
+	return pass, c.result(success, "CheckPermission")
+}
+
+func (c *fixtureClient) UpdateIssue(_ context.Context, org, repo, number, state string) error {
+	success := !slices.Contains(c.fixture.FailedUpdates, org+"/"+repo+"/"+number)
+	c.tracef("UpdateIssue %s/%s#%s %s => success=%t", org, repo, number, state, success)
+	return c.result(success, "UpdateIssue")
+}
+
+func (c *fixtureClient) UpdatePR(_ context.Context, org, repo, number, state string) error {
+	success := !slices.Contains(c.fixture.FailedUpdates, org+"/"+repo+"/"+number)
+	c.tracef("UpdatePR %s/%s#%s %s => success=%t", org, repo, number, state, success)
+	return c.result(success, "UpdatePR")
+}
+
+func (c *fixtureClient) GetIssueState(_ context.Context, org, repo, number string) (string, error) {
+	state, success := c.fixture.States[org+"/"+repo+"/"+number]
+	c.tracef("GetIssueState %s/%s#%s => state=%q success=%t", org, repo, number, state, success)
+	return state, c.result(success, "GetIssueState")
+}
+
+func (c *fixtureClient) GetPRState(_ context.Context, org, repo, number string) (string, error) {
+	state, success := c.fixture.States[org+"/"+repo+"/"+number]
+	c.tracef("GetPRState %s/%s#%s => state=%q success=%t", org, repo, number, state, success)
+	return state, c.result(success, "GetPRState")
+}
+
+func (c *fixtureClient) GetIssueLinkedPRNumber(_ context.Context, org, repo, number string) (int, error) {
+	num, success := c.fixture.LinkedPullRequests[org+"/"+repo+"/"+number]
+	c.tracef("GetIssueLinkedPRNumber %s/%s#%s => num=%d success=%t", org, repo, number, num, success)
+	return num, c.result(success, "GetIssueLinkedPRNumber")
+}
+
+// tracef writes a line of the decision trace when the robot is replaying events
+func (bot *robot) tracef(format string, args ...interface{}) {
+	if bot.trace != nil {
+		_, _ = fmt.Fprintf(bot.trace, "  "+format+"\n", args...)
+	}
+}
+
+func (bot *robot) traceAction(a *plannedAction) {
+	if bot.trace == nil {
+		return
+	}
+
+	switch a.Kind {
+	case actionKindUpdateIssue, actionKindUpdatePR:
+		bot.tracef("action: %s(%s)", a.Kind, a.State)
+	case actionKindComment:
+		bot.tracef("action: %s(%s)", a.Kind, a.Template)
+	default:
+		bot.tracef("action: %s(%s)", a.Kind, a.Reason)
+	}
+}
+
+// runReplay runs the webhook payloads through handleCommentEvent with the recorded API responses,
+// and prints the decision trace of every event. It never accesses the network.
+func runReplay(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(replayCommand, flag.ContinueOnError)
+	fs.SetOutput(out)
+	configFile := fs.String("config-file", "", "Path to the configuration file of the robot.")
+	fixtureFile := fs.String("fixture", "", "Path to the recorded responses of the platform API.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *configFile == "" || fs.NArg() == 0 {
+		return errors.New("usage: replay --config-file=<config> [--fixture=<fixture>] <event.json>...")
+	}
+
+	cnf := &configuration{}
+	if err := sutils.LoadFromYaml(*configFile, cnf); err != nil {
+		return err
+	}
+	if err := cnf.Validate(); err != nil {
+		return err
+	}
+
+	fixture := &replayFixture{}
+	if *fixtureFile != "" {
+		if err := sutils.LoadFromYaml(*fixtureFile, fixture); err != nil {
+			return err
+		}
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	bot := &robot{cli: &fixtureClient{fixture: fixture, out: out}, cnf: cnf, trace: out}
+	for _, file := range fs.Args() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		evt := new(client.GenericEvent)
+		if err = json.Unmarshal(data, evt); err != nil {
+			return fmt.Errorf("invalid event %s: %w", file, err)
+		}
+
+		_, _ = fmt.Fprintf(out, "event %s (%s) from %s\n", utils.GetString(evt.EventGUID), utils.GetString(evt.EventType), file)
+		bot.tracef("comment %q by %s on the %s %s/%s#%s",
+			utils.GetString(evt.Comment), utils.GetString(evt.Commenter), utils.GetString(evt.CommentKind),
+			utils.GetString(evt.Org), utils.GetString(evt.Repo), utils.GetString(evt.Number))
+		bot.handleCommentEvent(evt, cnf, logrus.NewEntry(logger))
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestRunReplay(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := runReplay([]string{
+		"--config-file=" + findTestdata(t, configYaml),
+		"--fixture=" + findTestdata(t, "replay/fixture.yaml"),
+		findTestdata(t, "replay/close_issue.json"),
+		findTestdata(t, "replay/close_unlinked_issue.json"),
+		findTestdata(t, "note_event.json"),
+	}, out)
+	assert.Equal(t, nil, err)
+
+	trace := out.String()
+	for _, line := range []string{
+		"matched repo config: repos=[owner1 owner2/repo1]",
+		"api: CheckPermission owner1/repo1 maintainer1 => pass=true success=true",
+		"command: /close on owner1/repo1#5 by the collaborator, policy: allowed",
+		"action: UpdateIssue(closed)",
+		"api: GetIssueState owner1/repo1#5 => state=\"opened\" success=true",
+		"api: UpdateIssue owner1/repo1#5 closed => success=true",
+		"command: /close on owner3/repo3#7 by the author, policy: needs-link-pr",
+		"action: Comment(comment_issue_needs_link_pr)",
+		"api: CreateIssueComment owner3/repo3#7",
+		"no repo config matches openUBMC-test/security-configure",
+	} {
+		assert.Equal(t, true, strings.Contains(trace, line), line)
+	}
+}
+
+func TestRunReplayArgs(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := runReplay([]string{"--config-file=" + findTestdata(t, configYaml)}, out)
+	assert.Equal(t, errors.New("usage: replay --config-file=<config> [--fixture=<fixture>] <event.json>..."), err)
+
+	err = runReplay([]string{"--config-file=" + findTestdata(t, "config1.yaml"), "event.json"}, out)
+	assert.Equal(t, errors.New("the repositories configuration can not be empty"), err)
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts     = 3
+	defaultRetryInitialInterval = 1
+	defaultRetryMaxInterval     = 30
+)
+
+// retryConfig configures the retries of the requests which change the state on the platform
+type retryConfig struct {
+	// MaxAttempts is the number of attempts including the first one, it is 3 by default.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// InitialInterval is the backoff in seconds after the first failed attempt, it is 1 by default.
+	InitialInterval int `json:"initial_interval,omitempty"`
+	// MaxInterval bounds the backoff in seconds, it is 30 by default.
+	MaxInterval int `json:"max_interval,omitempty"`
+}
+
+func (c *retryConfig) validate() error {
+	if c.MaxAttempts < 0 || c.InitialInterval < 0 || c.MaxInterval < 0 {
+		return errors.New("the retry max_attempts, initial_interval and max_interval can not be negative")
+	}
+	if c.MaxInterval != 0 && c.InitialInterval > c.MaxInterval {
+		return errors.New("the retry initial_interval can not be greater than max_interval")
+	}
+	return nil
+}
+
+// retrier retries a failed request with an exponential backoff and jitter
+type retrier struct {
+	maxAttempts int
+	initial     time.Duration
+	max         time.Duration
+	// sleep waits for d, it returns early with the error of ctx when ctx is done
+	sleep func(ctx context.Context, d time.Duration) error
+	now   func() time.Time
+	// jitter returns a random duration in [0, d)
+	jitter func(d time.Duration) time.Duration
+}
+
+func newRetrier(c *retryConfig) *retrier {
+	r := &retrier{
+		maxAttempts: c.MaxAttempts,
+		initial:     time.Duration(c.InitialInterval) * time.Second,
+		max:         time.Duration(c.MaxInterval) * time.Second,
+		sleep:       sleepContext,
+		now:         time.Now,
+		jitter: func(d time.Duration) time.Duration {
+			return time.Duration(rand.Int63n(int64(d)))
+		},
+	}
+	if r.maxAttempts == 0 {
+		r.maxAttempts = defaultRetryMaxAttempts
+	}
+	if r.initial == 0 {
+		r.initial = defaultRetryInitialInterval * time.Second
+	}
+	if r.max == 0 {
+		r.max = defaultRetryMaxInterval * time.Second
+	}
+	if r.initial > r.max {
+		r.initial = r.max
+	}
+
+	return r
+}
+
+// backoff returns the interval before the next attempt, n is the number of the failed attempts.
+// The interval doubles on every failure, and a half of it is random.
+func (r *retrier) backoff(n int) time.Duration {
+	d := r.initial
+	for i := 1; i < n && d < r.max; i++ {
+		d *= 2
+	}
+	if d > r.max {
+		d = r.max
+	}
+
+	half := d / 2
+	return half + r.jitter(d-half)
+}
+
+// do calls fn until it succeeds, fails with an error which is not retryable or the attempts are used up,
+// and returns the last error. A rate limited request waits until the limit is reset, unless it is reset
+// later than the max interval. It stops waiting when ctx is done. A nil retrier calls fn once.
+func (r *retrier) do(ctx context.Context, fn func() error) error {
+	if r == nil {
+		return fn()
+	}
+
+	for n := 1; ; n++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || n >= r.maxAttempts {
+			return err
+		}
+
+		d := r.backoff(n)
+		if reset, ok := r.untilReset(err); ok {
+			if reset > r.max {
+				return err
+			}
+			d = max(d, reset)
+		}
+		if r.sleep(ctx, d) != nil {
+			return err
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *retrier) untilReset(err error) (time.Duration, bool) {
+	resetAt, ok := rateLimitReset(err)
+	if !ok {
+		return 0, false
+	}
+	return resetAt.Sub(r.now()), true
+}
@@ -0,0 +1,229 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetryConfigValidate(t *testing.T) {
+	c := &retryConfig{MaxAttempts: -1}
+	assert.Equal(t, errors.New("the retry max_attempts, initial_interval and max_interval can not be negative"), c.validate())
+
+	c = &retryConfig{InitialInterval: 10, MaxInterval: 5}
+	assert.Equal(t, errors.New("the retry initial_interval can not be greater than max_interval"), c.validate())
+}
+
+func TestRetrierBackoff(t *testing.T) {
+	r := newRetrier(&retryConfig{InitialInterval: 2, MaxInterval: 10})
+	// no jitter
+	r.jitter = func(d time.Duration) time.Duration { return 0 }
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second},
+		[]time.Duration{r.backoff(1), r.backoff(2), r.backoff(3), r.backoff(4)})
+
+	// full jitter
+	r.jitter = func(d time.Duration) time.Duration { return d - 1 }
+	assert.Equal(t, 2*time.Second-1, r.backoff(1))
+	assert.Equal(t, 10*time.Second-1, r.backoff(5))
+}
+
+func TestRetrierDo(t *testing.T) {
+	now := time.Date(2024, 12, 15, 10, 0, 0, 0, time.UTC)
+	transient := newTransientError("UpdateIssue", errors.New("connection reset"))
+	rateLimited := func(reset time.Duration) error {
+		return &apiError{kind: errRateLimited, op: "UpdateIssue", status: 429, resetAt: now.Add(reset)}
+	}
+
+	testCases := []struct {
+		desc   string
+		errs   []error
+		out    error
+		calls  int
+		sleeps []time.Duration
+	}{
+		{"the first attempt succeeds", nil, nil, 1, nil},
+		{
+			"the third attempt succeeds",
+			[]error{transient, transient},
+			nil,
+			3,
+			[]time.Duration{time.Second / 2, time.Second},
+		},
+		{
+			"the attempts are used up",
+			[]error{transient, transient, transient},
+			transient,
+			3,
+			[]time.Duration{time.Second / 2, time.Second},
+		},
+		{
+			"the forbidden request is not retried",
+			[]error{&apiError{kind: errForbidden, op: "UpdateIssue", status: 403}},
+			&apiError{kind: errForbidden, op: "UpdateIssue", status: 403},
+			1,
+			nil,
+		},
+		{
+			"the rate limited request waits until the limit is reset",
+			[]error{rateLimited(5 * time.Second)},
+			nil,
+			2,
+			[]time.Duration{5 * time.Second},
+		},
+		{
+			"the rate limit is reset later than the max interval",
+			[]error{rateLimited(time.Minute)},
+			rateLimited(time.Minute),
+			1,
+			nil,
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			r := newRetrier(&retryConfig{})
+			r.now = func() time.Time { return now }
+			r.jitter = func(d time.Duration) time.Duration { return 0 }
+			var sleeps []time.Duration
+			r.sleep = func(_ context.Context, d time.Duration) error {
+				sleeps = append(sleeps, d)
+				return nil
+			}
+
+			calls := 0
+			err := r.do(context.Background(), func() error {
+				calls++
+				if calls <= len(testCases[i].errs) {
+					return testCases[i].errs[calls-1]
+				}
+				return nil
+			})
+			assert.Equal(t, testCases[i].out, err)
+			assert.Equal(t, testCases[i].calls, calls)
+			assert.Equal(t, testCases[i].sleeps, sleeps)
+		})
+	}
+
+	var r *retrier
+	assert.Equal(t, transient, r.do(context.Background(), func() error { return transient }))
+}
+
+func TestExecutePlanUpdateFailure(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		failure error
+		// state is the current state read again after the conflict
+		state   string
+		method  string
+		outcome string
+		comment string
+	}{
+		{
+			"the issue was deleted, nothing is commented",
+			&apiError{kind: errNotFound, op: "UpdateIssue", status: 404},
+			"",
+			"UpdateIssue",
+			outcomeFailure,
+			"",
+		},
+		{
+			"the token lacks the permission",
+			&apiError{kind: errForbidden, op: "UpdateIssue", status: 403},
+			"",
+			"CreateIssueComment",
+			outcomeFailure,
+			"@commenter1 the robot can't close",
+		},
+		{
+			"the issue was closed by someone else at the same time",
+			&apiError{kind: errConflict, op: "UpdateIssue", status: 409},
+			"closed",
+			"GetIssueState",
+			outcomeSkipped,
+			"",
+		},
+		{
+			"the update conflicts with the issue which is still opened",
+			&apiError{kind: errConflict, op: "UpdateIssue", status: 409},
+			"opened",
+			"CreateIssueComment",
+			outcomeFailure,
+			"@commenter1 fail to close",
+		},
+		{
+			"the rate limit is exceeded on every attempt",
+			&apiError{kind: errRateLimited, op: "UpdateIssue", status: 429},
+			"",
+			"CreateIssueComment",
+			outcomeFailure,
+			"@commenter1 fail to close",
+		},
+		{
+			"the platform is unavailable on every attempt",
+			&apiError{kind: errTransient, op: "UpdateIssue", status: 503},
+			"",
+			"CreateIssueComment",
+			outcomeFailure,
+			"@commenter1 fail to close",
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			mc := &mockClient{successfulCreateIssueComment: true, successfulGetState: true,
+				state: testCases[i].state, failure: testCases[i].failure}
+			bot := &robot{cli: mc, cnf: &configuration{
+				CommentUpdateStateFailure:   "@__commenter__ fail to __action__",
+				CommentUpdateStateForbidden: "@__commenter__ the robot can't __action__",
+			}, retry: newRetrier(&retryConfig{})}
+			bot.retry.sleep = noSleep
+
+			c, kind := commenter, client.CommentOnIssue
+			evt := &client.GenericEvent{Commenter: &c, CommentKind: &kind}
+			plan := newLifecyclePlan(org, repo, number, kind, actionClose)
+			plan.add(plannedAction{Kind: actionKindUpdateIssue, State: "closed"})
+
+			rec := bot.executePlan(context.Background(), evt, plan)
+			assert.Equal(t, testCases[i].outcome, rec.Outcome)
+			// the failure is reported to the commenter unless nothing is left to do
+			assert.Equal(t, testCases[i].method, mc.method)
+			assert.Equal(t, testCases[i].comment, mc.comment)
+		})
+	}
+}
+
+func noSleep(context.Context, time.Duration) error {
+	return nil
+}
+
+func TestRetrierDoCanceled(t *testing.T) {
+	r := newRetrier(&retryConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	transient := newTransientError("UpdateIssue", errors.New("connection reset"))
+	err := r.do(ctx, func() error {
+		calls++
+		// the robot shuts down while the request is failing
+		cancel()
+		return transient
+	})
+	assert.Equal(t, transient, err)
+	assert.Equal(t, 1, calls)
+}
@@ -14,38 +14,160 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/opensourceways/robot-framework-lib/client"
 	"github.com/opensourceways/robot-framework-lib/config"
 	"github.com/opensourceways/robot-framework-lib/framework"
 	"github.com/opensourceways/robot-framework-lib/utils"
 	"github.com/sirupsen/logrus"
+	"io"
+	"time"
 )
 
-// iClient is an interface that defines methods for client-side interactions
+// iClient is an interface that defines methods for client-side interactions.
+// The errors returned are classified by errNotFound, errForbidden, errRateLimited, errConflict and errTransient.
+// The calls are canceled with ctx, which carries the deadline and the GUID of the event.
 type iClient interface {
 	// CreatePRComment creates a comment for a pull request in a specified organization and repository
-	CreatePRComment(org, repo, number, comment string) (success bool)
+	CreatePRComment(ctx context.Context, org, repo, number, comment string) error
 	// CreateIssueComment creates a comment for an issue in a specified organization and repository
-	CreateIssueComment(org, repo, number, comment string) (success bool)
+	CreateIssueComment(ctx context.Context, org, repo, number, comment string) error
 	// CheckPermission checks the permission of a user for a specified repository
-	CheckPermission(org, repo, username string) (pass, success bool)
+	CheckPermission(ctx context.Context, org, repo, username string) (pass bool, err error)
 	// UpdateIssue updates the state of an issue in a specified organization and repository
-	UpdateIssue(org, repo, number, state string) (success bool)
+	UpdateIssue(ctx context.Context, org, repo, number, state string) error
 	// UpdatePR updates the state of a pull request in a specified organization and repository
-	UpdatePR(org, repo, number, state string) (success bool)
+	UpdatePR(ctx context.Context, org, repo, number, state string) error
+	// GetIssueState retrieves the current state of an issue, it is opened or closed
+	GetIssueState(ctx context.Context, org, repo, number string) (state string, err error)
+	// GetPRState retrieves the current state of a pull request, such as opened, closed or merged
+	GetPRState(ctx context.Context, org, repo, number string) (state string, err error)
 	// GetIssueLinkedPRNumber retrieves the number of a pull request linked to a specified issue
-	GetIssueLinkedPRNumber(org, repo, number string) (num int, success bool)
+	GetIssueLinkedPRNumber(ctx context.Context, org, repo, number string) (num int, err error)
+}
+
+// platformClient sends every request to the platform with the token of the robot
+type platformClient interface {
+	iClient
+	commentLister
+	issueLister
+	sigLister
 }
 
 type robot struct {
-	cli iClient
-	cnf *configuration
-	log *logrus.Entry
+	cli      iClient
+	cnf      *configuration
+	log      *logrus.Entry
+	audit    auditSink
+	history  *lifecycleHistory
+	dedup    *eventDeduper
+	queue    *serialQueue
+	retry    *retrier
+	inflight *eventTracker
+	// unfinished keeps the events left to the next instance on the shutdown
+	unfinished *unfinishedEvents
+	// publishing tracks the lifecycle events being published to the sinks
+	publishing *publishers
+	// actions delivers the changes on the platform when the action queue is enabled
+	actions *actionQueue
+	// permissions caches the permission lookups of the client, it is nil if the cache is disabled
+	permissions *permissionCache
+	// poller polls the comments of the repositories without webhooks, it is nil if no repository is polled
+	poller *poller
+	// journal records the handled comments, the backfill skips them. It is nil without the store.
+	journal *commentJournal
+	// comments lists the comments for the backfill
+	comments commentLister
+	// issues lists the closed issues for the policy audit
+	issues issueLister
+	// sigs looks up the sigs whose channels receive the chat messages
+	sigs sigLister
+	// guard stops the close guard from looping with the robot's own transitions
+	guard *closeGuard
+	// ctx is canceled on the graceful shutdown, the contexts of the events are derived from it
+	ctx    context.Context
+	cancel context.CancelFunc
+	// dryRun makes every repository run in the shadow mode
+	dryRun bool
+	// shadow is set on the copy of the robot which handles an event in the shadow mode
+	shadow bool
+	// trace receives the decision trace of every event, it is only set by the replay command
+	trace io.Writer
+}
+
+// newRobot creates the robot, the history of transitions is only kept when st is not nil
+func newRobot(c *configuration, token []byte, opt *robotOptions, st *store) (*robot, error) {
+	cli, err := newPlatformClient(c, token, framework.NewLogger().WithField("component", component))
+	if err != nil {
+		return nil, err
+	}
+
+	return newRobotWithClient(c, cli, opt, st)
+}
+
+// newPlatformClient creates the client of the platform, the sigs are looked up with the client of
+// robot-framework-lib, which is nil if the token is invalid
+func newPlatformClient(c *configuration, token []byte, logger *logrus.Entry) (*gitcodeClient, error) {
+	lib := client.NewClient(token, logger)
+	if lib == nil {
+		return nil, errors.New("failed to create the client of the platform, the token may be invalid")
+	}
+
+	return newGitcodeClient(c, lib, token, logger), nil
 }
 
-func newRobot(c *configuration, token []byte) *robot {
-	logger := framework.NewLogger().WithField("component", component)
-	return &robot{cli: client.NewClient(token, logger), cnf: c, log: logger}
+// newRobotWithClient creates the robot which requests the platform with cli
+func newRobotWithClient(c *configuration, cli *gitcodeClient, opt *robotOptions, st *store) (*robot, error) {
+	logger := cli.log
+	sink, err := newAuditSink(&c.Audit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every request shares the limits of the token
+	limited := newLimitedClient(cli, &c.RateLimit, &c.CircuitBreaker)
+	bot := &robot{
+		cli:         limited,
+		cnf:         c,
+		log:         logger,
+		audit:       sink,
+		permissions: cli.cache,
+		comments:    limited,
+		issues:      limited,
+		sigs:        limited,
+		guard:       newCloseGuard(),
+		dryRun:      opt.dryRun,
+	}
+	if st != nil {
+		if bot.history, err = newLifecycleHistory(st); err != nil {
+			return nil, err
+		}
+		if bot.journal, err = newCommentJournal(st); err != nil {
+			return nil, err
+		}
+		if c.ActionQueue.Enabled {
+			if bot.actions, err = newActionQueue(st, &c.ActionQueue); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if bot.dedup, err = newEventDeduper(&c.EventDedup, st); err != nil {
+		return nil, err
+	}
+	if len(c.Polling.Repos) > 0 {
+		if bot.poller, err = newPoller(limited, st, &c.Polling); err != nil {
+			return nil, err
+		}
+	}
+	bot.queue = newSerialQueue(&c.EventQueue, queueMetrics)
+	bot.retry = newRetrier(&c.Retry)
+	bot.ctx, bot.cancel = context.WithCancel(context.Background())
+	bot.inflight = newEventTracker()
+	bot.publishing = &publishers{}
+	bot.unfinished = &unfinishedEvents{path: opt.unfinishedEventsPath}
+
+	return bot, nil
 }
 
 func (bot *robot) GetConfigmap() config.Configmap {
@@ -55,6 +177,20 @@ func (bot *robot) GetConfigmap() config.Configmap {
 func (bot *robot) RegisterEventHandler(p framework.HandlerRegister) {
 	p.RegisterIssueCommentHandler(bot.handleCommentEvent)
 	p.RegisterPullRequestCommentHandler(bot.handleCommentEvent)
+	p.RegisterIssueHandler(bot.handleIssueEvent)
+}
+
+// registerEventOutcomeHandlers registers the same handlers as RegisterEventHandler, but they report if
+// the event is done, so the consumer mode only commits the events which are handled
+func (bot *robot) registerEventOutcomeHandlers(h *eventHandlers) {
+	handle := func(evt *client.GenericEvent, logger *logrus.Entry) error {
+		// The consumed event is redelivered by Kafka if it is not committed
+		_, err := bot.handleEventFrom(evt, logger, true)
+		return err
+	}
+	h.issueComment = handle
+	h.pullRequestComment = handle
+	h.issue = handle
 }
 
 func (bot *robot) GetLogger() *logrus.Entry {
@@ -62,19 +198,102 @@ func (bot *robot) GetLogger() *logrus.Entry {
 }
 
 func (bot *robot) handleCommentEvent(evt *client.GenericEvent, cnf config.Configmap, logger *logrus.Entry) {
+	bot.handleEvent(evt, logger)
+}
+
+// handleEvent handles the comment event or the issue event, it returns the audit record of the decision,
+// or nil if the event has no command or is not handled. The error is returned if the event is dropped
+// before it is handled, errEventInterrupted if it is left to the next instance on the shutdown.
+func (bot *robot) handleEvent(evt *client.GenericEvent, logger *logrus.Entry) (*auditRecord, error) {
+	return bot.handleEventFrom(evt, logger, false)
+}
+
+// handleEventFrom handles the event as handleEvent does. The redeliverable event is delivered again by its
+// source if it is not done, so it is not written to the unfinished events file when it is interrupted.
+func (bot *robot) handleEventFrom(evt *client.GenericEvent, logger *logrus.Entry, redeliverable bool) (
+	*auditRecord, error) {
+	// The event arriving after the unfinished events are listed on the shutdown is left to the next instance
+	if !bot.inflight.add(evt, redeliverable) {
+		if redeliverable {
+			return nil, errEventInterrupted
+		}
+		if err := bot.unfinished.append([]*client.GenericEvent{evt}); err != nil {
+			logger.WithError(err).Error("failed to record the unfinished event " + utils.GetString(evt.EventGUID))
+		}
+		return nil, errEventInterrupted
+	}
+	defer bot.inflight.done(evt)
+
+	// Drops the webhook redelivered by the platform or retried by the load balancer
+	guid := utils.GetString(evt.EventGUID)
+	if prev, dup := bot.dedup.begin(guid); dup {
+		if prev == nil {
+			logger.Infof("drop the redelivered event %s, it is still being handled", guid)
+		} else {
+			logger.Infof("drop the redelivered event %s, it was handled at %s: command=%q policy=%q outcome=%q",
+				guid, prev.HandledAt.Format(time.RFC3339), prev.Command, prev.Policy, prev.Outcome)
+		}
+		return nil, nil
+	}
+
+	// Handles the events of an issue or pull request one by one, so a quick /close and /reopen
+	// don't change the state at the same time, each of them sees the state left by the other
+	var rec *auditRecord
+	key := utils.GetString(evt.Org) + "/" + utils.GetString(evt.Repo) + "#" + utils.GetString(evt.Number)
+	err := bot.queue.do(key, func() {
+		// The event waiting in the queue is left to the next instance on the shutdown
+		if bot.interrupted() {
+			return
+		}
+		ctx, cancel := bot.eventContext(guid)
+		defer cancel()
+		if utils.GetString(evt.EventType) == framework.IssueEvent {
+			rec = bot.guardIssueClose(ctx, evt, logger)
+		} else {
+			rec = bot.handleLifecycleCommand(ctx, evt, logger)
+		}
+	})
+	if err != nil {
+		logger.WithError(err).Errorf("drop the event %s of %s", guid, key)
+		bot.dedup.forget(guid)
+		return nil, err
+	}
+	// The event canceled on the shutdown is written to the unfinished events file,
+	// it must not be dropped as a redelivered one when the next instance handles it
+	if bot.interrupted() {
+		bot.dedup.forget(guid)
+		return nil, errEventInterrupted
+	}
+
+	if err := bot.dedup.finish(guid, newHandledEvent(rec)); err != nil {
+		logger.WithError(err).Error("failed to record the handled event " + guid)
+	}
+	if err := bot.journal.record(evt); err != nil {
+		logger.WithError(err).Error("failed to record the handled comment of the event " + guid)
+	}
+	return rec, nil
+}
+
+// handleLifecycleCommand handles the lifecycle command in the comment,
+// it returns the audit record of the decision, or nil if there is no command.
+func (bot *robot) handleLifecycleCommand(ctx context.Context, evt *client.GenericEvent, logger *logrus.Entry) *auditRecord {
 	org, repo, number := utils.GetString(evt.Org), utils.GetString(evt.Repo), utils.GetString(evt.Number)
 	repoCnf := bot.cnf.getRepoConfig(org, repo)
 	// If the specified repository not match any repository  in the repoConfig list, it logs the warning and returns
 	if repoCnf == nil {
 		logger.Warningf("no config for the repo: " + org + "/" + repo)
-		return
+		bot.tracef("no repo config matches %s/%s", org, repo)
+		return nil
 	}
+	bot.tracef("matched repo config: repos=%v excluded_repos=%v need_issue_has_link_pull_requests=%t mode=%q",
+		repoCnf.Repos, repoCnf.ExcludedRepos, repoCnf.NeedIssueHasLinkPullRequests, repoCnf.Mode)
 
+	b := bot.withRepoMode(repoCnf)
 	// Checks if the event can be handled as a reopen event
-	if bot.handleReopenEvent(evt, org, repo, number) {
-		return
+	if rec := b.handleReopenEvent(ctx, evt, org, repo, number); rec != nil {
+		return rec
 	}
 
 	// Handles the close event
-	bot.handleCloseEvent(evt, repoCnf, org, repo, number)
+	return b.handleCloseEvent(ctx, evt, repoCnf, org, repo, number)
 }
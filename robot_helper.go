@@ -14,6 +14,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"github.com/opensourceways/robot-framework-lib/client"
 	"github.com/opensourceways/robot-framework-lib/utils"
 	"regexp"
@@ -25,6 +28,13 @@ const (
 	placeholderCommenter = "__commenter__"
 	// placeholderAction is a placeholder string for the action
 	placeholderAction = "__action__"
+	// placeholderState is a placeholder string for the current state of the issue or pull request
+	placeholderState = "__state__"
+	// placeholderAuthor is a placeholder string for the author of the issue
+	placeholderAuthor = "__author__"
+
+	actionClose  = "close"
+	actionReopen = "reopen"
 )
 
 var (
@@ -32,93 +42,268 @@ var (
 	regexpReopenComment = regexp.MustCompile(`^/reopen$`)
 	// regexpCloseComment is a compiled regular expression for closing comments
 	regexpCloseComment = regexp.MustCompile(`^/close$`)
+
+	// permissionCheckMetrics counts the permission checks against the platform by their results,
+	// they are passed, denied or failed
+	permissionCheckMetrics = expvar.NewMap("lifecycle_permission_check")
 )
 
 // handleReopenEvent only handles the reopening of an issue event.
-// Handle completed, set the interrupt flag to interrupt the subsequent operations.
-func (bot *robot) handleReopenEvent(evt *client.GenericEvent, org, repo, number string) (interrupt bool) {
+// Handle completed, the audit record of the decision is returned to interrupt the subsequent operations.
+func (bot *robot) handleReopenEvent(ctx context.Context, evt *client.GenericEvent, org, repo, number string) *auditRecord {
+	plan := bot.planReopen(ctx, evt, org, repo, number)
+	if plan == nil {
+		return nil
+	}
+
+	return bot.executePlan(ctx, evt, plan)
+}
+
+// handleCloseEvent  handles the closing of an issue or pull request event,
+// it returns the audit record of the decision, or nil if the event is not a close command.
+func (bot *robot) handleCloseEvent(ctx context.Context, evt *client.GenericEvent, configmap *repoConfig, org, repo, number string) *auditRecord {
+	plan := bot.planClose(ctx, evt, configmap, org, repo, number)
+	if plan == nil {
+		bot.tracef("no lifecycle command applies to the comment %q in the state %q",
+			utils.GetString(evt.Comment), utils.GetString(evt.State))
+		return nil
+	}
+
+	return bot.executePlan(ctx, evt, plan)
+}
+
+// planReopen decides what to do for the reopening of an issue event.
+// It returns nil if the event is not a reopen command.
+func (bot *robot) planReopen(ctx context.Context, evt *client.GenericEvent, org, repo, number string) *lifecyclePlan {
 	comment, state, commentKind := utils.GetString(evt.Comment), utils.GetString(evt.State), utils.GetString(evt.CommentKind)
 	commenter, author := utils.GetString(evt.Commenter), utils.GetString(evt.Author)
 	// If the comment is on an issue and the comment matches the reopen comment and the state is closed
-	if commentKind == client.CommentOnIssue &&
-		regexpReopenComment.MatchString(strings.TrimSpace(comment)) && state == bot.cnf.EventStateClosed {
-		interrupt = true
-		// Check if the commenter has the permission to operate
-		if !bot.checkCommenterPermission(org, repo, number, author, commenter, commentKind, "reopen") {
-			return
-		}
+	if commentKind != client.CommentOnIssue ||
+		!regexpReopenComment.MatchString(strings.TrimSpace(comment)) || state != bot.cnf.EventStateClosed {
+		return nil
+	}
 
-		bot.cli.UpdateIssue(org, repo, number, bot.cnf.EventStateOpened)
+	plan := newLifecyclePlan(org, repo, number, commentKind, actionReopen)
+	// Check if the commenter has the permission to operate
+	if !bot.planCommenterPermission(ctx, plan, author, commenter) {
+		return plan
 	}
-	return
+
+	bot.planStateChange(ctx, plan, actionKindUpdateIssue, bot.cnf.EventStateOpened, commenter)
+	return plan
 }
 
-// handleCloseEvent  handles the closing of an issue or pull request event
-func (bot *robot) handleCloseEvent(evt *client.GenericEvent, configmap *repoConfig, org, repo, number string) {
+// planClose decides what to do for the closing of an issue or pull request event.
+// It returns nil if the event is not a close command.
+func (bot *robot) planClose(ctx context.Context, evt *client.GenericEvent, configmap *repoConfig, org, repo, number string) *lifecyclePlan {
 	comment, state, commentKind := utils.GetString(evt.Comment), utils.GetString(evt.State), utils.GetString(evt.CommentKind)
 	commenter, author := utils.GetString(evt.Commenter), utils.GetString(evt.Author)
 	// If the comment matches the close comment and the state is opened
-	if regexpCloseComment.MatchString(strings.TrimSpace(comment)) && state == bot.cnf.EventStateOpened {
-		// Check if the commenter has the permission to operate
-		if !bot.checkCommenterPermission(org, repo, number, author, commenter, commentKind, "close") {
-			return
-		}
+	if !regexpCloseComment.MatchString(strings.TrimSpace(comment)) || state != bot.cnf.EventStateOpened {
+		return nil
+	}
 
-		// If the comment kind is an pull request, update the pull request state to closed and return
-		if commentKind != client.CommentOnIssue {
-			bot.cli.UpdatePR(org, repo, number, bot.cnf.EventStateClosed)
-			return
-		}
+	plan := newLifecyclePlan(org, repo, number, commentKind, actionClose)
+	// Check if the commenter has the permission to operate
+	if !bot.planCommenterPermission(ctx, plan, author, commenter) {
+		return plan
+	}
 
-		// Check if the issue needs linking to a pull request, and update the issue state to closed
-		bot.checkIssueNeedLinkingPR(configmap, org, repo, number, commenter)
+	// If the comment kind is an pull request, update the pull request state to closed and return
+	if commentKind != client.CommentOnIssue {
+		bot.planStateChange(ctx, plan, actionKindUpdatePR, bot.cnf.EventStateClosed, commenter)
+		return plan
 	}
+
+	// Check if the issue needs linking to a pull request, and update the issue state to closed
+	bot.checkIssueNeedLinkingPR(ctx, plan, configmap, commenter)
+	return plan
 }
 
-// handleCloseEvent  handles the closing of an issue
-func (bot *robot) checkIssueNeedLinkingPR(configmap *repoConfig, org, repo, number, commenter string) {
+// checkIssueNeedLinkingPR plans the closing of an issue
+func (bot *robot) checkIssueNeedLinkingPR(ctx context.Context, plan *lifecyclePlan, configmap *repoConfig, commenter string) {
+	// The linking pull requests don't matter if the issue was already closed
+	if bot.checkCurrentState(ctx, plan, actionKindUpdateIssue, bot.cnf.EventStateClosed, commenter) {
+		return
+	}
+
 	if configmap.NeedIssueHasLinkPullRequests {
 		// issue can be closed only when its linking PR exists
-		num, success := bot.cli.GetIssueLinkedPRNumber(org, repo, number)
+		num, err := bot.cli.GetIssueLinkedPRNumber(ctx, plan.Org, plan.Repo, plan.Number)
+		if errors.Is(err, errNotFound) {
+			planNotFound(plan)
+			return
+		}
 		// If the request is failed that means not be sure to close issue,
 		// create a comment indicating do closing again and return
-		if !success {
-			bot.cli.CreateIssueComment(org, repo, number,
-				strings.ReplaceAll(bot.cnf.CommentListLinkingPullRequestsFailure, placeholderCommenter, commenter))
+		if errors.Is(err, errCircuitOpen) {
+			planPlatformUnavailable(plan, commenter)
+			return
+		}
+		if err != nil {
+			plan.Policy = policyLinkPRCheckFailed
+			plan.add(commentAction(templateListLinkingPullRequestsFailure, map[string]string{placeholderCommenter: commenter}))
 			return
 		}
 
 		// If the linked pull request number is zero,
 		// create a comment indicating that the issue needs a linked pull request and return
 		if num == 0 {
-			bot.cli.CreateIssueComment(org, repo, number,
-				strings.ReplaceAll(bot.cnf.CommentIssueNeedsLinkPR, placeholderCommenter, commenter))
+			plan.Policy = policyNeedsLinkPR
+			plan.add(commentAction(templateIssueNeedsLinkPR, map[string]string{placeholderCommenter: commenter}))
 			return
 		}
 	}
 
-	bot.cli.UpdateIssue(org, repo, number, bot.cnf.EventStateClosed)
+	plan.Policy = policyAllowed
+	plan.add(plannedAction{Kind: actionKindUpdateIssue, State: bot.cnf.EventStateClosed})
 }
 
-func (bot *robot) checkCommenterPermission(org, repo, number, author, commenter, commentKind, action string) (pass bool) {
-	if author == commenter {
+// planStateChange plans to change the state of the issue or pull request, unless it is already in the state
+func (bot *robot) planStateChange(ctx context.Context, plan *lifecyclePlan, kind actionKind, state, commenter string) {
+	if bot.checkCurrentState(ctx, plan, kind, state, commenter) {
+		return
+	}
+
+	plan.Policy = policyAllowed
+	plan.add(plannedAction{Kind: kind, State: state})
+}
+
+// checkCurrentState reads the current state of the issue or pull request, because the state in the webhook
+// may be stale by the time the event is handled. If it is not in the state which the command changes
+// any more, for example it is already in the state or the pull request was merged, the plan is
+// completed with a comment instead of an update on the platform, and true is returned.
+// The plan is completed silently if the issue or pull request doesn't exist any more,
+// and the state in the webhook is trusted when the current state can't be read.
+func (bot *robot) checkCurrentState(ctx context.Context, plan *lifecyclePlan, kind actionKind, state, commenter string) bool {
+	var current string
+	var err error
+	if kind == actionKindUpdatePR {
+		current, err = bot.cli.GetPRState(ctx, plan.Org, plan.Repo, plan.Number)
+	} else {
+		current, err = bot.cli.GetIssueState(ctx, plan.Org, plan.Repo, plan.Number)
+	}
+	if errors.Is(err, errNotFound) {
+		planNotFound(plan)
 		return true
 	}
-	pass, success := bot.cli.CheckPermission(org, repo, commenter)
-	if success && !pass {
-		bot.handleNoPermissionOperateIssueOrPR(org, repo, number, commenter, commentKind, action)
+	if err != nil {
+		bot.logError(err, "failed to get the current state of "+plan.Org+"/"+plan.Repo+"#"+plan.Number+
+			", use the state in the webhook")
+		return false
 	}
-	return pass && success
+	bot.tracef("current state: %s", current)
+	// Only the opened one is closed and only the closed one is reopened, the other states such as merged are final
+	from := bot.cnf.EventStateOpened
+	if state == bot.cnf.EventStateOpened {
+		from = bot.cnf.EventStateClosed
+	}
+	if current == from {
+		return false
+	}
+
+	plan.Policy = policyAlreadyInState
+	plan.add(commentAction(templateStateUnchanged, map[string]string{
+		placeholderCommenter: commenter,
+		placeholderAction:    plan.Command,
+		placeholderState:     current,
+	}))
+	return true
 }
 
-func (bot *robot) handleNoPermissionOperateIssueOrPR(org, repo, number, commenter, commentKind, action string) {
-	if commentKind == client.CommentOnIssue {
-		bot.cli.CreateIssueComment(org, repo, number,
-			strings.ReplaceAll(strings.ReplaceAll(bot.cnf.CommentNoPermissionOperateIssue,
-				placeholderCommenter, commenter), placeholderAction, action))
-	} else {
-		bot.cli.CreatePRComment(org, repo, number,
-			strings.ReplaceAll(strings.ReplaceAll(bot.cnf.CommentNoPermissionOperatePR,
-				placeholderCommenter, commenter), placeholderAction, action))
+// planNotFound completes the plan on an issue or pull request which doesn't exist, for example
+// it was deleted. Nothing is commented, because the comment can't be created either.
+func planNotFound(plan *lifecyclePlan) {
+	plan.Policy = policyTargetNotFound
+	plan.add(plannedAction{
+		Kind:   actionKindSkip,
+		Reason: plan.Org + "/" + plan.Repo + "#" + plan.Number + " doesn't exist",
+	})
+}
+
+// planPlatformUnavailable completes the plan which failed fast on the open circuit, the commenter is asked to try later
+func planPlatformUnavailable(plan *lifecyclePlan, commenter string) {
+	plan.Policy = policyPlatformUnavailable
+	plan.add(commentAction(templatePlatformUnavailable, map[string]string{
+		placeholderCommenter: commenter,
+		placeholderAction:    plan.Command,
+	}))
+}
+
+// planCommenterPermission records the role of the commenter in the plan.
+// If the commenter can't operate, the plan is completed and false is returned.
+func (bot *robot) planCommenterPermission(ctx context.Context, plan *lifecyclePlan, author, commenter string) bool {
+	pass, role, err := bot.checkCommenterPermission(ctx, plan.Org, plan.Repo, author, commenter)
+	plan.Role = role
+	if pass {
+		return true
+	}
+	if errors.Is(err, errCircuitOpen) {
+		planPlatformUnavailable(plan, commenter)
+		return false
+	}
+
+	plan.Policy = deniedPolicy(role)
+	if role == roleUnknown {
+		if bot.log != nil {
+			bot.log.WithField("policy", policyPermissionCheckFailed).Errorf(
+				"failed to check the permission of %s on %s/%s, the %s command is dropped",
+				commenter, plan.Org, plan.Repo, plan.Command)
+		}
+		plan.add(commentAction(templateCheckPermissionFailure, map[string]string{
+			placeholderCommenter: commenter,
+			placeholderAction:    plan.Command,
+		}))
+		return false
+	}
+
+	template := templateNoPermissionOperatePR
+	if plan.CommentKind == client.CommentOnIssue {
+		template = templateNoPermissionOperateIssue
+	}
+	plan.add(commentAction(template, map[string]string{
+		placeholderCommenter: commenter,
+		placeholderAction:    plan.Command,
+	}))
+	return false
+}
+
+// checkCommenterPermission checks if the commenter can operate the issue or pull request,
+// it also returns the role which the decision was based on, and the error if the permission failed to be checked.
+func (bot *robot) checkCommenterPermission(ctx context.Context, org, repo, author, commenter string) (
+	pass bool, role string, err error) {
+	if author == commenter {
+		return true, roleAuthor, nil
+	}
+	// The lookup is retried with backoff, because a failed one drops the command
+	err = bot.retry.do(ctx, func() (err error) {
+		pass, err = bot.cli.CheckPermission(ctx, org, repo, commenter)
+		return
+	})
+	if err != nil {
+		bot.logError(err, "failed to check the permission of "+commenter+" on "+org+"/"+repo)
+		permissionCheckMetrics.Add("failed", 1)
+		return false, roleUnknown, err
+	}
+	if !pass {
+		permissionCheckMetrics.Add("denied", 1)
+		return false, roleNone, nil
+	}
+	permissionCheckMetrics.Add("passed", 1)
+	return true, roleCollaborator, nil
+}
+
+// recordDecision writes the audit record and the history of the decision, and publishes it to the sinks
+func (bot *robot) recordDecision(org, repo, number string, rec *auditRecord) {
+	bot.writeAudit(rec)
+	bot.recordHistory(org, repo, number, rec)
+	bot.notify(org, repo, rec)
+}
+
+// deniedPolicy returns the policy result of a command refused on the permission check
+func deniedPolicy(role string) string {
+	if role == roleUnknown {
+		return policyPermissionCheckFailed
 	}
+	return policyNoPermission
 }
@@ -14,7 +14,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"github.com/opensourceways/robot-framework-lib/client"
 	"github.com/stretchr/testify/assert"
 	"os"
@@ -34,36 +37,62 @@ type mockClient struct {
 	permission                       bool
 	method                           string
 	issueLinkingPRNum                int
+	successfulGetState               bool
+	state                            string
+	// comment is the body of the last comment created
+	comment string
+	// failure is the error of the unsuccessful calls, it is a transient error by default
+	failure error
 }
 
-func (m *mockClient) CreatePRComment(org, repo, number, comment string) bool {
-	m.method = "CreatePRComment"
-	return m.successfulCreatePRComment
+func (m *mockClient) result(successful bool) error {
+	if successful {
+		return nil
+	}
+	if m.failure != nil {
+		return m.failure
+	}
+	return newTransientError(m.method, errors.New("mock failure"))
 }
 
-func (m *mockClient) CreateIssueComment(org, repo, number, comment string) bool {
-	m.method = "CreateIssueComment"
-	return m.successfulCreateIssueComment
+func (m *mockClient) CreatePRComment(_ context.Context, org, repo, number, comment string) error {
+	m.method, m.comment = "CreatePRComment", comment
+	return m.result(m.successfulCreatePRComment)
 }
 
-func (m *mockClient) UpdateIssue(org, repo, number, state string) bool {
+func (m *mockClient) CreateIssueComment(_ context.Context, org, repo, number, comment string) error {
+	m.method, m.comment = "CreateIssueComment", comment
+	return m.result(m.successfulCreateIssueComment)
+}
+
+func (m *mockClient) UpdateIssue(_ context.Context, org, repo, number, state string) error {
 	m.method = "UpdateIssue"
-	return m.successfulUpdateIssue
+	return m.result(m.successfulUpdateIssue)
 }
 
-func (m *mockClient) UpdatePR(org, repo, number, state string) bool {
+func (m *mockClient) UpdatePR(_ context.Context, org, repo, number, state string) error {
 	m.method = "UpdatePR"
-	return m.successfulUpdatePR
+	return m.result(m.successfulUpdatePR)
+}
+
+func (m *mockClient) GetIssueState(_ context.Context, org, repo, number string) (string, error) {
+	m.method = "GetIssueState"
+	return m.state, m.result(m.successfulGetState)
 }
 
-func (m *mockClient) GetIssueLinkedPRNumber(org, repo, number string) (int, bool) {
+func (m *mockClient) GetPRState(_ context.Context, org, repo, number string) (string, error) {
+	m.method = "GetPRState"
+	return m.state, m.result(m.successfulGetState)
+}
+
+func (m *mockClient) GetIssueLinkedPRNumber(_ context.Context, org, repo, number string) (int, error) {
 	m.method = "GetIssueLinkedPRNumber"
-	return m.issueLinkingPRNum, m.successfulGetIssueLinkedPRNumber
+	return m.issueLinkingPRNum, m.result(m.successfulGetIssueLinkedPRNumber)
 }
 
-func (m *mockClient) CheckPermission(org, repo, username string) (bool, bool) {
+func (m *mockClient) CheckPermission(_ context.Context, org, repo, username string) (bool, error) {
 	m.method = "CheckPermission"
-	return m.permission, m.successfulCheckPermission
+	return m.permission, m.result(m.successfulCheckPermission)
 }
 
 const (
@@ -77,7 +106,7 @@ const (
 
 func TestHandleReopenEvent(t *testing.T) {
 
-	mc := new(mockClient)
+	mc := &mockClient{successfulUpdateIssue: true, successfulUpdatePR: true}
 	bot := &robot{cli: mc, cnf: &configuration{
 		EventStateClosed: "closed",
 	}}
@@ -92,16 +121,17 @@ func TestHandleReopenEvent(t *testing.T) {
 
 	case1 := "the comment is not matching anyone comment command"
 	cli.method = case1
-	bot.handleReopenEvent(event, org, repo, number)
+	bot.handleReopenEvent(context.Background(), event, org, repo, number)
 	execMethod1 := cli.method
 	assert.Equal(t, case1, execMethod1)
 
 	*event.Comment = comment1
-	case2 := "CheckPermission"
+	// the permission lookup failed, and the commenter is told
+	case2 := "CreateIssueComment"
 	*event.CommentKind = client.CommentOnIssue
 	*event.State = bot.cnf.EventStateClosed
 	cli.method = ""
-	bot.handleReopenEvent(event, org, repo, number)
+	bot.handleReopenEvent(context.Background(), event, org, repo, number)
 	execMethod2 := cli.method
 	assert.Equal(t, case2, execMethod2)
 
@@ -110,7 +140,7 @@ func TestHandleReopenEvent(t *testing.T) {
 	author := commenter
 	event.Author = &author
 	*event.Commenter = commenter
-	bot.handleReopenEvent(event, org, repo, number)
+	bot.handleReopenEvent(context.Background(), event, org, repo, number)
 	execMethod3 := cli.method
 	assert.Equal(t, case3, execMethod3)
 
@@ -118,7 +148,7 @@ func TestHandleReopenEvent(t *testing.T) {
 
 func TestHandleCloseEvent(t *testing.T) {
 
-	mc := new(mockClient)
+	mc := &mockClient{successfulUpdateIssue: true, successfulUpdatePR: true}
 	bot := &robot{cli: mc, cnf: &configuration{
 		CommentNoPermissionOperateIssue: " [@__commenter__](***/__commenter__)  you ",
 		EventStateOpened:                "opened",
@@ -136,14 +166,15 @@ func TestHandleCloseEvent(t *testing.T) {
 
 	case1 := "the comment is not matching anyone comment command"
 	cli.method = case1
-	bot.handleCloseEvent(event, repoCnf, org, repo, number)
+	bot.handleCloseEvent(context.Background(), event, repoCnf, org, repo, number)
 	execMethod1 := cli.method
 	assert.Equal(t, case1, execMethod1)
 
 	*event.Comment = comment
-	case2 := "CheckPermission"
+	// the permission lookup failed, and the commenter is told
+	case2 := "CreatePRComment"
 	cli.method = ""
-	bot.handleCloseEvent(event, repoCnf, org, repo, number)
+	bot.handleCloseEvent(context.Background(), event, repoCnf, org, repo, number)
 	execMethod2 := cli.method
 	assert.Equal(t, case2, execMethod2)
 
@@ -152,68 +183,316 @@ func TestHandleCloseEvent(t *testing.T) {
 	author := commenter
 	event.Author = &author
 	*event.Commenter = commenter
-	bot.handleCloseEvent(event, repoCnf, org, repo, number)
+	bot.handleCloseEvent(context.Background(), event, repoCnf, org, repo, number)
 	execMethod3 := cli.method
 	assert.Equal(t, case3, execMethod3)
 
 	case4 := "UpdateIssue"
 	cli.method = ""
 	*event.CommentKind = client.CommentOnIssue
-	bot.handleCloseEvent(event, repoCnf, org, repo, number)
+	bot.handleCloseEvent(context.Background(), event, repoCnf, org, repo, number)
 	execMethod4 := cli.method
 	assert.Equal(t, case4, execMethod4)
 
 	case5 := "CreateIssueComment"
 	cli.method = ""
 	repoCnf.NeedIssueHasLinkPullRequests = true
-	bot.handleCloseEvent(event, repoCnf, org, repo, number)
+	bot.handleCloseEvent(context.Background(), event, repoCnf, org, repo, number)
 	execMethod5 := cli.method
 	assert.Equal(t, case5, execMethod5)
 
 	case6 := "CreateIssueComment"
 	cli.method = ""
 	cli.successfulGetIssueLinkedPRNumber = true
-	bot.handleCloseEvent(event, repoCnf, org, repo, number)
+	bot.handleCloseEvent(context.Background(), event, repoCnf, org, repo, number)
 	execMethod6 := cli.method
 	assert.Equal(t, case6, execMethod6)
 }
 
 func TestCheckCommenterPermission(t *testing.T) {
 
-	mc := new(mockClient)
-	bot := &robot{cli: mc, cnf: &configuration{
-		CommentNoPermissionOperateIssue: " [@__commenter__](***/__commenter__)  you ",
-	}}
+	mc := &mockClient{successfulUpdateIssue: true, successfulUpdatePR: true}
+	bot := &robot{cli: mc, cnf: &configuration{}}
 
 	cli, ok := bot.cli.(*mockClient)
 	assert.Equal(t, true, ok)
-	action := "open1"
 
 	cli.method = ""
-	pass := bot.checkCommenterPermission(org, repo, number, commenter, commenter, client.CommentOnIssue, action)
+	pass, role, _ := bot.checkCommenterPermission(context.Background(), org, repo, commenter, commenter)
 	assert.Equal(t, true, pass)
+	assert.Equal(t, roleAuthor, role)
 	execMethod1 := cli.method
 	assert.Equal(t, "", execMethod1)
 
 	author := commenter + "ff"
 	case2 := "CheckPermission"
-	cli.method = case2
-	pass1 := bot.checkCommenterPermission(org, repo, number, author, commenter, client.CommentOnIssue, action)
+	pass1, role1, _ := bot.checkCommenterPermission(context.Background(), org, repo, author, commenter)
 	assert.Equal(t, false, pass1)
+	assert.Equal(t, roleUnknown, role1)
 	execMethod2 := cli.method
 	assert.Equal(t, case2, execMethod2)
 
-	case3 := "CreateIssueComment"
-	cli.method = ""
 	cli.successfulCheckPermission = true
-	cli.permission = false
-	bot.checkCommenterPermission(org, repo, number, author, commenter, client.CommentOnIssue, action)
-	execMethod3 := cli.method
-	assert.Equal(t, case3, execMethod3)
+	pass2, role2, _ := bot.checkCommenterPermission(context.Background(), org, repo, author, commenter)
+	assert.Equal(t, false, pass2)
+	assert.Equal(t, roleNone, role2)
+
+	cli.permission = true
+	pass3, role3, _ := bot.checkCommenterPermission(context.Background(), org, repo, author, commenter)
+	assert.Equal(t, true, pass3)
+	assert.Equal(t, roleCollaborator, role3)
+}
 
-	case4 := "CreatePRComment"
-	cli.method = ""
-	bot.checkCommenterPermission(org, repo, number, author, commenter, client.CommentOnPR, action)
-	execMethod4 := cli.method
-	assert.Equal(t, case4, execMethod4)
+func TestPlanClose(t *testing.T) {
+	author := "author1"
+	testCases := []struct {
+		desc        string
+		cli         mockClient
+		commenter   string
+		commentKind string
+		repoCnf     repoConfig
+		out         *lifecyclePlan
+	}{
+		{
+			"the permission lookup failed",
+			mockClient{},
+			commenter,
+			client.CommentOnIssue,
+			repoConfig{},
+			&lifecyclePlan{Role: roleUnknown, Policy: policyPermissionCheckFailed, Actions: []plannedAction{
+				commentAction(templateCheckPermissionFailure, map[string]string{
+					placeholderCommenter: commenter, placeholderAction: actionClose,
+				}),
+			}},
+		},
+		{
+			"the commenter has no permission to close the issue",
+			mockClient{successfulCheckPermission: true},
+			commenter,
+			client.CommentOnIssue,
+			repoConfig{},
+			&lifecyclePlan{Role: roleNone, Policy: policyNoPermission, Actions: []plannedAction{
+				commentAction(templateNoPermissionOperateIssue, map[string]string{
+					placeholderCommenter: commenter, placeholderAction: actionClose,
+				}),
+			}},
+		},
+		{
+			"the commenter has no permission to close the pull request",
+			mockClient{successfulCheckPermission: true},
+			commenter,
+			client.CommentOnPR,
+			repoConfig{},
+			&lifecyclePlan{Role: roleNone, Policy: policyNoPermission, Actions: []plannedAction{
+				commentAction(templateNoPermissionOperatePR, map[string]string{
+					placeholderCommenter: commenter, placeholderAction: actionClose,
+				}),
+			}},
+		},
+		{
+			"a collaborator closes the pull request",
+			mockClient{successfulCheckPermission: true, permission: true},
+			commenter,
+			client.CommentOnPR,
+			repoConfig{},
+			&lifecyclePlan{Role: roleCollaborator, Policy: policyAllowed, Actions: []plannedAction{
+				{Kind: actionKindUpdatePR, State: "closed"},
+			}},
+		},
+		{
+			"the author closes the issue",
+			mockClient{},
+			author,
+			client.CommentOnIssue,
+			repoConfig{},
+			&lifecyclePlan{Role: roleAuthor, Policy: policyAllowed, Actions: []plannedAction{
+				{Kind: actionKindUpdateIssue, State: "closed"},
+			}},
+		},
+		{
+			"the linking pull requests lookup failed",
+			mockClient{},
+			author,
+			client.CommentOnIssue,
+			repoConfig{NeedIssueHasLinkPullRequests: true},
+			&lifecyclePlan{Role: roleAuthor, Policy: policyLinkPRCheckFailed, Actions: []plannedAction{
+				commentAction(templateListLinkingPullRequestsFailure, map[string]string{placeholderCommenter: author}),
+			}},
+		},
+		{
+			"the issue has no linking pull requests",
+			mockClient{successfulGetIssueLinkedPRNumber: true},
+			author,
+			client.CommentOnIssue,
+			repoConfig{NeedIssueHasLinkPullRequests: true},
+			&lifecyclePlan{Role: roleAuthor, Policy: policyNeedsLinkPR, Actions: []plannedAction{
+				commentAction(templateIssueNeedsLinkPR, map[string]string{placeholderCommenter: author}),
+			}},
+		},
+		{
+			"the issue has linking pull requests",
+			mockClient{successfulGetIssueLinkedPRNumber: true, issueLinkingPRNum: 2},
+			author,
+			client.CommentOnIssue,
+			repoConfig{NeedIssueHasLinkPullRequests: true},
+			&lifecyclePlan{Role: roleAuthor, Policy: policyAllowed, Actions: []plannedAction{
+				{Kind: actionKindUpdateIssue, State: "closed"},
+			}},
+		},
+		{
+			"the issue was closed after the webhook was sent",
+			mockClient{successfulGetState: true, state: "closed"},
+			author,
+			client.CommentOnIssue,
+			repoConfig{NeedIssueHasLinkPullRequests: true},
+			&lifecyclePlan{Role: roleAuthor, Policy: policyAlreadyInState, Actions: []plannedAction{
+				commentAction(templateStateUnchanged, map[string]string{
+					placeholderCommenter: author, placeholderAction: actionClose, placeholderState: "closed",
+				}),
+			}},
+		},
+		{
+			"the issue was deleted after the webhook was sent",
+			mockClient{failure: &apiError{kind: errNotFound, op: "GetIssueState", status: 404}},
+			author,
+			client.CommentOnIssue,
+			repoConfig{},
+			&lifecyclePlan{Role: roleAuthor, Policy: policyTargetNotFound, Actions: []plannedAction{
+				{Kind: actionKindSkip, Reason: org + "/" + repo + "#" + number + " doesn't exist"},
+			}},
+		},
+		{
+			"the pull request was merged after the webhook was sent",
+			mockClient{successfulCheckPermission: true, permission: true, successfulGetState: true, state: "merged"},
+			commenter,
+			client.CommentOnPR,
+			repoConfig{},
+			&lifecyclePlan{Role: roleCollaborator, Policy: policyAlreadyInState, Actions: []plannedAction{
+				commentAction(templateStateUnchanged, map[string]string{
+					placeholderCommenter: commenter, placeholderAction: actionClose, placeholderState: "merged",
+				}),
+			}},
+		},
+		{
+			"the pull request is still opened",
+			mockClient{successfulCheckPermission: true, permission: true, successfulGetState: true, state: "opened"},
+			commenter,
+			client.CommentOnPR,
+			repoConfig{},
+			&lifecyclePlan{Role: roleCollaborator, Policy: policyAllowed, Actions: []plannedAction{
+				{Kind: actionKindUpdatePR, State: "closed"},
+			}},
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].desc, func(t *testing.T) {
+			bot := &robot{cli: &testCases[i].cli, cnf: &configuration{
+				EventStateOpened: "opened",
+				EventStateClosed: "closed",
+			}}
+			evt := &client.GenericEvent{
+				Comment:     strPtr(comment),
+				State:       strPtr("opened"),
+				CommentKind: strPtr(testCases[i].commentKind),
+				Commenter:   strPtr(testCases[i].commenter),
+				Author:      strPtr(author),
+			}
+
+			want := testCases[i].out
+			want.Org, want.Repo, want.Number = org, repo, number
+			want.CommentKind, want.Command = testCases[i].commentKind, actionClose
+			assert.Equal(t, want, bot.planClose(context.Background(), evt, &testCases[i].repoCnf, org, repo, number))
+		})
+	}
+}
+
+func TestPlanReopen(t *testing.T) {
+	bot := &robot{cli: new(mockClient), cnf: &configuration{
+		EventStateOpened: "opened",
+		EventStateClosed: "closed",
+	}}
+	evt := &client.GenericEvent{
+		Comment:     strPtr(comment1),
+		State:       strPtr("closed"),
+		CommentKind: strPtr(client.CommentOnPR),
+		Commenter:   strPtr(commenter),
+		Author:      strPtr(commenter),
+	}
+
+	// pull requests can't be reopened by the command
+	assert.Equal(t, (*lifecyclePlan)(nil), bot.planReopen(context.Background(), evt, org, repo, number))
+
+	*evt.CommentKind = client.CommentOnIssue
+	assert.Equal(t, &lifecyclePlan{
+		Org: org, Repo: repo, Number: number, CommentKind: client.CommentOnIssue, Command: actionReopen,
+		Role: roleAuthor, Policy: policyAllowed, Actions: []plannedAction{
+			{Kind: actionKindUpdateIssue, State: "opened"},
+		},
+	}, bot.planReopen(context.Background(), evt, org, repo, number))
+
+	// the issue was reopened after the webhook was sent
+	bot.cli = &mockClient{successfulGetState: true, state: "opened"}
+	assert.Equal(t, &lifecyclePlan{
+		Org: org, Repo: repo, Number: number, CommentKind: client.CommentOnIssue, Command: actionReopen,
+		Role: roleAuthor, Policy: policyAlreadyInState, Actions: []plannedAction{
+			commentAction(templateStateUnchanged, map[string]string{
+				placeholderCommenter: commenter, placeholderAction: actionReopen, placeholderState: "opened",
+			}),
+		},
+	}, bot.planReopen(context.Background(), evt, org, repo, number))
+}
+
+func TestRenderComment(t *testing.T) {
+	cnf := &configuration{
+		CommentNoPermissionOperatePR: "@__commenter__ can't __action__ it",
+	}
+	a := commentAction(templateNoPermissionOperatePR, map[string]string{
+		placeholderCommenter: commenter, placeholderAction: actionClose,
+	})
+	assert.Equal(t, "@commenter1 can't close it", cnf.renderComment(&a))
+
+	a.Template = "comment_not_exist"
+	assert.Equal(t, "", cnf.renderComment(&a))
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// flakyPermissionClient fails the permission lookups before the last one
+type flakyPermissionClient struct {
+	mockClient
+	failures int
+	calls    int
+}
+
+func (c *flakyPermissionClient) CheckPermission(_ context.Context, org, repo, username string) (bool, error) {
+	c.calls++
+	return true, c.result(c.calls > c.failures)
+}
+
+func TestCheckCommenterPermissionRetry(t *testing.T) {
+	failed := func() int64 {
+		v, _ := permissionCheckMetrics.Get("failed").(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+
+	bot := &robot{retry: newRetrier(&retryConfig{MaxAttempts: 3})}
+	bot.retry.sleep = noSleep
+
+	cli := &flakyPermissionClient{failures: 2}
+	bot.cli = cli
+	pass, role, _ := bot.checkCommenterPermission(context.Background(), org, repo, "author1", commenter)
+	assert.Equal(t, []interface{}{true, roleCollaborator, 3}, []interface{}{pass, role, cli.calls})
+
+	before := failed()
+	cli = &flakyPermissionClient{failures: 3}
+	bot.cli = cli
+	pass, role, _ = bot.checkCommenterPermission(context.Background(), org, repo, "author1", commenter)
+	assert.Equal(t, []interface{}{false, roleUnknown, 3}, []interface{}{pass, role, cli.calls})
+	assert.Equal(t, before+1, failed())
 }
@@ -0,0 +1,278 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/config"
+	"github.com/opensourceways/robot-framework-lib/framework"
+	"github.com/opensourceways/server-common-lib/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const scenarioHandlePath = "scenario-hook"
+
+// scenario describes the initial state of the forge, the incoming comments and the expected final state
+type scenario struct {
+	// Config is the configuration file in testdata, it is config.yaml by default
+	Config string `json:"config,omitempty"`
+	State  struct {
+		Issues       []forgeItem                 `json:"issues,omitempty"`
+		PullRequests []forgeItem                 `json:"pull_requests,omitempty"`
+		Admins       []string                    `json:"admins,omitempty"`
+		Sigs         map[string][]client.SigInfo `json:"sigs,omitempty"`
+	} `json:"state"`
+	Events []scenarioEvent `json:"events"`
+	Expect struct {
+		Issues       []forgeItem       `json:"issues,omitempty"`
+		PullRequests []forgeItem       `json:"pull_requests,omitempty"`
+		Comments     []scenarioComment `json:"comments"`
+	} `json:"expect"`
+}
+
+// scenarioEvent is a comment on an issue or a pull request, or an action on an issue
+type scenarioEvent struct {
+	Kind   string `json:"kind"`
+	Org    string `json:"org"`
+	Repo   string `json:"repo"`
+	Number string `json:"number"`
+	// Commenter is the user who comments, or who acts on the issue in the issue event
+	Commenter string `json:"commenter"`
+	Comment   string `json:"comment,omitempty"`
+	// Action is set to send the issue event of the action made on the web UI, such as close,
+	// the forge changes the state of the issue before the event is sent
+	Action string `json:"action,omitempty"`
+	// GUID is set to redeliver a webhook, the events get distinct GUIDs by default
+	GUID string `json:"guid,omitempty"`
+	// State is set to send a stale state in the webhook, it is the state on the forge by default
+	State string `json:"state,omitempty"`
+}
+
+// scenarioComment matches a comment created by the robot whose body contains Contains
+type scenarioComment struct {
+	Kind     string `json:"kind"`
+	Org      string `json:"org"`
+	Repo     string `json:"repo"`
+	Number   string `json:"number"`
+	Contains string `json:"contains"`
+}
+
+// scenarioRobot reports every handled event, so the scenario can wait for the asynchronous dispatching
+type scenarioRobot struct {
+	*robot
+	handled chan struct{}
+}
+
+func (r *scenarioRobot) RegisterEventHandler(p framework.HandlerRegister) {
+	r.robot.RegisterEventHandler(&scenarioRegister{HandlerRegister: p, handled: r.handled})
+}
+
+// scenarioRegister registers the handlers of the robot, which report every handled event
+type scenarioRegister struct {
+	framework.HandlerRegister
+	handled chan struct{}
+}
+
+func (r *scenarioRegister) report(fn framework.GenericHandlerFunc) framework.GenericHandlerFunc {
+	return func(evt *client.GenericEvent, cnf config.Configmap, logger *logrus.Entry) {
+		defer func() {
+			r.handled <- struct{}{}
+		}()
+		fn(evt, cnf, logger)
+	}
+}
+
+func (r *scenarioRegister) RegisterIssueHandler(fn framework.GenericHandlerFunc) {
+	r.HandlerRegister.RegisterIssueHandler(r.report(fn))
+}
+
+func (r *scenarioRegister) RegisterIssueCommentHandler(fn framework.GenericHandlerFunc) {
+	r.HandlerRegister.RegisterIssueCommentHandler(r.report(fn))
+}
+
+func (r *scenarioRegister) RegisterPullRequestCommentHandler(fn framework.GenericHandlerFunc) {
+	r.HandlerRegister.RegisterPullRequestCommentHandler(r.report(fn))
+}
+
+type scenarioEnv struct {
+	forge    *fakeForge
+	forgeURL string
+	bot      *scenarioRobot
+	hookURL  string
+	// sent numbers the events, so every event has a distinct GUID across the scenarios
+	sent int
+}
+
+var (
+	scenarioEnvOnce sync.Once
+	theScenarioEnv  *scenarioEnv
+)
+
+// newScenarioEnv starts the fake forge and the framework server of the robot.
+// The framework registers its handlers on the default mux, so they are shared by all the scenarios.
+func newScenarioEnv(t *testing.T) *scenarioEnv {
+	scenarioEnvOnce.Do(func() {
+		forge := newFakeForge()
+		forgeSrv := httptest.NewServer(forge)
+
+		logger := framework.NewLogger().WithField("component", component)
+		logger.Logger.SetLevel(logrus.PanicLevel)
+		cnf := &configuration{}
+		bot, err := newRobotWithClient(cnf, newForgeClient(forgeSrv.URL, cnf, logger), &robotOptions{}, nil)
+		assert.Equal(t, nil, err)
+
+		sr := &scenarioRobot{robot: bot, handled: make(chan struct{}, 1)}
+		opt := config.FrameworkOptions{HandlePath: scenarioHandlePath}
+		_ = framework.NewServer(sr, opt)
+		robotSrv := httptest.NewServer(http.DefaultServeMux)
+
+		theScenarioEnv = &scenarioEnv{
+			forge:    forge,
+			forgeURL: forgeSrv.URL,
+			bot:      sr,
+			hookURL:  robotSrv.URL + "/" + scenarioHandlePath,
+		}
+	})
+
+	return theScenarioEnv
+}
+
+func (env *scenarioEnv) load(t *testing.T, sc *scenario) {
+	cnf := &configuration{}
+	path := sc.Config
+	if path == "" {
+		path = configYaml
+	}
+	assert.Equal(t, nil, utils.LoadFromYaml(findTestdata(t, path), cnf))
+	assert.Equal(t, nil, cnf.Validate())
+
+	// The handlers on the framework server are bound to the robot, so it is rebuilt in place
+	bot, err := newRobotWithClient(cnf, newForgeClient(env.forgeURL, cnf, env.bot.log), &robotOptions{}, nil)
+	assert.Equal(t, nil, err)
+	*env.bot.robot = *bot
+	env.forge.reset(sc.State.Issues, sc.State.PullRequests, sc.State.Admins, sc.State.Sigs)
+}
+
+// send delivers the comment or the issue event to the framework server as a webhook, the state and author
+// of the issue or pull request are taken from the forge like the platform does
+func (env *scenarioEnv) send(t *testing.T, i int, e *scenarioEvent) {
+	if e.Action != "" {
+		env.forge.setState(e.Kind, e.Org, e.Repo, e.Number, issueActionStates[e.Action])
+	}
+	item, ok := env.forge.item(e.Kind, e.Org, e.Repo, e.Number)
+	assert.Equal(t, true, ok, "the target of the event %d does not exist", i)
+
+	commentKind := client.CommentOnIssue
+	if e.Kind == kindPullRequest {
+		commentKind = client.CommentOnPR
+	}
+	state := item.State
+	if e.State != "" {
+		state = e.State
+	}
+	env.sent++
+	guid := e.GUID
+	if guid == "" {
+		guid = fmt.Sprintf("scenario-event-%d", env.sent)
+	}
+	evt := map[string]string{
+		"eventType":   framework.NoteEvent,
+		"eventGUID":   guid,
+		"commentKind": commentKind,
+		"comment":     e.Comment,
+		"commenter":   e.Commenter,
+		"author":      item.Author,
+		"org":         e.Org,
+		"repo":        e.Repo,
+		"number":      e.Number,
+		"state":       state,
+	}
+	// The author of the issue event is the user who acted on the issue
+	if e.Action != "" {
+		evt = map[string]string{
+			"eventType": framework.IssueEvent,
+			"eventGUID": guid,
+			"action":    e.Action,
+			"author":    e.Commenter,
+			"org":       e.Org,
+			"repo":      e.Repo,
+			"number":    e.Number,
+			"state":     state,
+		}
+	}
+	payload, _ := json.Marshal(evt)
+
+	req, _ := http.NewRequest(http.MethodPost, env.hookURL, bytes.NewReader(payload))
+	req.Header.Set(client.HeaderRobotChain, client.HeaderRobotChainAuthed)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	_ = resp.Body.Close()
+
+	select {
+	case <-env.bot.handled:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the event %d was not handled", i)
+	}
+}
+
+func (env *scenarioEnv) verify(t *testing.T, sc *scenario) {
+	for _, want := range sc.Expect.Issues {
+		got, _ := env.forge.item(kindIssue, want.Org, want.Repo, want.Number)
+		assert.Equal(t, want.State, got.State, "the state of the issue "+want.key())
+	}
+	for _, want := range sc.Expect.PullRequests {
+		got, _ := env.forge.item(kindPullRequest, want.Org, want.Repo, want.Number)
+		assert.Equal(t, want.State, got.State, "the state of the pull request "+want.key())
+	}
+
+	comments := env.forge.listComments()
+	assert.Equal(t, len(sc.Expect.Comments), len(comments), "the number of comments")
+	for i := 0; i < len(comments) && i < len(sc.Expect.Comments); i++ {
+		want, got := sc.Expect.Comments[i], comments[i]
+		assert.Equal(t, []string{want.Kind, want.Org, want.Repo, want.Number},
+			[]string{got.Kind, got.Org, got.Repo, got.Number}, "the target of the comment %d", i)
+		assert.Equal(t, true, strings.Contains(got.Body, want.Contains), "the body of the comment %d: %s", i, got.Body)
+	}
+}
+
+func TestScenarios(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(findTestdata(t, configYaml)), "scenarios", "*.yaml"))
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, 0, len(files))
+
+	env := newScenarioEnv(t)
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".yaml"), func(t *testing.T) {
+			sc := &scenario{}
+			assert.Equal(t, nil, utils.LoadFromYaml(file, sc))
+
+			env.load(t, sc)
+			for i := range sc.Events {
+				env.send(t, i, &sc.Events[i])
+			}
+			env.verify(t, sc)
+		})
+	}
+}
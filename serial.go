@@ -0,0 +1,158 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+)
+
+const defaultMaxPendingEvents = 16
+
+var (
+	errQueueFull = errors.New("too many pending events")
+
+	// queueMetrics are published on /debug/vars, queue_depth has the number of
+	// running and waiting events of each issue or pull request which has any
+	queueMetrics = expvar.NewMap("lifecycle_event_queue")
+)
+
+// queueConfig configures the per issue queue of the events
+type queueConfig struct {
+	// MaxPending bounds the number of events waiting for an issue or pull request, it is 16 by default.
+	MaxPending int `json:"max_pending,omitempty"`
+}
+
+func (c *queueConfig) validate() error {
+	if c.MaxPending < 0 {
+		return errors.New("the event_queue max_pending can not be negative")
+	}
+	return nil
+}
+
+type keyQueue struct {
+	// waiters are signaled in order, the first one runs when the running event is done
+	waiters []chan struct{}
+}
+
+// serialQueue runs the events of the same key one by one in the order they reach the queue,
+// the events of different keys run in parallel. The framework handles each webhook in its own goroutine,
+// so the order is not always the order of the comments.
+type serialQueue struct {
+	mu         sync.Mutex
+	maxPending int
+	queues     map[string]*keyQueue
+	depth      *expvar.Map
+	pending    *expvar.Int
+	rejected   *expvar.Int
+}
+
+func newSerialQueue(c *queueConfig, metrics *expvar.Map) *serialQueue {
+	q := &serialQueue{
+		maxPending: c.MaxPending,
+		queues:     map[string]*keyQueue{},
+		depth:      new(expvar.Map).Init(),
+		pending:    new(expvar.Int),
+		rejected:   new(expvar.Int),
+	}
+	if q.maxPending == 0 {
+		q.maxPending = defaultMaxPendingEvents
+	}
+
+	if metrics != nil {
+		metrics.Set("queue_depth", q.depth)
+		metrics.Set("pending", q.pending)
+		metrics.Set("rejected", q.rejected)
+	}
+
+	return q
+}
+
+// do runs fn once the earlier events of the key are done.
+// It returns errQueueFull without running fn if too many events of the key are waiting.
+func (q *serialQueue) do(key string, fn func()) error {
+	if q == nil {
+		fn()
+		return nil
+	}
+
+	if err := q.acquire(key); err != nil {
+		return err
+	}
+	defer q.release(key)
+
+	fn()
+	return nil
+}
+
+func (q *serialQueue) acquire(key string) error {
+	q.mu.Lock()
+
+	kq, running := q.queues[key]
+	if !running {
+		q.queues[key] = &keyQueue{}
+		q.setDepth(key, 1)
+		q.mu.Unlock()
+		return nil
+	}
+
+	if len(kq.waiters) >= q.maxPending {
+		q.rejected.Add(1)
+		q.mu.Unlock()
+		return errQueueFull
+	}
+
+	ch := make(chan struct{})
+	kq.waiters = append(kq.waiters, ch)
+	q.setDepth(key, len(kq.waiters)+1)
+	q.mu.Unlock()
+
+	<-ch
+	return nil
+}
+
+// release hands the key over to the next waiting event
+func (q *serialQueue) release(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	kq := q.queues[key]
+	if len(kq.waiters) == 0 {
+		delete(q.queues, key)
+		q.setDepth(key, 0)
+		return
+	}
+
+	next := kq.waiters[0]
+	kq.waiters = kq.waiters[1:]
+	q.setDepth(key, len(kq.waiters)+1)
+	close(next)
+}
+
+func (q *serialQueue) setDepth(key string, n int) {
+	if old, ok := q.depth.Get(key).(*expvar.Int); ok {
+		q.pending.Add(int64(n) - old.Value())
+	} else {
+		q.pending.Add(int64(n))
+	}
+
+	if n == 0 {
+		q.depth.Delete(key)
+		return
+	}
+	v := new(expvar.Int)
+	v.Set(int64(n))
+	q.depth.Set(key, v)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"expvar"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueConfigValidate(t *testing.T) {
+	c := &queueConfig{MaxPending: -1}
+	assert.Equal(t, errors.New("the event_queue max_pending can not be negative"), c.validate())
+}
+
+// waitDepth waits until the queue of the key has n events
+func waitDepth(t *testing.T, q *serialQueue, key string, n int64) {
+	for i := 0; i < 1000; i++ {
+		q.mu.Lock()
+		v, _ := q.depth.Get(key).(*expvar.Int)
+		q.mu.Unlock()
+		if v != nil && v.Value() == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("the depth of %s is not %d", key, n)
+}
+
+func TestSerialQueueOrder(t *testing.T) {
+	metrics := new(expvar.Map).Init()
+	q := newSerialQueue(&queueConfig{MaxPending: 2}, metrics)
+
+	var mu sync.Mutex
+	var order []string
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, s)
+	}
+
+	key := "owner1/repo1#1"
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = q.do(key, func() {
+			<-block
+			record("/close")
+		})
+	}()
+	waitDepth(t, q, key, 1)
+
+	// the events of another issue are not blocked
+	assert.Equal(t, nil, q.do("owner1/repo1#2", func() { record("other") }))
+
+	for i, cmd := range []string{"/reopen", "/close again"} {
+		wg.Add(1)
+		go func(cmd string) {
+			defer wg.Done()
+			_ = q.do(key, func() { record(cmd) })
+		}(cmd)
+		waitDepth(t, q, key, int64(i+2))
+	}
+	assert.Equal(t, "3", metrics.Get("pending").String())
+
+	// the queue of the key is full
+	assert.Equal(t, errQueueFull, q.do(key, func() { record("rejected") }))
+	assert.Equal(t, "1", metrics.Get("rejected").String())
+
+	close(block)
+	wg.Wait()
+	assert.Equal(t, []string{"other", "/close", "/reopen", "/close again"}, order)
+	assert.Equal(t, "0", metrics.Get("pending").String())
+	assert.Equal(t, "{}", metrics.Get("queue_depth").String())
+	assert.Equal(t, 0, len(q.queues))
+}
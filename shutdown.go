@@ -0,0 +1,295 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 30
+	// maxShutdownTimeout is the grace period of interrupts.WaitForGracefulShutdown, the process exits after it
+	maxShutdownTimeout = time.Minute
+)
+
+// errEventInterrupted is returned for the event canceled on the shutdown, it is left to the next instance
+var errEventInterrupted = errors.New("the event is interrupted by the shutdown")
+
+// eventTracker keeps the events which are being handled or waiting in the queue
+type eventTracker struct {
+	mu sync.Mutex
+	// events maps the events to their arrival order
+	events map[*client.GenericEvent]uint64
+	seq    uint64
+	// redeliverable are the events delivered again by their sources if they are not done
+	redeliverable map[*client.GenericEvent]bool
+	// closed is set once the events are listed on the shutdown, no event is added after that
+	closed bool
+	// changed is signaled when an event is done
+	changed chan struct{}
+}
+
+func newEventTracker() *eventTracker {
+	return &eventTracker{
+		events:        map[*client.GenericEvent]uint64{},
+		redeliverable: map[*client.GenericEvent]bool{},
+		changed:       make(chan struct{}, 1),
+	}
+}
+
+// add tracks the event, it returns false if the tracker is closed
+func (t *eventTracker) add(evt *client.GenericEvent, redeliverable bool) bool {
+	if t == nil {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.seq++
+	t.events[evt] = t.seq
+	if redeliverable {
+		t.redeliverable[evt] = true
+	}
+	return true
+}
+
+func (t *eventTracker) done(evt *client.GenericEvent) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	delete(t.events, evt)
+	delete(t.redeliverable, evt)
+	t.mu.Unlock()
+
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+// close stops adding the events, and returns the events left in their arrival order,
+// except the redeliverable ones
+func (t *eventTracker) close() []*client.GenericEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	events := make([]*client.GenericEvent, 0, len(t.events))
+	for evt := range t.events {
+		if !t.redeliverable[evt] {
+			events = append(events, evt)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return t.events[events[i]] < t.events[events[j]]
+	})
+	return events
+}
+
+// wait waits until no event is left or ctx is done, it reports if no event is left
+func (t *eventTracker) wait(ctx context.Context) bool {
+	for {
+		t.mu.Lock()
+		n := len(t.events)
+		t.mu.Unlock()
+		if n == 0 {
+			return true
+		}
+
+		select {
+		case <-t.changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// shutdown waits up to timeout for the events being handled or queued. The events which are not done by then
+// are written to the unfinished events file, so the next instance handles them, and the requests of them are
+// canceled. The events which arrive after that, such as the polled or consumed ones, are written to the file too.
+// The webhooks are no longer accepted by then, because the framework server is shut down on the interrupt.
+func (bot *robot) shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	bot.inflight.wait(ctx)
+	unfinished := bot.inflight.close()
+	// The lifecycle events of the events done are published in the rest of the timeout
+	if !bot.publishing.close(ctx) {
+		bot.log.Warningf("the lifecycle events being published are canceled after %s", timeout)
+	}
+	// Cancels the requests of the events left, they don't record their results after that
+	bot.cancel()
+
+	if len(unfinished) == 0 {
+		bot.log.Info("all the lifecycle events are done")
+		return nil
+	}
+	bot.log.Warningf("%d lifecycle events are not done in %s", len(unfinished), timeout)
+
+	return bot.unfinished.append(unfinished)
+}
+
+// interrupted reports if the robot is shutting down and the events left are canceled
+func (bot *robot) interrupted() bool {
+	return bot.ctx != nil && bot.ctx.Err() != nil
+}
+
+// unfinishedEvents is the file of the events left to the next instance, one JSON event per line
+type unfinishedEvents struct {
+	mu   sync.Mutex
+	path string
+}
+
+// append writes the events to the end of the file
+func (u *unfinishedEvents) append(events []*client.GenericEvent) error {
+	if u == nil || u.path == "" {
+		return errors.New("the unfinished events are lost, because the unfinished events file is not set")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return writeUnfinishedEvents(u.path, events)
+}
+
+// read returns the events in the file, it returns nothing if there is no file
+func (u *unfinishedEvents) read() ([]*client.GenericEvent, error) {
+	if u == nil || u.path == "" {
+		return nil, nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return readUnfinishedEvents(u.path)
+}
+
+// remove deletes the done event from the file, the file is removed once no event is left.
+// The file is replaced as a whole, so it is never left half written.
+func (u *unfinishedEvents) remove(evt *client.GenericEvent) error {
+	done, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	events, err := readUnfinishedEvents(u.path)
+	if err != nil {
+		return err
+	}
+	left := make([]*client.GenericEvent, 0, len(events))
+	for _, e := range events {
+		// The event may be written twice if it was left again on the shutdown while it was resumed
+		if b, err := json.Marshal(e); err != nil || string(b) != string(done) {
+			left = append(left, e)
+		}
+	}
+	if len(left) == 0 {
+		if err = os.Remove(u.path); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	tmp := u.path + ".tmp"
+	_ = os.Remove(tmp)
+	if err = writeUnfinishedEvents(tmp, left); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.path)
+}
+
+// writeUnfinishedEvents appends the events to the file, one JSON event per line
+func writeUnfinishedEvents(path string, events []*client.GenericEvent) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, evt := range events {
+		if err = enc.Encode(evt); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// readUnfinishedEvents reads the events written by the previous instance, it returns nothing if there is no file
+func readUnfinishedEvents(path string) ([]*client.GenericEvent, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []*client.GenericEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		evt := &client.GenericEvent{}
+		if err = json.Unmarshal(scanner.Bytes(), evt); err != nil {
+			return nil, err
+		}
+		events = append(events, evt)
+	}
+	return events, scanner.Err()
+}
+
+// resumeUnfinishedEvents handles the events left by the previous instance one by one in their order.
+// Every event is removed from the file once it is done, so the events not done are still there
+// if this instance crashes or is shut down before, the event dropped by the queue is kept too.
+func (bot *robot) resumeUnfinishedEvents() error {
+	events, err := bot.unfinished.read()
+	if err != nil || len(events) == 0 {
+		return err
+	}
+
+	bot.log.Infof("resume %d lifecycle events left by the previous instance", len(events))
+	for _, evt := range events {
+		_, err = bot.handleEvent(evt, bot.log.WithFields(logrus.Fields(*evt.CollectLoggingFields())))
+		if errors.Is(err, errEventInterrupted) {
+			return nil
+		}
+		if err != nil {
+			continue
+		}
+		if err = bot.unfinished.remove(evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright (c) Huawei Technologies Co., Ltd. 2024. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/opensourceways/robot-framework-lib/client"
+	"github.com/opensourceways/robot-framework-lib/utils"
+	sutils "github.com/opensourceways/server-common-lib/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// blockingClient holds the permission lookups until the event is canceled
+type blockingClient struct {
+	mockClient
+	started chan struct{}
+}
+
+func (c *blockingClient) CheckPermission(ctx context.Context, org, repo, username string) (bool, error) {
+	c.started <- struct{}{}
+	<-ctx.Done()
+	return false, newTransientError("CheckPermission", ctx.Err())
+}
+
+func newShutdownTestRobot(t *testing.T, cli iClient) *robot {
+	cnf := &configuration{}
+	assert.Equal(t, nil, sutils.LoadFromYaml(findTestdata(t, configYaml), cnf))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	dedup, err := newEventDeduper(&dedupConfig{}, nil)
+	assert.Equal(t, nil, err)
+
+	bot := &robot{cli: cli, cnf: cnf, log: logrus.NewEntry(logger), dedup: dedup, inflight: newEventTracker()}
+	bot.ctx, bot.cancel = context.WithCancel(context.Background())
+	return bot
+}
+
+func newCloseEvent(guid string) *client.GenericEvent {
+	evt := &client.GenericEvent{}
+	_ = json.Unmarshal([]byte(`{"eventType":"Note Hook","eventGUID":"`+guid+`","commentKind":"Issue",
+		"comment":"/close","commenter":"maintainer1","author":"author1","org":"owner1","repo":"repo1",
+		"number":"5","state":"opened"}`), evt)
+	return evt
+}
+
+func TestEventTracker(t *testing.T) {
+	tracker := newEventTracker()
+	evt1, evt2, evt3 := newCloseEvent("guid1"), newCloseEvent("guid2"), newCloseEvent("guid3")
+	assert.Equal(t, true, tracker.add(evt2, false))
+	assert.Equal(t, true, tracker.add(evt3, true))
+	assert.Equal(t, true, tracker.add(evt1, false))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, false, tracker.wait(ctx))
+
+	// the redeliverable event is left to its source
+	assert.Equal(t, []*client.GenericEvent{evt2, evt1}, tracker.close())
+	assert.Equal(t, false, tracker.add(newCloseEvent("guid4"), false))
+
+	tracker.done(evt1)
+	tracker.done(evt2)
+	tracker.done(evt3)
+	assert.Equal(t, true, tracker.wait(context.Background()))
+}
+
+func TestShutdownAndResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unfinished_events.json")
+
+	cli := &blockingClient{started: make(chan struct{})}
+	bot := newShutdownTestRobot(t, cli)
+	bot.unfinished = &unfinishedEvents{path: path}
+	handled := make(chan struct{})
+	go func() {
+		bot.handleCommentEvent(newCloseEvent("guid1"), bot.cnf, bot.log)
+		close(handled)
+	}()
+	<-cli.started
+
+	// the event is still waiting for the platform after the timeout
+	assert.Equal(t, nil, bot.shutdown(20*time.Millisecond))
+	<-handled
+	events, err := readUnfinishedEvents(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "guid1", utils.GetString(events[0].EventGUID))
+	// the event can be handled again
+	_, dup := bot.dedup.begin("guid1")
+	assert.Equal(t, false, dup)
+
+	// the event arriving after the shutdown is written too
+	_, err = bot.handleEvent(newCloseEvent("guid2"), bot.log)
+	assert.Equal(t, errEventInterrupted, err)
+	events, err = readUnfinishedEvents(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "guid2", utils.GetString(events[1].EventGUID))
+
+	// the next instance handles the events
+	mc := &mockClient{successfulCheckPermission: true, permission: true, successfulUpdateIssue: true}
+	next := newShutdownTestRobot(t, mc)
+	next.unfinished = &unfinishedEvents{path: path}
+	assert.Equal(t, nil, next.resumeUnfinishedEvents())
+	assert.Equal(t, "UpdateIssue", mc.method)
+	_, err = os.Stat(path)
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	// nothing is written if all the events are done
+	assert.Equal(t, nil, next.shutdown(time.Second))
+	_, err = os.Stat(path)
+	assert.Equal(t, true, os.IsNotExist(err))
+	assert.Equal(t, nil, next.resumeUnfinishedEvents())
+}
+
+func TestResumeInterrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unfinished_events.json")
+	assert.Equal(t, nil, writeUnfinishedEvents(path, []*client.GenericEvent{
+		newCloseEvent("guid1"), newCloseEvent("guid2"),
+	}))
+
+	// the instance is shut down while it resumes the first event
+	cli := &blockingClient{started: make(chan struct{})}
+	bot := newShutdownTestRobot(t, cli)
+	bot.unfinished = &unfinishedEvents{path: path}
+	resumed := make(chan error)
+	go func() {
+		resumed <- bot.resumeUnfinishedEvents()
+	}()
+	<-cli.started
+	assert.Equal(t, nil, bot.shutdown(20*time.Millisecond))
+	assert.Equal(t, nil, <-resumed)
+
+	// no event is lost, the event left again is written twice
+	events, err := readUnfinishedEvents(path)
+	assert.Equal(t, nil, err)
+	guids := make([]string, 0, len(events))
+	for _, evt := range events {
+		guids = append(guids, utils.GetString(evt.EventGUID))
+	}
+	assert.Equal(t, []string{"guid1", "guid2", "guid1"}, guids)
+
+	// the done event is removed from the file at once
+	mc := &mockClient{successfulCheckPermission: true, permission: true, successfulUpdateIssue: true}
+	next := newShutdownTestRobot(t, mc)
+	next.unfinished = &unfinishedEvents{path: path}
+	assert.Equal(t, nil, next.unfinished.remove(events[0]))
+	events, err = readUnfinishedEvents(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "guid2", utils.GetString(events[0].EventGUID))
+
+	assert.Equal(t, nil, next.resumeUnfinishedEvents())
+	_, err = os.Stat(path)
+	assert.Equal(t, true, os.IsNotExist(err))
+}